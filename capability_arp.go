@@ -1,6 +1,9 @@
 package exu
 
-import log "github.com/sirupsen/logrus"
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+)
 
 type CapabilityArp struct {
 	*IpDevice
@@ -15,7 +18,7 @@ func (c CapabilityArp) HandleRequest(port *VPort, data *EthernetFrame) Capabilit
 	}
 
 	// if this is an ARP response, check if it's for one of our ports
-	if arpPayload.Opcode == ArpOpcodeReply && arpPayload.TargetIP.Equal(c.portIPs[port].IP) {
+	if arpPayload.Opcode == ArpOpcodeReply && arpPayload.TargetIP.Equal(c.portIP(port).IP) {
 		c.arpTableMu.Lock()
 		defer c.arpTableMu.Unlock()
 
@@ -32,7 +35,14 @@ func (c CapabilityArp) HandleRequest(port *VPort, data *EthernetFrame) Capabilit
 	}
 
 	// if the ARP packet is for one of our ports, reply with our MAC address
-	if c.portIPs[port].IP.Equal(arpPayload.TargetIP) {
+	if c.portIP(port).IP.Equal(arpPayload.TargetIP) {
+		// the sender is likely to be talked to soon, so it is learned right away
+		if !arpPayload.SenderIP.Equal(net.IPv4zero) {
+			c.arpTableMu.Lock()
+			c.arpTable[arpPayload.SenderIP.String()] = append(net.HardwareAddr{}, arpPayload.SenderMac...)
+			c.arpTableMu.Unlock()
+		}
+
 		// create the ARP payload
 		arpResponsePayload := &ArpPacket{
 			HardwareType: arpPayload.HardwareType,
@@ -16,9 +16,8 @@ func (c CapabilityForwardArp) HandleRequest(port *VPort, data *EthernetFrame) Ca
 
 	// if the ARP packet is not for one of our ports, forward it
 	// look in the MAC address table for the destination port
-	c.macAddressMapMu.RLock()
-	dstPort, ok := c.macAddressMap[arpPayload.TargetMac.String()]
-	c.macAddressMapMu.RUnlock()
+	vlan, _ := c.classifyFn(port, data)
+	dstPort, ok := c.lookupMacAddress(vlan, arpPayload.TargetMac)
 
 	log.WithFields(log.Fields{
 		"device":    c.name,
@@ -29,7 +28,11 @@ func (c CapabilityForwardArp) HandleRequest(port *VPort, data *EthernetFrame) Ca
 
 	// if we don't have the MAC address in our map, flood the frame to all ports
 	if !ok {
-		for _, p := range c.ports {
+		c.portsMu.RLock()
+		ports := c.floodPorts()
+		c.portsMu.RUnlock()
+
+		for _, p := range ports {
 			if p != port {
 				_ = c.WriteFromPort(p, data)
 			}
@@ -52,7 +55,7 @@ func (c CapabilityForwardArp) Match(port *VPort, data *EthernetFrame) bool {
 		}
 
 		// if the ARP packet is not for one of our ports, forward it
-		if !c.portIPs[port].IP.Equal(arpPayload.TargetIP) {
+		if !c.portIP(port).IP.Equal(arpPayload.TargetIP) {
 			return true
 		}
 	}
@@ -1,6 +1,10 @@
 package exu
 
-import log "github.com/sirupsen/logrus"
+import (
+	"encoding/binary"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
 
 type CapabilityIcmp struct {
 	*IpDevice
@@ -20,7 +24,12 @@ func (c CapabilityIcmp) HandleRequest(port *VPort, data *EthernetFrame) Capabili
 	}
 
 	// if the packet is for one of our ports, reply with an ICMP echo reply
-	if c.portIPs[port].IP.Equal(ipv4Packet.Header.DestinationIP) {
+	if c.portIP(port).IP.Equal(ipv4Packet.Header.DestinationIP) {
+		// other messages, e.g. errors about packets we sent, are not answered
+		if icmpPayload.Type != ICMPTypeEcho {
+			return CapabilityStatusDone
+		}
+
 		log.WithFields(log.Fields{
 			"device":    c.name,
 			"port":      port.portCname,
@@ -28,33 +37,7 @@ func (c CapabilityIcmp) HandleRequest(port *VPort, data *EthernetFrame) Capabili
 			"capabilty": "icmp",
 		}).Debug("received ICMP packet")
 
-		// create the ICMP payload
-		icmpResponsePayload := &ICMPPayload{
-			Type: ICMPTypeEchoReply,
-			Code: 0,
-			Data: icmpPayload.Data,
-		}
-		icmpResponsePayload.Checksum = icmpResponsePayload.CalculateChecksum()
-
-		icmpResponsePayloadBytes, _ := icmpResponsePayload.MarshalBinary()
-
-		ipv4ResponsePacket := &IPv4Packet{
-			Header: IPv4Header{
-				Version:        4,
-				IHL:            5,
-				TOS:            0,
-				TotalLength:    uint16(20 + len(icmpResponsePayloadBytes)),
-				ID:             0,
-				FlagsFragment:  0,
-				TTL:            64,
-				Protocol:       IPv4ProtocolICMP,
-				HeaderChecksum: 0,
-				SourceIP:       c.portIPs[port].IP,
-				DestinationIP:  ipv4Packet.Header.SourceIP,
-			},
-			Payload: icmpResponsePayloadBytes,
-		}
-		ipv4ResponsePacket.Header.HeaderChecksum = ipv4ResponsePacket.Header.CalculateChecksum()
+		ipv4ResponsePacket := newIcmpEchoReply(c.portIP(port).IP, ipv4Packet.Header.SourceIP, icmpPayload)
 
 		// create the ethernet frame
 		ethernetFrame, err := NewEthernetFrame(data.Source(), data.Destination(), WithTagging(TaggingUntagged), ipv4ResponsePacket)
@@ -92,3 +75,74 @@ func (c CapabilityIcmp) Match(_ *VPort, data *EthernetFrame) bool {
 
 	return false
 }
+
+// newIcmpEchoReply returns the IPv4 packet answering the ICMP echo request.
+func newIcmpEchoReply(src, dst net.IP, request *ICMPPayload) *IPv4Packet {
+	// create the ICMP payload
+	icmpResponsePayload := &ICMPPayload{
+		Type: ICMPTypeEchoReply,
+		Code: 0,
+		Data: request.Data,
+	}
+	icmpResponsePayload.Checksum = icmpResponsePayload.CalculateChecksum()
+
+	icmpResponsePayloadBytes, _ := icmpResponsePayload.MarshalBinary()
+
+	ipv4ResponsePacket := &IPv4Packet{
+		Header: IPv4Header{
+			Version:        4,
+			IHL:            5,
+			TOS:            0,
+			TotalLength:    uint16(20 + len(icmpResponsePayloadBytes)),
+			ID:             0,
+			FlagsFragment:  0,
+			TTL:            64,
+			Protocol:       IPv4ProtocolICMP,
+			HeaderChecksum: 0,
+			SourceIP:       src,
+			DestinationIP:  dst,
+		},
+		Payload: icmpResponsePayloadBytes,
+	}
+	ipv4ResponsePacket.Header.HeaderChecksum = ipv4ResponsePacket.Header.CalculateChecksum()
+
+	return ipv4ResponsePacket
+}
+
+// newIcmpError returns an ICMP error message about original, quoting its header and
+// the first 8 bytes of its payload. rest is the second word of the ICMP header,
+// e.g. the next-hop MTU of a fragmentation needed message.
+func newIcmpError(src, dst net.IP, icmpType ICMPType, code uint8, rest uint32, original []byte) *IPv4Packet {
+	quoted := original
+	if len(quoted) > 20+8 {
+		quoted = quoted[:20+8]
+	}
+
+	data := make([]byte, 4+len(quoted))
+	binary.BigEndian.PutUint32(data[0:4], rest)
+	copy(data[4:], quoted)
+
+	icmpPayload := &ICMPPayload{
+		Type: icmpType,
+		Code: code,
+		Data: data,
+	}
+	icmpPayload.Checksum = icmpPayload.CalculateChecksum()
+	icmpPayloadBytes, _ := icmpPayload.MarshalBinary()
+
+	packet := &IPv4Packet{
+		Header: IPv4Header{
+			Version:       4,
+			IHL:           5,
+			TotalLength:   uint16(20 + len(icmpPayloadBytes)),
+			TTL:           64,
+			Protocol:      IPv4ProtocolICMP,
+			SourceIP:      src,
+			DestinationIP: dst,
+		},
+		Payload: icmpPayloadBytes,
+	}
+	packet.Header.HeaderChecksum = packet.Header.CalculateChecksum()
+
+	return packet
+}
@@ -0,0 +1,16 @@
+package exu
+
+// CapabilityLldp feeds LLDPDUs to the LLDP agent of a device. LLDPDUs are consumed
+// even while LLDP is disabled, they are never forwarded.
+type CapabilityLldp struct {
+	*EthernetDevice
+}
+
+func (c CapabilityLldp) HandleRequest(port *VPort, data *EthernetFrame) CapabilityStatus {
+	c.lldpReceive(port, data)
+	return CapabilityStatusDone
+}
+
+func (c CapabilityLldp) Match(_ *VPort, data *EthernetFrame) bool {
+	return isLldpdu(data)
+}
@@ -0,0 +1,25 @@
+package exu
+
+type CapabilityStp struct {
+	*VSwitch
+}
+
+func (c CapabilityStp) HandleRequest(port *VPort, data *EthernetFrame) CapabilityStatus {
+	bpdu := &BpduPacket{}
+	err := bpdu.UnmarshalBinary(data.Payload())
+	if err != nil {
+		return CapabilityStatusFail
+	}
+
+	c.stpReceive(port, bpdu)
+	return CapabilityStatusDone
+}
+
+func (c CapabilityStp) Match(port *VPort, data *EthernetFrame) bool {
+	c.stp.mu.Lock()
+	enabled := c.stp.enabled
+	c.stp.mu.Unlock()
+
+	// BPDUs on QinQ ports belong to the customer
+	return enabled && isBpdu(data) && !c.isTunnelPort(port)
+}
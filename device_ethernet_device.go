@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type EthernetDevice struct {
@@ -15,8 +16,37 @@ type EthernetDevice struct {
 	ports   []*VPort
 	portsMu sync.RWMutex
 
-	macAddressMap   map[string]*VPort
+	macAddressMap   map[macAddressKey]*macAddressEntry
 	macAddressMapMu sync.RWMutex
+	macAgingTime    time.Duration
+	macTableLimit   int
+	onMacMoveFn     func(mac net.HardwareAddr, vlan uint16, from, to *VPort)
+
+	// classifyFn returns the VLAN a frame received on a port belongs to, or false
+	// if the frame must not be learned from
+	classifyFn func(port *VPort, data *EthernetFrame) (uint16, bool)
+	// macTableVlanFn returns the VLAN the static addresses of a VLAN are kept in, it
+	// has to agree with classifyFn
+	macTableVlanFn func(vlan uint16) uint16
+	// macTableSharedFn returns the VLANs whose addresses are kept in the table of
+	// another VLAN, keyed by that VLAN
+	macTableSharedFn func() map[uint16][]uint16
+	// ingressFilters run before a classified frame is learned from, if any of them
+	// returns false the frame is dropped
+	ingressFilters []func(port *VPort, vlan uint16, data *EthernetFrame) bool
+
+	portChannels       []*PortChannel
+	portChannelMembers map[*VPort]*PortChannel
+	portChannelCount   int
+	portChannelsMu     sync.RWMutex
+	// onPortChannelFn is called after a port-channel was created or removed
+	onPortChannelFn func(pc *PortChannel, added bool)
+
+	// virtualPorts are logical ports that are not backed by a physical port, e.g.
+	// the tunnel interface of a VTEP. They are guarded by portsMu.
+	virtualPorts []*VPort
+
+	lldp lldpAgent
 
 	capabilities []Capability
 
@@ -32,15 +62,23 @@ type EthernetReceiver interface {
 func NewEthernetDevice(name string, numberOfPorts int, onReceive func(srcPort *VPort, data *EthernetFrame), onConnect func(port *VPort), onDisconnect func(port *VPort)) *EthernetDevice {
 	dev := new(EthernetDevice)
 	*dev = EthernetDevice{
-		name:            name,
-		ports:           make([]*VPort, numberOfPorts),
-		portsMu:         sync.RWMutex{},
-		macAddressMap:   make(map[string]*VPort),
-		macAddressMapMu: sync.RWMutex{},
-		capabilities:    make([]Capability, 0),
-		onReceiveFn:     onReceive,
-		onConnectFn:     onConnect,
-		onDisconnectFn:  onDisconnect,
+		name:               name,
+		ports:              make([]*VPort, numberOfPorts),
+		portsMu:            sync.RWMutex{},
+		macAddressMap:      make(map[macAddressKey]*macAddressEntry),
+		macAddressMapMu:    sync.RWMutex{},
+		macAgingTime:       DefaultMacAgingTime,
+		classifyFn:         classifyByTag,
+		macTableVlanFn:     ownMacTableVlan,
+		macTableSharedFn:   noSharedMacTables,
+		portChannelMembers: make(map[*VPort]*PortChannel),
+		lldp: lldpAgent{
+			neighbors: make(map[lldpNeighborKey]*lldpNeighbor),
+		},
+		capabilities:   make([]Capability, 0),
+		onReceiveFn:    onReceive,
+		onConnectFn:    onConnect,
+		onDisconnectFn: onDisconnect,
 	}
 
 	for i := 0; i < numberOfPorts; i++ {
@@ -56,40 +94,15 @@ func NewEthernetDevice(name string, numberOfPorts int, onReceive func(srcPort *V
 		dev.ports[i] = NewVPort(mac, "eth0/"+strconv.Itoa(i))
 		func(i int) {
 			dev.ports[i].SetOnReceive(func(data *EthernetFrame) {
-				// check if we already have the source MAC address in our map
-				dev.macAddressMapMu.RLock()
-				_, ok := dev.macAddressMap[data.Source().String()]
-				dev.macAddressMapMu.RUnlock()
-
-				// if we don't have the source MAC address in our map, add it
-				if !ok && data.Source().String() != "ff:ff:ff:ff:ff:ff" {
-					dev.macAddressMapMu.Lock()
-					dev.macAddressMap[data.Source().String()] = dev.ports[i]
-					dev.macAddressMapMu.Unlock()
-
-					log.WithField("mac", data.Source().String()).
-						WithField("port", dev.ports[i].portCname).
-						WithField("device", dev.name).
-						Trace("learned new mac address")
-				}
+				port := dev.ports[i]
 
-				// check all capabilities
-				for _, capability := range dev.capabilities {
-					if capability.Match(dev.ports[i], data) {
-						res := capability.HandleRequest(dev.ports[i], data)
-						switch res {
-						case CapabilityStatusDone:
-							goto done
-						case CapabilityStatusFail:
-							goto done
-						case CapabilityStatusPass:
-							continue
-						}
-					}
+				// LACPDUs are handled per member port, everything else is received on
+				// the port-channel the port is a member of
+				if isLacpdu(data) {
+					dev.lacpReceive(port, data)
+					return
 				}
-
-				dev.onReceiveFn(dev.ports[i], data)
-			done:
+				dev.receive(dev.logicalPort(port), data)
 			})
 		}(i)
 	}
@@ -97,6 +110,52 @@ func NewEthernetDevice(name string, numberOfPorts int, onReceive func(srcPort *V
 	return dev
 }
 
+// receive runs a frame received on port through classification, the ingress
+// filters, MAC learning and the capabilities of the device before handing it to
+// the device itself.
+func (e *EthernetDevice) receive(port *VPort, data *EthernetFrame) {
+	// learn or refresh the source MAC address
+	if vlan, ok := e.classifyFn(port, data); ok {
+		for _, filter := range e.ingressFilters {
+			if !filter(port, vlan, data) {
+				return
+			}
+		}
+
+		e.learnMacAddress(port, vlan, data.Source())
+	}
+
+	// check all capabilities
+	for _, capability := range e.capabilities {
+		if capability.Match(port, data) {
+			switch capability.HandleRequest(port, data) {
+			case CapabilityStatusDone, CapabilityStatusFail:
+				return
+			case CapabilityStatusPass:
+				continue
+			}
+		}
+	}
+
+	e.onReceiveFn(port, data)
+}
+
+// classifyByTag assigns frames to the VLAN of their outermost tag, untagged frames
+// belong to VLAN 0.
+func classifyByTag(_ *VPort, data *EthernetFrame) (uint16, bool) {
+	return data.VlanID(), true
+}
+
+// ownMacTableVlan keeps the addresses of every VLAN in a table of its own.
+func ownMacTableVlan(vlan uint16) uint16 {
+	return vlan
+}
+
+// noSharedMacTables is the counterpart of ownMacTableVlan, no table is shared.
+func noSharedMacTables() map[uint16][]uint16 {
+	return nil
+}
+
 func (e *EthernetDevice) WriteFromPort(port *VPort, data *EthernetFrame) error {
 	e.portsMu.RLock()
 	defer e.portsMu.RUnlock()
@@ -109,7 +168,7 @@ func (e *EthernetDevice) WriteFromPort(port *VPort, data *EthernetFrame) error {
 		}
 	}
 
-	if !found {
+	if !found && !e.isPortChannelPort(port) {
 		return errors.New("port not found")
 	}
 
@@ -120,12 +179,47 @@ func (e *EthernetDevice) WriteFromPort(port *VPort, data *EthernetFrame) error {
 	return port.Write(data)
 }
 
+// SetMTU sets the MTU of all ports of the device, including port-channels.
+func (e *EthernetDevice) SetMTU(mtu int) error {
+	e.portsMu.RLock()
+	defer e.portsMu.RUnlock()
+
+	// members of port-channels are not flood ports, port-channels are not in ports
+	for _, port := range append(e.floodPorts(), e.ports...) {
+		if err := port.SetMTU(mtu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addVirtualPort adds a port that is not backed by a physical port to the device.
+func (e *EthernetDevice) addVirtualPort(port *VPort) {
+	e.portsMu.Lock()
+	defer e.portsMu.Unlock()
+
+	e.virtualPorts = append(e.virtualPorts, port)
+}
+
+// removeVirtualPort removes a port added with addVirtualPort.
+func (e *EthernetDevice) removeVirtualPort(port *VPort) {
+	e.portsMu.Lock()
+	defer e.portsMu.Unlock()
+
+	for i, other := range e.virtualPorts {
+		if other == port {
+			e.virtualPorts = append(e.virtualPorts[:i], e.virtualPorts[i+1:]...)
+			return
+		}
+	}
+}
+
 func (e *EthernetDevice) GetFirstFreePort() *VPort {
 	e.portsMu.Lock()
 	defer e.portsMu.Unlock()
 
 	for _, port := range e.ports {
-		if port.connectedTo == nil {
+		if port.peer() == nil {
 			return port
 		}
 	}
@@ -138,8 +232,8 @@ func (e *EthernetDevice) connectPorts(portOnMachine int, target *VPort) {
 		WithField("port", target.mac.String()).
 		Info("connected port")
 
-	e.ports[portOnMachine].connectedTo = target
-	target.connectedTo = e.ports[portOnMachine]
+	e.ports[portOnMachine].setPeer(target)
+	target.setPeer(e.ports[portOnMachine])
 	e.onConnectFn(e.ports[portOnMachine])
 }
 
@@ -148,7 +242,7 @@ func (e *EthernetDevice) ConnectToFirstAvailablePort(target *VPort) error {
 	defer e.portsMu.Unlock()
 
 	for i, port := range e.ports {
-		if port.connectedTo == nil {
+		if port.peer() == nil {
 			e.connectPorts(i, target)
 			return nil
 		}
@@ -173,7 +267,7 @@ func (e *EthernetDevice) ConnectPorts(portOnMachine, target *VPort) error {
 		return errors.New("port not found on machine")
 	}
 
-	if e.ports[index].connectedTo != nil {
+	if e.ports[index].peer() != nil {
 		return errors.New("port already connected")
 	}
 
@@ -190,20 +284,13 @@ func (e *EthernetDevice) DisconnectPort(target *VPort) {
 	defer e.portsMu.Unlock()
 
 	for _, port := range e.ports {
-		if port.connectedTo == target {
-			port.connectedTo = nil
-			port.onReceive = nil
+		if port.peer() == target {
+			port.setPeer(nil)
+			target.setPeer(nil)
+			port.SetOnReceive(nil)
 			e.onDisconnectFn(port)
-			break
-		}
-	}
-
-	e.macAddressMapMu.Lock()
-	defer e.macAddressMapMu.Unlock()
-
-	for mac, port := range e.macAddressMap {
-		if port == target {
-			delete(e.macAddressMap, mac)
+			e.FlushMacAddressesOnPort(port)
+			e.lldpForgetPort(port)
 			break
 		}
 	}
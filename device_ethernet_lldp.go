@@ -0,0 +1,241 @@
+package exu
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLldpInterval       = 30 * time.Second
+	DefaultLldpHoldMultiplier = 4
+)
+
+type LldpConfig struct {
+	// Interval is the time between two LLDPDUs, defaults to DefaultLldpInterval
+	Interval time.Duration
+	// HoldMultiplier times Interval is the time neighbors keep our information,
+	// defaults to DefaultLldpHoldMultiplier
+	HoldMultiplier int
+}
+
+// LldpNeighbor is a device seen on a local port via LLDP.
+type LldpNeighbor struct {
+	// Port is the local port the neighbor was seen on
+	Port              *VPort
+	ChassisID         string
+	PortID            string
+	PortDescription   string
+	SystemName        string
+	ManagementAddress net.IP
+	// ExpiresIn is the time until the neighbor is removed if no new LLDPDU is received
+	ExpiresIn time.Duration
+}
+
+type lldpNeighborKey struct {
+	port      *VPort
+	chassisID string
+	portID    string
+}
+
+type lldpNeighbor struct {
+	packet  LldpPacket
+	expires time.Time
+}
+
+type lldpAgent struct {
+	mu        sync.Mutex
+	enabled   bool
+	config    LldpConfig
+	stop      chan struct{}
+	neighbors map[lldpNeighborKey]*lldpNeighbor
+	// managementAddressFn returns the address advertised on a port, devices
+	// without addresses leave it nil
+	managementAddressFn func(port *VPort) net.IP
+}
+
+// EnableLldp starts sending LLDPDUs on all ports and collecting the neighbors
+// seen on them.
+func (e *EthernetDevice) EnableLldp(config LldpConfig) {
+	if config.Interval == 0 {
+		config.Interval = DefaultLldpInterval
+	}
+	if config.HoldMultiplier == 0 {
+		config.HoldMultiplier = DefaultLldpHoldMultiplier
+	}
+
+	e.lldp.mu.Lock()
+	if e.lldp.enabled {
+		close(e.lldp.stop)
+	}
+	e.lldp.enabled = true
+	e.lldp.config = config
+	e.lldp.stop = make(chan struct{})
+	stop := e.lldp.stop
+	e.lldp.mu.Unlock()
+
+	log.WithField("device", e.name).
+		Info("enabled lldp")
+
+	go e.lldpRun(stop, config)
+}
+
+// DisableLldp stops LLDP, neighbors are told to forget us right away.
+func (e *EthernetDevice) DisableLldp() {
+	e.lldp.mu.Lock()
+	if !e.lldp.enabled {
+		e.lldp.mu.Unlock()
+		return
+	}
+
+	close(e.lldp.stop)
+	e.lldp.enabled = false
+	e.lldp.neighbors = make(map[lldpNeighborKey]*lldpNeighbor)
+	e.lldp.mu.Unlock()
+
+	e.lldpSend(0)
+}
+
+// LldpNeighbors returns all neighbors that did not expire yet, sorted by local port.
+func (e *EthernetDevice) LldpNeighbors() []LldpNeighbor {
+	e.lldp.mu.Lock()
+	defer e.lldp.mu.Unlock()
+
+	now := time.Now()
+	neighbors := make([]LldpNeighbor, 0)
+	for key, neighbor := range e.lldp.neighbors {
+		if !now.Before(neighbor.expires) {
+			delete(e.lldp.neighbors, key)
+			continue
+		}
+
+		neighbors = append(neighbors, LldpNeighbor{
+			Port:              key.port,
+			ChassisID:         neighbor.packet.ChassisID,
+			PortID:            neighbor.packet.PortID,
+			PortDescription:   neighbor.packet.PortDescription,
+			SystemName:        neighbor.packet.SystemName,
+			ManagementAddress: neighbor.packet.ManagementAddress,
+			ExpiresIn:         neighbor.expires.Sub(now),
+		})
+	}
+
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Port != neighbors[j].Port {
+			return neighbors[i].Port.portCname < neighbors[j].Port.portCname
+		}
+		if neighbors[i].ChassisID != neighbors[j].ChassisID {
+			return neighbors[i].ChassisID < neighbors[j].ChassisID
+		}
+		return neighbors[i].PortID < neighbors[j].PortID
+	})
+
+	return neighbors
+}
+
+// lldpForgetPort removes all neighbors seen on port.
+func (e *EthernetDevice) lldpForgetPort(port *VPort) {
+	e.lldp.mu.Lock()
+	defer e.lldp.mu.Unlock()
+
+	for key := range e.lldp.neighbors {
+		if key.port == port {
+			delete(e.lldp.neighbors, key)
+		}
+	}
+}
+
+func (e *EthernetDevice) lldpRun(stop chan struct{}, config LldpConfig) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	// TTLs are sent in seconds, round up so short intervals do not expire right away
+	hold := config.Interval * time.Duration(config.HoldMultiplier)
+	ttl := uint16((hold + time.Second - 1) / time.Second)
+
+	for {
+		e.lldpSend(ttl)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lldpSend sends an LLDPDU with the given TTL on every connected port.
+func (e *EthernetDevice) lldpSend(ttl uint16) {
+	e.lldp.mu.Lock()
+	managementAddressFn := e.lldp.managementAddressFn
+	e.lldp.mu.Unlock()
+
+	e.portsMu.RLock()
+	ports := append([]*VPort{}, e.ports...)
+	e.portsMu.RUnlock()
+
+	for _, port := range ports {
+		if port.peer() == nil {
+			continue
+		}
+
+		lldpdu := &LldpPacket{
+			ChassisID:       ports[0].mac.String(),
+			PortID:          port.portCname,
+			TTL:             ttl,
+			PortDescription: port.portCname,
+			SystemName:      e.name,
+		}
+		if managementAddressFn != nil {
+			lldpdu.ManagementAddress = managementAddressFn(port)
+		}
+
+		frame, err := NewEthernetFrame(LldpMAC, port.mac, WithTagging(TaggingUntagged), lldpdu)
+		if err != nil {
+			continue
+		}
+
+		_ = port.Write(frame)
+	}
+}
+
+// lldpReceive processes an LLDPDU received on port.
+func (e *EthernetDevice) lldpReceive(port *VPort, data *EthernetFrame) {
+	lldpdu := &LldpPacket{}
+	if err := lldpdu.UnmarshalBinary(data.Payload()); err != nil {
+		return
+	}
+
+	e.lldp.mu.Lock()
+	defer e.lldp.mu.Unlock()
+
+	if !e.lldp.enabled {
+		return
+	}
+
+	key := lldpNeighborKey{
+		port:      port,
+		chassisID: lldpdu.ChassisID,
+		portID:    lldpdu.PortID,
+	}
+
+	if lldpdu.TTL == 0 {
+		delete(e.lldp.neighbors, key)
+		return
+	}
+
+	if _, ok := e.lldp.neighbors[key]; !ok {
+		log.WithField("device", e.name).
+			WithField("port", port.portCname).
+			WithField("neighbor", lldpdu.SystemName).
+			WithField("neighbor_port", lldpdu.PortID).
+			Debug("discovered lldp neighbor")
+	}
+
+	e.lldp.neighbors[key] = &lldpNeighbor{
+		packet:  *lldpdu,
+		expires: time.Now().Add(time.Duration(lldpdu.TTL) * time.Second),
+	}
+}
@@ -0,0 +1,446 @@
+package exu
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LinkAggregationMode int
+
+const (
+	// LinkAggregationStatic uses every connected member without negotiation
+	LinkAggregationStatic LinkAggregationMode = iota
+	// LinkAggregationLacpActive negotiates with LACP and sends LACPDUs on its own
+	LinkAggregationLacpActive
+	// LinkAggregationLacpPassive negotiates with LACP but only answers an active partner
+	LinkAggregationLacpPassive
+)
+
+const (
+	DefaultLacpInterval       = time.Second
+	DefaultLacpSystemPriority = uint16(32768)
+	DefaultLacpPortPriority   = uint16(32768)
+)
+
+type PortChannelConfig struct {
+	Mode LinkAggregationMode
+	// Key identifies the port-channel in LACPDUs, defaults to the port-channel number
+	Key            uint16
+	SystemPriority uint16
+	// LacpInterval is the time between two LACPDUs, a partner that was not heard
+	// from for three intervals is considered gone
+	LacpInterval time.Duration
+}
+
+type portChannelMember struct {
+	port           *VPort
+	number         uint16
+	partner        *LacpInfo
+	partnerSeesUs  bool
+	partnerExpires time.Time
+	distributing   bool
+}
+
+// PortChannel groups several ports of an EthernetDevice into one logical port.
+type PortChannel struct {
+	device  *EthernetDevice
+	port    *VPort
+	config  PortChannelConfig
+	mu      sync.Mutex
+	members []*portChannelMember
+	stop    chan struct{}
+}
+
+// NewPortChannel groups members into a port-channel. The MAC address table,
+// flooding and the spanning tree of a VSwitch treat the port-channel as a single
+// port, frames are distributed over the active members by a hash of their addresses.
+func (e *EthernetDevice) NewPortChannel(config PortChannelConfig, members ...*VPort) (*PortChannel, error) {
+	pc, err := e.newPortChannel(config, members)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.onPortChannelFn != nil {
+		e.onPortChannelFn(pc, true)
+	}
+
+	if config.Mode != LinkAggregationStatic {
+		go pc.runLacp()
+	}
+
+	return pc, nil
+}
+
+// newPortChannel creates a port-channel and registers it with the device.
+func (e *EthernetDevice) newPortChannel(config PortChannelConfig, members []*VPort) (*PortChannel, error) {
+	if len(members) == 0 {
+		return nil, errors.New("port-channel needs at least one member")
+	}
+
+	e.portsMu.RLock()
+	defer e.portsMu.RUnlock()
+
+	e.portChannelsMu.Lock()
+	defer e.portChannelsMu.Unlock()
+
+	numbers := make([]uint16, len(members))
+	for i, member := range members {
+		for j, port := range e.ports {
+			if port == member {
+				numbers[i] = uint16(j + 1)
+			}
+		}
+
+		if numbers[i] == 0 {
+			return nil, errors.New("port not found on machine")
+		}
+
+		if _, ok := e.portChannelMembers[member]; ok {
+			return nil, errors.New("port is already a member of a port-channel")
+		}
+	}
+
+	e.portChannelCount++
+	if config.Key == 0 {
+		config.Key = uint16(e.portChannelCount)
+	}
+	if config.SystemPriority == 0 {
+		config.SystemPriority = DefaultLacpSystemPriority
+	}
+	if config.LacpInterval == 0 {
+		config.LacpInterval = DefaultLacpInterval
+	}
+
+	pc := &PortChannel{
+		device: e,
+		config: config,
+		stop:   make(chan struct{}),
+	}
+	pc.port = NewVPort(members[0].mac, "Port-channel"+strconv.Itoa(e.portChannelCount))
+	pc.port.writeFn = pc.write
+
+	for i, member := range members {
+		pc.members = append(pc.members, &portChannelMember{
+			port:   member,
+			number: numbers[i],
+		})
+		e.portChannelMembers[member] = pc
+	}
+	e.portChannels = append(e.portChannels, pc)
+
+	// addresses are learned on the port-channel from now on
+	for _, member := range members {
+		e.FlushMacAddressesOnPort(member)
+	}
+
+	log.WithField("device", e.name).
+		WithField("port", pc.port.portCname).
+		WithField("members", len(members)).
+		Info("created port-channel")
+
+	return pc, nil
+}
+
+// RemovePortChannel dissolves a port-channel, its members become individual
+// ports again.
+func (e *EthernetDevice) RemovePortChannel(pc *PortChannel) {
+	e.portChannelsMu.Lock()
+	for i, other := range e.portChannels {
+		if other == pc {
+			e.portChannels = append(e.portChannels[:i], e.portChannels[i+1:]...)
+			break
+		}
+	}
+	for _, member := range pc.members {
+		delete(e.portChannelMembers, member.port)
+	}
+	e.portChannelsMu.Unlock()
+
+	close(pc.stop)
+	e.FlushMacAddressesOnPort(pc.port)
+
+	if e.onPortChannelFn != nil {
+		e.onPortChannelFn(pc, false)
+	}
+}
+
+// Port returns the logical port of the port-channel.
+func (pc *PortChannel) Port() *VPort {
+	return pc.port
+}
+
+// Members returns all member ports of the port-channel.
+func (pc *PortChannel) Members() []*VPort {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	members := make([]*VPort, len(pc.members))
+	for i, member := range pc.members {
+		members[i] = member.port
+	}
+	return members
+}
+
+// ActiveMembers returns the member ports frames are currently distributed over.
+func (pc *PortChannel) ActiveMembers() []*VPort {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.activeMembers()
+}
+
+// activeMembers returns the distributing members. The caller must hold pc.mu.
+func (pc *PortChannel) activeMembers() []*VPort {
+	active := make([]*VPort, 0, len(pc.members))
+	for _, member := range pc.members {
+		if member.port.peer() == nil {
+			continue
+		}
+
+		if pc.config.Mode == LinkAggregationStatic || member.distributing {
+			active = append(active, member.port)
+		}
+	}
+	return active
+}
+
+// write sends the frame on one of the active members, chosen by a hash of the
+// addresses of the frame so all frames of a flow take the same link.
+func (pc *PortChannel) write(data *EthernetFrame) error {
+	pc.mu.Lock()
+	active := pc.activeMembers()
+	pc.mu.Unlock()
+
+	if len(active) == 0 {
+		return VPortNotConnectedError
+	}
+
+	return active[flowHash(data)%uint32(len(active))].Write(data)
+}
+
+// flowHash hashes the MAC addresses and, for IPv4 packets, the IP addresses of a frame.
+func flowHash(data *EthernetFrame) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write(data.Destination())
+	_, _ = hash.Write(data.Source())
+
+	if data.EtherType().Equal(EtherTypeIPv4) {
+		payload := data.Payload()
+		if len(payload) >= 20 {
+			_, _ = hash.Write(payload[12:20])
+		}
+	}
+
+	return hash.Sum32()
+}
+
+// logicalPort returns the port-channel port is a member of, or port itself.
+func (e *EthernetDevice) logicalPort(port *VPort) *VPort {
+	e.portChannelsMu.RLock()
+	defer e.portChannelsMu.RUnlock()
+
+	if pc, ok := e.portChannelMembers[port]; ok {
+		return pc.port
+	}
+	return port
+}
+
+// isPortChannelPort returns true if port is the logical port of a port-channel.
+func (e *EthernetDevice) isPortChannelPort(port *VPort) bool {
+	e.portChannelsMu.RLock()
+	defer e.portChannelsMu.RUnlock()
+
+	for _, pc := range e.portChannels {
+		if pc.port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// floodPorts returns all ports a frame has to be flooded to, with members of a
+// port-channel replaced by the port-channel, followed by the virtual ports. The
+// caller must hold portsMu.
+func (e *EthernetDevice) floodPorts() []*VPort {
+	e.portChannelsMu.RLock()
+	defer e.portChannelsMu.RUnlock()
+
+	ports := make([]*VPort, 0, len(e.ports))
+	added := make(map[*PortChannel]bool)
+	for _, port := range e.ports {
+		pc, ok := e.portChannelMembers[port]
+		if !ok {
+			ports = append(ports, port)
+			continue
+		}
+
+		if !added[pc] {
+			added[pc] = true
+			ports = append(ports, pc.port)
+		}
+	}
+	return append(ports, e.virtualPorts...)
+}
+
+// lacpActorInfo returns our side of the link of member. The caller must hold pc.mu.
+func (pc *PortChannel) lacpActorInfo(member *portChannelMember) LacpInfo {
+	state := LacpStateAggregation | LacpStateTimeout
+	if pc.config.Mode == LinkAggregationLacpActive {
+		state |= LacpStateActivity
+	}
+
+	if pc.selected(member) {
+		state |= LacpStateSynchronization | LacpStateCollecting
+		if member.distributing {
+			state |= LacpStateDistributing
+		}
+	}
+
+	if member.partner == nil {
+		state |= LacpStateDefaulted
+	}
+
+	return LacpInfo{
+		SystemPriority: pc.config.SystemPriority,
+		System:         pc.device.ports[0].mac,
+		Key:            pc.config.Key,
+		PortPriority:   DefaultLacpPortPriority,
+		Port:           member.number,
+		State:          state,
+	}
+}
+
+// selected returns true if member has a partner and it is the same partner system
+// as the one of all other selected members. The caller must hold pc.mu.
+func (pc *PortChannel) selected(member *portChannelMember) bool {
+	if member.partner == nil {
+		return false
+	}
+
+	for _, other := range pc.members {
+		if other.partner != nil {
+			return other.partner.SystemPriority == member.partner.SystemPriority &&
+				other.partner.System.String() == member.partner.System.String() &&
+				other.partner.Key == member.partner.Key
+		}
+	}
+	return false
+}
+
+// lacpSend sends an LACPDU on member. The caller must hold pc.mu.
+func (pc *PortChannel) lacpSend(member *portChannelMember) {
+	if member.port.peer() == nil {
+		return
+	}
+
+	lacpdu := &LacpPacket{
+		Actor: pc.lacpActorInfo(member),
+	}
+	if member.partner != nil {
+		lacpdu.Partner = *member.partner
+	}
+
+	frame, err := NewEthernetFrame(SlowProtocolsMAC, member.port.mac, WithTagging(TaggingUntagged), lacpdu)
+	if err != nil {
+		return
+	}
+
+	_ = member.port.Write(frame)
+}
+
+// updateDistributing starts or stops distributing on member depending on the
+// state of the negotiation and returns true if the state changed. The caller
+// must hold pc.mu.
+func (pc *PortChannel) updateDistributing(member *portChannelMember) bool {
+	distributing := pc.selected(member) && member.partnerSeesUs &&
+		member.partner.State&LacpStateSynchronization != 0
+
+	if distributing == member.distributing {
+		return false
+	}
+
+	member.distributing = distributing
+
+	entry := log.WithField("device", pc.device.name).
+		WithField("port", pc.port.portCname).
+		WithField("member", member.port.portCname)
+	if distributing {
+		entry.Info("port-channel member up")
+	} else {
+		entry.Info("port-channel member down")
+	}
+
+	return true
+}
+
+func (pc *PortChannel) runLacp() {
+	ticker := time.NewTicker(pc.config.LacpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pc.stop:
+			return
+		case now := <-ticker.C:
+			pc.mu.Lock()
+			for _, member := range pc.members {
+				if member.partner != nil && (now.After(member.partnerExpires) || member.port.peer() == nil) {
+					member.partner = nil
+					member.partnerSeesUs = false
+				}
+				pc.updateDistributing(member)
+
+				// passive members only talk to partners that started the negotiation
+				if pc.config.Mode == LinkAggregationLacpActive || member.partner != nil {
+					pc.lacpSend(member)
+				}
+			}
+			pc.mu.Unlock()
+		}
+	}
+}
+
+// lacpReceive processes an LACPDU received on a member port.
+func (e *EthernetDevice) lacpReceive(port *VPort, data *EthernetFrame) {
+	e.portChannelsMu.RLock()
+	pc, ok := e.portChannelMembers[port]
+	e.portChannelsMu.RUnlock()
+
+	if !ok || pc.config.Mode == LinkAggregationStatic {
+		return
+	}
+
+	lacpdu := &LacpPacket{}
+	if err := lacpdu.UnmarshalBinary(data.Payload()); err != nil {
+		return
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	var member *portChannelMember
+	for _, m := range pc.members {
+		if m.port == port {
+			member = m
+		}
+	}
+	if member == nil {
+		return
+	}
+
+	wasSelected := pc.selected(member)
+	partner := lacpdu.Actor
+	member.partner = &partner
+	member.partnerExpires = time.Now().Add(3 * pc.config.LacpInterval)
+	member.partnerSeesUs = lacpdu.Partner.sameLink(pc.lacpActorInfo(member))
+
+	// answer right away if our state changed, so the partner does not have to wait
+	// for the next interval
+	if pc.updateDistributing(member) || wasSelected != pc.selected(member) || !member.partnerSeesUs {
+		pc.lacpSend(member)
+	}
+}
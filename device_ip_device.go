@@ -7,14 +7,19 @@ import (
 	"time"
 )
 
+// DefaultArpTimeout is how long ArpResolve waits for a reply if no timeout is set.
+const DefaultArpTimeout = 5 * time.Second
+
 type IpDevice struct {
 	*EthernetDevice
+	portIPsMu      sync.RWMutex
 	portIPs        map[*VPort]net.IPNet
 	onReceiveIp    func(srcPort *VPort, data *EthernetFrame)
 	onConnectIp    func(port *VPort)
 	onDisconnectIp func(port *VPort)
 	arpTableMu     sync.RWMutex
 	arpTable       map[string]net.HardwareAddr
+	arpTimeout     time.Duration
 }
 
 func NewIpDevice(name string, numberOfPorts int, onReceive func(srcPort *VPort, data *EthernetFrame), onConnect func(port *VPort), onDisconnect func(port *VPort)) *IpDevice {
@@ -22,24 +27,34 @@ func NewIpDevice(name string, numberOfPorts int, onReceive func(srcPort *VPort,
 		portIPs:        make(map[*VPort]net.IPNet),
 		arpTable:       make(map[string]net.HardwareAddr),
 		arpTableMu:     sync.RWMutex{},
+		arpTimeout:     DefaultArpTimeout,
 		onReceiveIp:    onReceive,
 		onConnectIp:    onConnect,
 		onDisconnectIp: onDisconnect,
 	}
 
 	ipDevice.EthernetDevice = NewEthernetDevice(name, numberOfPorts, ipDevice.onReceive, func(*VPort) {}, ipDevice.onDisconnect)
+	ipDevice.EthernetDevice.capabilities = append(ipDevice.EthernetDevice.capabilities, CapabilityLldp{
+		EthernetDevice: ipDevice.EthernetDevice,
+	})
 	ipDevice.EthernetDevice.capabilities = append(ipDevice.EthernetDevice.capabilities, CapabilityIcmp{
 		IpDevice: ipDevice,
 	})
 	ipDevice.EthernetDevice.capabilities = append(ipDevice.EthernetDevice.capabilities, CapabilityArp{
 		IpDevice: ipDevice,
 	})
+	ipDevice.lldp.managementAddressFn = func(port *VPort) net.IP {
+		return ipDevice.portIP(port).IP
+	}
 
 	return ipDevice
 }
 
 func (d *IpDevice) SetPortIPNet(port *VPort, ipNet net.IPNet) {
+	d.portIPsMu.Lock()
 	d.portIPs[port] = ipNet
+	d.portIPsMu.Unlock()
+
 	log.WithFields(log.Fields{
 		"device": d.name,
 		"port":   port.portCname,
@@ -47,6 +62,34 @@ func (d *IpDevice) SetPortIPNet(port *VPort, ipNet net.IPNet) {
 	}).Debug("set port IP")
 }
 
+// portIP returns the address of port, the zero IPNet if it has none.
+func (d *IpDevice) portIP(port *VPort) net.IPNet {
+	d.portIPsMu.RLock()
+	defer d.portIPsMu.RUnlock()
+
+	return d.portIPs[port]
+}
+
+// portIPNets returns a copy of the addresses of all ports.
+func (d *IpDevice) portIPNets() map[*VPort]net.IPNet {
+	d.portIPsMu.RLock()
+	defer d.portIPsMu.RUnlock()
+
+	portIPs := make(map[*VPort]net.IPNet, len(d.portIPs))
+	for port, ipNet := range d.portIPs {
+		portIPs[port] = ipNet
+	}
+	return portIPs
+}
+
+// SetArpTimeout sets how long ArpResolve waits for a reply.
+func (d *IpDevice) SetArpTimeout(timeout time.Duration) {
+	d.arpTableMu.Lock()
+	defer d.arpTableMu.Unlock()
+
+	d.arpTimeout = timeout
+}
+
 func (d *IpDevice) onReceive(srcPort *VPort, data *EthernetFrame) {
 	d.onReceiveIp(srcPort, data)
 }
@@ -62,13 +105,18 @@ func (d *IpDevice) ArpResolve(requested net.IP) (net.HardwareAddr, error) {
 	}).Debug("resolving ARP")
 
 	// check if we already have the MAC address in our ARP table
-	if mac, ok := d.arpTable[requested.String()]; ok {
+	d.arpTableMu.RLock()
+	mac, ok := d.arpTable[requested.String()]
+	timeout := d.arpTimeout
+	d.arpTableMu.RUnlock()
+	if ok {
 		return mac, nil
 	}
 
 	// check which port is in the same network as the requested IP
 	ports := make([]*VPort, 0)
-	for p, ipNet := range d.portIPs {
+	portIPs := d.portIPNets()
+	for p, ipNet := range portIPs {
 		networkAddress := net.IPNet{
 			IP:   ipNet.IP.Mask(ipNet.Mask),
 			Mask: ipNet.Mask,
@@ -85,13 +133,18 @@ func (d *IpDevice) ArpResolve(requested net.IP) (net.HardwareAddr, error) {
 	}
 
 	for _, port := range ports {
+		// ports without an address cannot ask
+		if portIPs[port].IP == nil {
+			continue
+		}
+
 		arpRequestPayload := &ArpPacket{
 			HardwareType: ArpHardwareTypeEthernet,
 			ProtocolType: ArpProtocolTypeIPv4,
 			Opcode:       ArpOpcodeRequest,
-			SenderIP:     d.portIPs[d.ports[0]].IP,
+			SenderIP:     portIPs[port].IP,
 			TargetIP:     requested,
-			SenderMac:    d.ports[0].mac,
+			SenderMac:    port.mac,
 			TargetMac:    net.HardwareAddr{0, 0, 0, 0, 0, 0},
 		}
 
@@ -105,10 +158,10 @@ func (d *IpDevice) ArpResolve(requested net.IP) (net.HardwareAddr, error) {
 		_ = port.Write(ethernetFrame)
 	}
 
-	// wait for the ARP table to be updated with a timeout of 5 seconds
+	// wait for the ARP table to be updated until the timeout
 	resultChan := make(chan net.HardwareAddr)
 	go func() {
-		for i := 0; i < 50; i++ {
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
 			d.arpTableMu.RLock()
 			mac, ok := d.arpTable[requested.String()]
 			d.arpTableMu.RUnlock()
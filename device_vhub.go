@@ -0,0 +1,220 @@
+package exu
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultHubLinkSpeed is the link speed in bits per second of a half-duplex hub if
+// none is configured.
+const DefaultHubLinkSpeed uint64 = 10_000_000
+
+const (
+	// hubSlotBits is the slot time of 10/100 Mbit/s ethernet in bit times
+	hubSlotBits = 512
+	// hubAttemptLimit is the number of times a frame is sent before it is dropped
+	hubAttemptLimit = 16
+	// hubBackoffLimit caps the exponent of the backoff
+	hubBackoffLimit = 10
+)
+
+type HalfDuplexConfig struct {
+	// LinkSpeed in bits per second, defaults to DefaultHubLinkSpeed. It determines
+	// how long a frame occupies the medium.
+	LinkSpeed uint64
+	// SlotTime is the window after the start of a transmission in which another
+	// transmission collides with it instead of deferring. Defaults to 512 bit times.
+	SlotTime time.Duration
+}
+
+// bitTime returns the time it takes to transmit bits.
+func (c HalfDuplexConfig) bitTime(bits uint64) time.Duration {
+	return time.Duration(bits * uint64(time.Second) / c.LinkSpeed)
+}
+
+// HubStatistics counts the frames repeated by a hub.
+type HubStatistics struct {
+	Frames uint64
+	// Collisions is the number of frames that collided with another frame
+	Collisions uint64
+	// Dropped is the number of frames dropped after hubAttemptLimit collisions
+	Dropped uint64
+}
+
+// hubTransmission is a frame occupying the medium of a half-duplex hub.
+type hubTransmission struct {
+	start    time.Time
+	end      time.Time
+	collided bool
+}
+
+type hubMedium struct {
+	mu         sync.Mutex
+	halfDuplex bool
+	config     HalfDuplexConfig
+	current    *hubTransmission
+	stats      HubStatistics
+}
+
+// VHub repeats every frame received on a port to all other ports. It does not
+// learn MAC addresses, does not look at frames and does not run any protocols.
+type VHub struct {
+	*EthernetDevice
+	medium hubMedium
+}
+
+func NewVHub(name string, numberOfPorts int) *VHub {
+	vHub := &VHub{}
+	vHub.EthernetDevice = NewEthernetDevice(name, numberOfPorts, func(*VPort, *EthernetFrame) {}, func(*VPort) {}, func(*VPort) {})
+
+	// a hub does not take part in any protocol, all frames are repeated as they are
+	for _, port := range vHub.ports {
+		func(port *VPort) {
+			port.SetOnReceive(func(data *EthernetFrame) {
+				vHub.onReceive(port, data)
+			})
+		}(port)
+	}
+
+	return vHub
+}
+
+// EnableHalfDuplex turns the hub into a shared collision domain. Frames occupy the
+// medium for their transmission time, frames sent while another frame is in its
+// slot time collide and are retried after a binary exponential backoff.
+func (h *VHub) EnableHalfDuplex(config HalfDuplexConfig) {
+	if config.LinkSpeed == 0 {
+		config.LinkSpeed = DefaultHubLinkSpeed
+	}
+	if config.SlotTime == 0 {
+		config.SlotTime = config.bitTime(hubSlotBits)
+	}
+
+	h.medium.mu.Lock()
+	defer h.medium.mu.Unlock()
+
+	h.medium.halfDuplex = true
+	h.medium.config = config
+}
+
+// DisableHalfDuplex repeats frames immediately again.
+func (h *VHub) DisableHalfDuplex() {
+	h.medium.mu.Lock()
+	defer h.medium.mu.Unlock()
+
+	h.medium.halfDuplex = false
+}
+
+// Statistics returns the counters of the hub.
+func (h *VHub) Statistics() HubStatistics {
+	h.medium.mu.Lock()
+	defer h.medium.mu.Unlock()
+
+	return h.medium.stats
+}
+
+func (h *VHub) onReceive(srcPort *VPort, data *EthernetFrame) {
+	h.medium.mu.Lock()
+	halfDuplex := h.medium.halfDuplex
+	h.medium.mu.Unlock()
+
+	if !halfDuplex {
+		h.repeat(srcPort, data)
+		return
+	}
+
+	h.transmit(srcPort, data)
+}
+
+// transmit sends a frame over the shared medium, retrying it on collisions.
+func (h *VHub) transmit(srcPort *VPort, data *EthernetFrame) {
+	for attempt := 1; ; attempt++ {
+		if h.occupyMedium(data) {
+			h.repeat(srcPort, data)
+			return
+		}
+
+		if attempt == hubAttemptLimit {
+			h.medium.mu.Lock()
+			h.medium.stats.Dropped++
+			h.medium.mu.Unlock()
+
+			log.WithField("device", h.name).
+				WithField("port", srcPort.portCname).
+				Debug("dropped frame after excessive collisions")
+			return
+		}
+
+		h.medium.mu.Lock()
+		slotTime := h.medium.config.SlotTime
+		h.medium.mu.Unlock()
+
+		exponent := attempt
+		if exponent > hubBackoffLimit {
+			exponent = hubBackoffLimit
+		}
+		time.Sleep(time.Duration(rand.Intn(1<<exponent)) * slotTime)
+	}
+}
+
+// occupyMedium transmits data on the medium and returns false if it collided with
+// another frame.
+func (h *VHub) occupyMedium(data *EthernetFrame) bool {
+	for {
+		h.medium.mu.Lock()
+		now := time.Now()
+		current := h.medium.current
+
+		if current == nil || !now.Before(current.end) {
+			break
+		}
+
+		// a transmission that started less than a slot time ago is not sensed yet,
+		// both frames are destroyed
+		if now.Sub(current.start) < h.medium.config.SlotTime {
+			current.collided = true
+			current.end = now
+			h.medium.stats.Collisions += 2
+			h.medium.mu.Unlock()
+			return false
+		}
+
+		// the medium is busy, defer until it is idle
+		wait := current.end.Sub(now)
+		h.medium.mu.Unlock()
+		time.Sleep(wait)
+	}
+
+	transmission := &hubTransmission{
+		start: time.Now(),
+	}
+	duration := h.medium.config.bitTime(uint64(len(*data)) * 8)
+	transmission.end = transmission.start.Add(duration)
+	h.medium.current = transmission
+	h.medium.mu.Unlock()
+
+	time.Sleep(duration)
+
+	h.medium.mu.Lock()
+	defer h.medium.mu.Unlock()
+
+	return !transmission.collided
+}
+
+// repeat sends a copy of data to every connected port except srcPort.
+func (h *VHub) repeat(srcPort *VPort, data *EthernetFrame) {
+	h.medium.mu.Lock()
+	h.medium.stats.Frames++
+	h.medium.mu.Unlock()
+
+	h.portsMu.RLock()
+	defer h.portsMu.RUnlock()
+
+	for _, port := range h.ports {
+		if port != srcPort && port.connected() {
+			_ = port.Write(data.Clone())
+		}
+	}
+}
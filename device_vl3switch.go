@@ -0,0 +1,237 @@
+package exu
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Svi is a switched virtual interface, the routed interface of a VLAN.
+type Svi struct {
+	Vlan  uint16
+	IPNet net.IPNet
+	Mac   net.HardwareAddr
+}
+
+// sviInterface connects an SVI to the switch and to the router behind it. Frames
+// the switch sends to port are received by the router on routerPort and the other
+// way around.
+type sviInterface struct {
+	Svi
+	port       *VPort
+	routerPort *VPort
+}
+
+// VL3Switch is a switch that routes between the VLANs it has SVIs in. Frames that
+// are not addressed to an SVI are switched like on a VSwitch. Every SVI is a port
+// of the switch in its VLAN that is connected to a port of a VRouter, so packets
+// are routed between SVIs like between the ports of a VRouter.
+type VL3Switch struct {
+	*VSwitch
+	router *VRouter
+	mac    net.HardwareAddr
+	svis   map[uint16]*sviInterface
+	sviMu  sync.RWMutex
+}
+
+func NewVL3Switch(name string, numberOfPorts int) *VL3Switch {
+	mac := make(net.HardwareAddr, 6)
+	mac[0] = 0x42
+	mac[1] = 0x69
+	r := rand.Uint32()
+	mac[2] = byte(r >> 24)
+	mac[3] = byte(r >> 16)
+	mac[4] = byte(r >> 8)
+	mac[5] = byte(r)
+
+	vL3Switch := &VL3Switch{
+		VSwitch: NewVSwitch(name, numberOfPorts),
+		router:  NewVRouter(name, 0),
+		mac:     mac,
+		svis:    make(map[uint16]*sviInterface),
+	}
+	vL3Switch.router.mtuFn = vL3Switch.sviMTU
+
+	return vL3Switch
+}
+
+// SetSviIPNet creates the SVI of vlan or changes its address. All SVIs share the
+// MAC address of the switch.
+func (s *VL3Switch) SetSviIPNet(vlan uint16, ipNet net.IPNet) error {
+	if ipNet.IP.To4() == nil {
+		return errors.New("svi address must be an ipv4 address")
+	}
+	ipNet = net.IPNet{IP: ipNet.IP.To4(), Mask: ipNet.Mask}
+
+	s.sviMu.Lock()
+	svi, ok := s.svis[vlan]
+	if !ok {
+		svi = s.newSvi(vlan)
+		s.svis[vlan] = svi
+	}
+	svi.IPNet = ipNet
+	s.sviMu.Unlock()
+
+	s.router.SetPortIPNet(svi.routerPort, ipNet)
+
+	log.WithFields(log.Fields{
+		"device": s.name,
+		"vlan":   vlan,
+		"ip":     ipNet.IP,
+	}).Debug("set svi IP")
+	return nil
+}
+
+// newSvi creates the ports of the SVI of vlan. The SVI is trusted by DHCP snooping
+// and ARP inspection, and its MAC address is a static entry so frames to it are
+// never flooded. The caller must hold the svi lock.
+func (s *VL3Switch) newSvi(vlan uint16) *sviInterface {
+	name := "Vlan" + strconv.Itoa(int(vlan))
+	svi := &sviInterface{
+		Svi: Svi{
+			Vlan: vlan,
+			Mac:  s.mac,
+		},
+		port:       NewVPort(s.mac, name),
+		routerPort: NewVPort(s.mac, name),
+	}
+
+	// the MTU of the VLAN is enforced by the ports of the switch
+	_ = svi.port.SetMTU(MaxMTU)
+	_ = svi.routerPort.SetMTU(MaxMTU)
+
+	svi.port.setPeer(svi.routerPort)
+	svi.routerPort.setPeer(svi.port)
+	svi.port.SetOnReceive(func(data *EthernetFrame) {
+		s.receive(svi.port, data)
+	})
+	svi.routerPort.SetOnReceive(func(data *EthernetFrame) {
+		// like a host, the router only receives frames addressed to it
+		if dst := data.Destination(); dst[0]&0x01 == 0 && !bytes.Equal(dst, s.mac) {
+			return
+		}
+		s.router.receive(svi.routerPort, data)
+	})
+
+	s.addVirtualPort(svi.port)
+	s.router.addVirtualPort(svi.routerPort)
+
+	s.SetPortMode(svi.port, PortModeConfig{Mode: Access, Vlan: vlan})
+	s.SetDhcpSnoopingTrusted(svi.port, true)
+	s.SetArpInspectionTrusted(svi.port, true)
+	_ = s.AddStaticMacAddress(vlan, s.mac, svi.port)
+
+	return svi
+}
+
+// RemoveSvi removes the SVI of vlan, the VLAN is only switched afterwards.
+func (s *VL3Switch) RemoveSvi(vlan uint16) {
+	s.sviMu.Lock()
+	svi, ok := s.svis[vlan]
+	delete(s.svis, vlan)
+	s.sviMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	s.router.removePortIPNet(svi.routerPort)
+	s.router.removeVirtualPort(svi.routerPort)
+
+	_ = s.RemoveStaticMacAddress(vlan, s.mac)
+	s.removeVirtualPort(svi.port)
+	s.FlushMacAddressesOnPort(svi.port)
+	s.SetDhcpSnoopingTrusted(svi.port, false)
+	s.SetArpInspectionTrusted(svi.port, false)
+
+	s.portModeMu.Lock()
+	delete(s.portMode, svi.port)
+	s.portModeMu.Unlock()
+
+	svi.port.setPeer(nil)
+	svi.routerPort.setPeer(nil)
+	svi.port.SetOnReceive(nil)
+	svi.routerPort.SetOnReceive(nil)
+}
+
+// Svis returns all SVIs sorted by VLAN.
+func (s *VL3Switch) Svis() []Svi {
+	s.sviMu.RLock()
+	defer s.sviMu.RUnlock()
+
+	svis := make([]Svi, 0, len(s.svis))
+	for _, svi := range s.svis {
+		svis = append(svis, svi.Svi)
+	}
+
+	sort.Slice(svis, func(i, j int) bool {
+		return svis[i].Vlan < svis[j].Vlan
+	})
+	return svis
+}
+
+// AddRoute adds a route to the routing information base, like VRouter.AddRoute.
+// Routes leave through the SVI their next hop is connected to, so they need a next
+// hop and can not have a port.
+func (s *VL3Switch) AddRoute(route Route) error {
+	if route.Port != nil {
+		return errors.New("routes leave through the svi of their next hop, they can not have a port")
+	}
+	if route.Via.To4() == nil {
+		return errors.New("next hop must be an ipv4 address")
+	}
+
+	return s.router.AddRoute(route)
+}
+
+// DeleteRoute removes a route added with AddRoute.
+func (s *VL3Switch) DeleteRoute(route Route) error {
+	return s.router.DeleteRoute(route)
+}
+
+// SetArpTimeout sets how long the switch waits for the next hop of a routed packet
+// to be resolved.
+func (s *VL3Switch) SetArpTimeout(timeout time.Duration) {
+	s.router.SetArpTimeout(timeout)
+}
+
+// sviMTU returns the MTU packets routed out of the SVI with the router port port
+// are fragmented to, the smallest MTU of the ports carrying its VLAN.
+func (s *VL3Switch) sviMTU(port *VPort) int {
+	s.sviMu.RLock()
+	defer s.sviMu.RUnlock()
+
+	var egress *sviInterface
+	sviPorts := make(map[*VPort]bool, len(s.svis))
+	for _, svi := range s.svis {
+		sviPorts[svi.port] = true
+		if svi.routerPort == port {
+			egress = svi
+		}
+	}
+
+	if egress == nil {
+		return port.MTU()
+	}
+
+	s.portsMu.RLock()
+	defer s.portsMu.RUnlock()
+
+	mtu := 0
+	for _, p := range s.floodPorts() {
+		if !sviPorts[p] && p.connected() && s.carriesVlan(p, egress.Vlan) && (mtu == 0 || p.MTU() < mtu) {
+			mtu = p.MTU()
+		}
+	}
+
+	if mtu == 0 {
+		return DefaultMTU
+	}
+	return mtu
+}
@@ -1,26 +1,61 @@
 package exu
 
 import (
-	"bytes"
-	"errors"
+	log "github.com/sirupsen/logrus"
 	"net"
+	"sync"
 )
 
 type Route struct {
 	Network net.IPNet
 	Via     net.IP
+	// Port is the port a connected network is attached to. Packets matching a
+	// route without a next hop are delivered to their destination directly.
+	Port *VPort
+	// Source is where the route was learned from, it determines the default
+	// administrative distance of the route
+	Source RouteSource
+	// Distance is the administrative distance of the route, zero means the
+	// default distance of its source. Of several routes to the same network, the
+	// one with the lowest distance is used.
+	Distance uint8
+	// Metric decides between routes to the same network with the same distance,
+	// the lowest wins
+	Metric uint32
+}
+
+// connectedRoute returns the route to the network of ipNet, attached to port.
+func connectedRoute(port *VPort, ipNet net.IPNet) Route {
+	return Route{
+		Network: net.IPNet{
+			IP:   ipNet.IP.Mask(ipNet.Mask),
+			Mask: ipNet.Mask,
+		},
+		Port:   port,
+		Source: RouteSourceConnected,
+	}
 }
 
 type VRouter struct {
 	*IpDevice
-	routingTable []Route
-	defaultRoute *Route
+	rib            map[string][]Route
+	ribSelected    map[string]ribSelection
+	routingTable   routingTable
+	routingTableMu sync.RWMutex
+	arpQueues      map[string]*arpQueue
+	arpQueuesMu    sync.Mutex
+	icmpErrors     icmpErrorLimiter
+	// mtuFn returns the MTU packets leaving through a port are fragmented to
+	mtuFn func(port *VPort) int
 }
 
 func NewVRouter(name string, numberOfPorts int) *VRouter {
 	vRouter := &VRouter{
-		routingTable: make([]Route, 0),
+		rib:       make(map[string][]Route),
+		arpQueues: make(map[string]*arpQueue),
+		mtuFn:     (*VPort).MTU,
 	}
+	vRouter.SetIcmpRateLimit(DefaultIcmpRateLimit)
 	vRouter.IpDevice = NewIpDevice(name, numberOfPorts, vRouter.onReceive, func(*VPort) {}, vRouter.onDisconnect)
 	vRouter.EthernetDevice.capabilities = append(vRouter.EthernetDevice.capabilities, CapabilityForwardArp{
 		IpDevice: vRouter.IpDevice,
@@ -29,22 +64,61 @@ func NewVRouter(name string, numberOfPorts int) *VRouter {
 	return vRouter
 }
 
-func (r *VRouter) AddRoute(route Route) error {
-	// if the network is 0.0.0.0/0, set it as the default route
-	if route.Network.IP.Equal(net.IPv4zero) && bytes.Equal(route.Network.Mask, net.IPv4Mask(0, 0, 0, 0)) {
-		if r.defaultRoute != nil {
-			return errors.New("default route already set")
-		}
+// SetPortIPNet sets the address of port and installs its network as a connected
+// route, replacing the connected route of the previous address.
+func (r *VRouter) SetPortIPNet(port *VPort, ipNet net.IPNet) {
+	r.routingTableMu.Lock()
+	defer r.routingTableMu.Unlock()
 
-		r.defaultRoute = &route
-		return nil
+	if previous, err := normalizeRoute(connectedRoute(port, r.portIP(port))); err == nil {
+		r.ribRemove(previous)
 	}
 
-	r.routingTable = append(r.routingTable, route)
-	return nil
+	r.IpDevice.SetPortIPNet(port, ipNet)
+
+	route, err := normalizeRoute(connectedRoute(port, ipNet))
+	if err == nil {
+		err = r.ribAdd(route)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"device": r.name,
+			"port":   port.portCname,
+			"ip":     ipNet.IP,
+		}).WithError(err).Warn("could not add connected route")
+	}
+
+	r.compileRoutes()
 }
 
-func (r *VRouter) onReceive(_ *VPort, data *EthernetFrame) {
+// removePortIPNet removes the address of port and its connected route.
+func (r *VRouter) removePortIPNet(port *VPort) {
+	r.routingTableMu.Lock()
+	defer r.routingTableMu.Unlock()
+
+	if previous, err := normalizeRoute(connectedRoute(port, r.portIP(port))); err == nil {
+		r.ribRemove(previous)
+	}
+
+	r.portIPsMu.Lock()
+	delete(r.portIPs, port)
+	r.portIPsMu.Unlock()
+
+	r.compileRoutes()
+}
+
+// LookupRoute returns the forwarding table entry packets to dst are forwarded
+// with, the best route to the longest prefix containing dst. Its next hop is
+// resolved to a neighbor in a connected network, nil for connected networks, and
+// Port is the port packets leave through.
+func (r *VRouter) LookupRoute(dst net.IP) (Route, bool) {
+	r.routingTableMu.RLock()
+	defer r.routingTableMu.RUnlock()
+
+	return r.routingTable.lookup(dst)
+}
+
+func (r *VRouter) onReceive(srcPort *VPort, data *EthernetFrame) {
 	// right now we can only route IPv4 and ARP packets
 	if !data.EtherType().Equal(EtherTypeIPv4) {
 		return
@@ -53,55 +127,77 @@ func (r *VRouter) onReceive(_ *VPort, data *EthernetFrame) {
 	// get the destination IP
 	ipv4Packet := &IPv4Packet{}
 	err := ipv4Packet.UnmarshalBinary(data.Payload())
-	if err != nil {
+	if err != nil || !r.checkHeader(srcPort, data, ipv4Packet) {
 		return
 	}
 
-	bestRoute := r.defaultRoute
-	for _, route := range r.routingTable {
-		// find a more fitting route
-		if route.Network.Contains(ipv4Packet.Header.DestinationIP) {
-			bestRoute = &route
-			break
-		}
+	if r.isLocalAddress(ipv4Packet.Header.DestinationIP) {
+		r.receiveLocal(srcPort, data, ipv4Packet)
+		return
 	}
 
-	// find an interface that is in the network of the next hop of the best route
-	var nextHopPort *VPort
-	for port, ipNet := range r.portIPs {
-		networkIP := net.IPNet{
-			IP:   ipNet.IP.Mask(ipNet.Mask),
-			Mask: ipNet.Mask,
-		}
-
-		if networkIP.Contains(bestRoute.Via) {
-			nextHopPort = port
-			break
-		}
+	// packets that would leave with a TTL of 0 are dropped
+	if ipv4Packet.Header.TTL <= 1 {
+		r.sendIcmpError(srcPort, data, ICMPTypeTimeExceeded, ICMPCodeTTLExceeded, 0)
+		return
 	}
 
-	// if we don't have a next hop port, we can't route the packet
-	if nextHopPort == nil {
+	bestRoute, ok := r.LookupRoute(ipv4Packet.Header.DestinationIP)
+	if !ok {
+		log.WithFields(log.Fields{
+			"device": r.name,
+			"dst":    ipv4Packet.Header.DestinationIP,
+		}).Trace("no route to destination")
+		r.sendIcmpError(srcPort, data, ICMPTypeDestinationUnreachable, ICMPCodeNetUnreachable, 0)
 		return
 	}
 
+	// connected networks are delivered to the destination directly, everything else
+	// to the next hop, which is in a connected network
+	nextHop := bestRoute.Via
+	if nextHop == nil {
+		nextHop = ipv4Packet.Header.DestinationIP
+	}
+	nextHopPort := bestRoute.Port
+
 	// decrement the TTL
 	ipv4Packet.Header.TTL--
 
-	// if the TTL is 0, drop the packet
-	if ipv4Packet.Header.TTL == 0 {
-		return
-	}
-
 	// recalculate the checksum
 	ipv4Packet.Header.HeaderChecksum = 0
 	ipv4Packet.Header.HeaderChecksum = ipv4Packet.Header.CalculateChecksum()
 
-	// create the ethernet frame
-	ethernetFrame, _ := NewEthernetFrame(nextHopPort.mac, data.Source(), TagData{}, ipv4Packet)
-	err = nextHopPort.Write(ethernetFrame)
-	if err != nil {
-		return
+	// packets that do not fit the MTU of the egress port are fragmented, unless
+	// they must not be
+	packets := []*IPv4Packet{ipv4Packet}
+	if mtu := r.mtuFn(nextHopPort); int(ipv4Packet.Header.TotalLength) > mtu {
+		if ipv4Packet.Header.FlagsFragment&IPv4FlagDontFragment != 0 {
+			r.sendIcmpError(srcPort, data, ICMPTypeDestinationUnreachable, ICMPCodeFragmentationNeeded, uint32(mtu))
+			return
+		}
+
+		packets, err = ipv4Packet.Fragment(mtu)
+		if err != nil {
+			return
+		}
+	}
+
+	r.forward(nextHopPort, nextHop, arpQueueEntry{
+		srcPort: srcPort,
+		data:    data,
+		packets: packets,
+	})
+}
+
+// sendPackets sends packets to the neighbor with the MAC address dst.
+func (r *VRouter) sendPackets(port *VPort, dst net.HardwareAddr, packets []*IPv4Packet) {
+	for _, packet := range packets {
+		// create the ethernet frame
+		ethernetFrame, _ := NewEthernetFrame(dst, port.mac, TagData{}, packet)
+		err := port.Write(ethernetFrame)
+		if err != nil {
+			return
+		}
 	}
 }
 
@@ -0,0 +1,99 @@
+package exu
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// ArpQueueLimit is the number of packets a router queues for a neighbor that is
+// being resolved. Further packets are dropped until the neighbor is resolved.
+const ArpQueueLimit = 16
+
+// arpQueueEntry is a routed packet waiting for its next hop to be resolved. The
+// original frame is kept to answer it if the next hop cannot be resolved.
+type arpQueueEntry struct {
+	srcPort *VPort
+	data    *EthernetFrame
+	packets []*IPv4Packet
+}
+
+// arpQueue holds the packets to a neighbor that is being resolved.
+type arpQueue struct {
+	port    *VPort
+	entries []arpQueueEntry
+}
+
+// forward sends entry to nextHop on port. If the MAC address of the next hop is
+// not known yet, the entry is queued until it is resolved.
+func (r *VRouter) forward(port *VPort, nextHop net.IP, entry arpQueueEntry) {
+	r.arpTableMu.RLock()
+	mac, ok := r.arpTable[nextHop.String()]
+	r.arpTableMu.RUnlock()
+
+	if ok {
+		r.sendPackets(port, mac, entry.packets)
+		return
+	}
+
+	key := nextHop.String()
+
+	r.arpQueuesMu.Lock()
+	queue, pending := r.arpQueues[key]
+	if !pending {
+		queue = &arpQueue{port: port}
+		r.arpQueues[key] = queue
+	}
+
+	queued := len(queue.entries) < ArpQueueLimit
+	if queued {
+		queue.entries = append(queue.entries, entry)
+	}
+	r.arpQueuesMu.Unlock()
+
+	if !queued {
+		log.WithFields(log.Fields{
+			"device": r.name,
+			"ip":     nextHop,
+		}).Trace("dropped packet, arp queue is full")
+		return
+	}
+
+	// only the first packet to a neighbor resolves it
+	if !pending {
+		WithWaitGroup(func() {
+			r.resolve(nextHop)
+		})
+	}
+}
+
+// resolve resolves nextHop and releases the packets queued for it. If it cannot be
+// resolved, the senders of the packets are told the host is unreachable.
+func (r *VRouter) resolve(nextHop net.IP) {
+	mac, err := r.ArpResolve(nextHop)
+
+	r.arpQueuesMu.Lock()
+	queue := r.arpQueues[nextHop.String()]
+	delete(r.arpQueues, nextHop.String())
+	r.arpQueuesMu.Unlock()
+
+	if queue == nil {
+		return
+	}
+
+	if err == nil && mac != nil {
+		for _, entry := range queue.entries {
+			r.sendPackets(queue.port, mac, entry.packets)
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"device":  r.name,
+		"ip":      nextHop,
+		"packets": len(queue.entries),
+	}).Debug("could not resolve next hop")
+
+	for _, entry := range queue.entries {
+		r.sendIcmpError(entry.srcPort, entry.data, ICMPTypeDestinationUnreachable, ICMPCodeHostUnreachable, 0)
+	}
+}
@@ -0,0 +1,213 @@
+package exu
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultIcmpRateLimit is the limit of ICMP errors a router sends if none is set.
+var DefaultIcmpRateLimit = IcmpRateLimit{
+	PerSecond: 1000,
+	Burst:     50,
+}
+
+// IcmpRateLimit is a token bucket limiting the ICMP errors a router sends. Errors
+// exceeding it are not sent.
+type IcmpRateLimit struct {
+	// PerSecond is the number of errors that can be sent per second on average,
+	// zero disables the limit
+	PerSecond float64
+	// Burst is the number of errors that can be sent at once
+	Burst int
+}
+
+// IcmpErrorStatistics counts the ICMP errors of a router.
+type IcmpErrorStatistics struct {
+	Sent uint64
+	// RateLimited is the number of errors that were not sent because they
+	// exceeded the rate limit
+	RateLimited uint64
+}
+
+type icmpErrorLimiter struct {
+	mu     sync.Mutex
+	limit  IcmpRateLimit
+	tokens float64
+	last   time.Time
+	stats  IcmpErrorStatistics
+}
+
+// SetIcmpRateLimit sets the limit of ICMP errors the router sends.
+func (r *VRouter) SetIcmpRateLimit(limit IcmpRateLimit) {
+	r.icmpErrors.mu.Lock()
+	defer r.icmpErrors.mu.Unlock()
+
+	r.icmpErrors.limit = limit
+	r.icmpErrors.tokens = float64(limit.Burst)
+	r.icmpErrors.last = time.Now()
+}
+
+// IcmpErrorStatistics returns the ICMP error counters of the router.
+func (r *VRouter) IcmpErrorStatistics() IcmpErrorStatistics {
+	r.icmpErrors.mu.Lock()
+	defer r.icmpErrors.mu.Unlock()
+
+	return r.icmpErrors.stats
+}
+
+// allow takes a token from the bucket and returns false if there is none.
+func (l *icmpErrorLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit.PerSecond > 0 {
+		now := time.Now()
+		l.tokens = math.Min(float64(l.limit.Burst), l.tokens+now.Sub(l.last).Seconds()*l.limit.PerSecond)
+		l.last = now
+
+		if l.tokens < 1 {
+			l.stats.RateLimited++
+			return false
+		}
+		l.tokens--
+	}
+
+	l.stats.Sent++
+	return true
+}
+
+// icmpIsError returns true if icmpType is an ICMP error message.
+func icmpIsError(icmpType ICMPType) bool {
+	switch icmpType {
+	case ICMPTypeDestinationUnreachable, ICMPTypeSourceQuench, ICMPTypeRedirect,
+		ICMPTypeTimeExceeded, ICMPTypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// icmpErrorAllowed returns true if the packet in data may be answered with an
+// ICMP error. Errors are never sent about ICMP errors, fragments other than the
+// first, or packets that were not sent to a single host by a single host.
+func icmpErrorAllowed(data *EthernetFrame, header *IPv4Header, payload []byte) bool {
+	if data.Destination()[0]&0x01 != 0 {
+		return false
+	}
+
+	if header.FlagsFragment&IPv4FragmentOffsetMask != 0 {
+		return false
+	}
+
+	src := header.SourceIP
+	dst := header.DestinationIP
+	if src.IsUnspecified() || src.IsLoopback() || src.IsMulticast() || src.Equal(net.IPv4bcast) ||
+		dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+		return false
+	}
+
+	if header.Protocol == IPv4ProtocolICMP && len(payload) > 0 && icmpIsError(ICMPType(payload[0])) {
+		return false
+	}
+
+	return true
+}
+
+// sendIcmpError answers the packet in data, which was received on srcPort, with an
+// ICMP error from the address of srcPort.
+func (r *VRouter) sendIcmpError(srcPort *VPort, data *EthernetFrame, icmpType ICMPType, code uint8, rest uint32) {
+	r.sendIcmpErrorFrom(r.portIP(srcPort).IP, srcPort, data, icmpType, code, rest)
+}
+
+// sendIcmpErrorFrom answers the packet in data, which was received on srcPort, with
+// an ICMP error from srcIP.
+func (r *VRouter) sendIcmpErrorFrom(srcIP net.IP, srcPort *VPort, data *EthernetFrame, icmpType ICMPType, code uint8, rest uint32) {
+	if srcIP == nil {
+		return
+	}
+
+	original := data.Payload()
+	header := &IPv4Header{}
+	if len(original) < 20 || header.UnmarshalBinary(original[:20]) != nil {
+		return
+	}
+
+	if !icmpErrorAllowed(data, header, original[20:]) || !r.icmpErrors.allow() {
+		return
+	}
+
+	reply := newIcmpError(srcIP, header.SourceIP, icmpType, code, rest, original)
+
+	ethernetFrame, err := NewEthernetFrame(data.Source(), srcPort.mac, WithTagging(TaggingUntagged), reply)
+	if err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"device": r.name,
+		"port":   srcPort.portCname,
+		"dst":    header.SourceIP,
+		"type":   icmpType,
+		"code":   code,
+	}).Trace("sent ICMP error")
+
+	_ = srcPort.Write(ethernetFrame)
+}
+
+// checkHeader returns false and answers with a parameter problem if the header of
+// packet is malformed.
+func (r *VRouter) checkHeader(srcPort *VPort, data *EthernetFrame, packet *IPv4Packet) bool {
+	var pointer uint32
+	switch {
+	case packet.Header.Version != 4:
+		// there is nobody to tell, the packet is not ipv4
+		return false
+	case packet.Header.IHL < 5:
+		pointer = 0
+	case int(packet.Header.TotalLength) < int(packet.Header.IHL)*4 || int(packet.Header.TotalLength) > len(data.Payload()):
+		pointer = 2
+	default:
+		return true
+	}
+
+	// the pointer is the first byte of the rest of the header
+	r.sendIcmpError(srcPort, data, ICMPTypeParameterProblem, 0, pointer<<24)
+	return false
+}
+
+// isLocalAddress returns true if ip is the address of any port of the router.
+func (r *VRouter) isLocalAddress(ip net.IP) bool {
+	for _, ipNet := range r.portIPNets() {
+		if ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveLocal handles packets addressed to the router. Echo requests are answered,
+// UDP datagrams are answered with port unreachable, as no ports are open, and other
+// protocols with protocol unreachable. Answers come from the address the packet was
+// sent to, so the last hop of a traceroute shows the address that was traced.
+func (r *VRouter) receiveLocal(srcPort *VPort, data *EthernetFrame, packet *IPv4Packet) {
+	local := packet.Header.DestinationIP
+
+	switch packet.Header.Protocol {
+	case IPv4ProtocolICMP:
+		icmp := &ICMPPayload{}
+		if err := icmp.UnmarshalBinary(packet.Payload); err != nil || icmp.Type != ICMPTypeEcho {
+			return
+		}
+
+		reply := newIcmpEchoReply(local, packet.Header.SourceIP, icmp)
+		if frame, err := NewEthernetFrame(data.Source(), srcPort.mac, WithTagging(TaggingUntagged), reply); err == nil {
+			_ = srcPort.Write(frame)
+		}
+	case IPv4ProtocolUDP:
+		r.sendIcmpErrorFrom(local, srcPort, data, ICMPTypeDestinationUnreachable, ICMPCodePortUnreachable, 0)
+	default:
+		r.sendIcmpErrorFrom(local, srcPort, data, ICMPTypeDestinationUnreachable, ICMPCodeProtocolUnreachable, 0)
+	}
+}
@@ -0,0 +1,383 @@
+package exu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+)
+
+type RouteSource int
+
+const (
+	RouteSourceStatic RouteSource = iota
+	RouteSourceConnected
+	// RouteSourceDynamic is a route learned from a routing protocol
+	RouteSourceDynamic
+)
+
+func (s RouteSource) String() string {
+	switch s {
+	case RouteSourceConnected:
+		return "connected"
+	case RouteSourceDynamic:
+		return "dynamic"
+	}
+	return "static"
+}
+
+// DefaultDistance returns the administrative distance of routes from the source
+// that have none set.
+func (s RouteSource) DefaultDistance() uint8 {
+	switch s {
+	case RouteSourceConnected:
+		return 0
+	case RouteSourceDynamic:
+		return 120
+	}
+	return 1
+}
+
+// code returns the code of the source in "show ip route".
+func (s RouteSource) code() string {
+	switch s {
+	case RouteSourceConnected:
+		return "C"
+	case RouteSourceDynamic:
+		return "D"
+	}
+	return "S"
+}
+
+// maxRouteRecursion is the number of next hops a route can be resolved through
+// before it is considered unresolvable.
+const maxRouteRecursion = 8
+
+// ribSelection is the best route to a network and its forwarding table entry.
+type ribSelection struct {
+	route Route
+	entry Route
+}
+
+// RouteEntry is a route of the routing information base along with its state.
+type RouteEntry struct {
+	Route
+	// Active is true if the next hop of the route can be resolved
+	Active bool
+	// Selected is true if the route is the best route to its network and is in
+	// the forwarding table
+	Selected bool
+	// NextHop is the neighbor packets matching a selected route are sent to, the
+	// next hop resolved recursively. It is nil for connected networks.
+	NextHop net.IP
+	// EgressPort is the port packets matching a selected route leave through
+	EgressPort *VPort
+}
+
+// String returns the entry as a line of "show ip route".
+func (e RouteEntry) String() string {
+	selected := " "
+	if e.Selected {
+		selected = "*"
+	}
+
+	line := fmt.Sprintf("%s%s %s", e.Source.code(), selected, e.Network.String())
+	if e.Source == RouteSourceConnected {
+		return fmt.Sprintf("%s is directly connected, %s", line, e.Port.portCname)
+	}
+
+	line = fmt.Sprintf("%s [%d/%d]", line, e.Distance, e.Metric)
+	if e.Via != nil {
+		line = fmt.Sprintf("%s via %s", line, e.Via)
+	}
+
+	switch {
+	case e.Selected:
+		line = fmt.Sprintf("%s, %s", line, e.EgressPort.portCname)
+	case e.Port != nil:
+		line = fmt.Sprintf("%s, %s", line, e.Port.portCname)
+	}
+	if !e.Active {
+		line += " (unresolved)"
+	}
+	return line
+}
+
+// normalizeRoute returns route with its network masked, IPv4 addresses in their 4
+// byte form and its distance set.
+func normalizeRoute(route Route) (Route, error) {
+	if route.Via != nil && route.Via.To4() == nil {
+		return Route{}, errors.New("next hop must be an ipv4 address")
+	}
+
+	ip := route.Network.IP.To4()
+	if _, size := route.Network.Mask.Size(); ip == nil || size != 32 {
+		return Route{}, errors.New("route must be to an ipv4 network")
+	}
+
+	if route.Source == RouteSourceConnected && (route.Port == nil || route.Via != nil) {
+		return Route{}, errors.New("connected routes need a port and no next hop")
+	}
+
+	route.Network = net.IPNet{
+		IP:   ip.Mask(route.Network.Mask),
+		Mask: route.Network.Mask,
+	}
+	if route.Via != nil {
+		route.Via = route.Via.To4()
+	}
+	if route.Distance == 0 {
+		route.Distance = route.Source.DefaultDistance()
+	}
+	return route, nil
+}
+
+// sameRibRoute returns true if a and b are the same route of the same source.
+func sameRibRoute(a, b Route) bool {
+	return a.Source == b.Source && sameRoute(a, b)
+}
+
+// ribLess orders the routes to a network by preference.
+func ribLess(a, b Route) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	return routeLess(a, b)
+}
+
+// AddRoute adds a route to the routing information base. Routes without a source
+// are static routes. Adding a route that already exists with the same source and
+// next hop fails, ReplaceRoute changes it.
+func (r *VRouter) AddRoute(route Route) error {
+	route, err := normalizeRoute(route)
+	if err != nil {
+		return err
+	}
+
+	r.routingTableMu.Lock()
+	defer r.routingTableMu.Unlock()
+
+	if err = r.ribAdd(route); err != nil {
+		return err
+	}
+
+	r.compileRoutes()
+	return nil
+}
+
+// ReplaceRoute replaces all routes to the network of route from the source of
+// route with route, or adds it if there are none.
+func (r *VRouter) ReplaceRoute(route Route) error {
+	route, err := normalizeRoute(route)
+	if err != nil {
+		return err
+	}
+
+	r.routingTableMu.Lock()
+	defer r.routingTableMu.Unlock()
+
+	key := route.Network.String()
+	routes := make([]Route, 0, len(r.rib[key]))
+	for _, existing := range r.rib[key] {
+		if existing.Source != route.Source {
+			routes = append(routes, existing)
+		}
+	}
+	r.rib[key] = routes
+
+	if err = r.ribAdd(route); err != nil {
+		return err
+	}
+
+	r.compileRoutes()
+	return nil
+}
+
+// DeleteRoute removes the route to the network of route with the same source and
+// next hop.
+func (r *VRouter) DeleteRoute(route Route) error {
+	route, err := normalizeRoute(route)
+	if err != nil {
+		return err
+	}
+
+	r.routingTableMu.Lock()
+	defer r.routingTableMu.Unlock()
+
+	if !r.ribRemove(route) {
+		return errors.New("route does not exist")
+	}
+
+	r.compileRoutes()
+	return nil
+}
+
+// Routes returns all routes of the routing information base, sorted by network
+// and preference, like "show ip route".
+func (r *VRouter) Routes() []RouteEntry {
+	r.routingTableMu.RLock()
+	defer r.routingTableMu.RUnlock()
+
+	keys := make([]string, 0, len(r.rib))
+	for key := range r.rib {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := r.rib[keys[i]][0].Network, r.rib[keys[j]][0].Network
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		lengthA, _ := a.Mask.Size()
+		lengthB, _ := b.Mask.Size()
+		return lengthA < lengthB
+	})
+
+	entries := make([]RouteEntry, 0, len(keys))
+	for _, key := range keys {
+		selected, hasSelected := r.ribSelected[key]
+
+		for _, route := range r.rib[key] {
+			entry := RouteEntry{Route: route}
+			_, entry.Active = resolveRoute(&r.routingTable, route)
+
+			if hasSelected && sameRibRoute(route, selected.route) {
+				entry.Active = true
+				entry.Selected = true
+				entry.NextHop = selected.entry.Via
+				entry.EgressPort = selected.entry.Port
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// ribAdd adds a normalized route to the routing information base. The caller must
+// hold the routing table lock.
+func (r *VRouter) ribAdd(route Route) error {
+	key := route.Network.String()
+	for _, existing := range r.rib[key] {
+		if sameRibRoute(existing, route) {
+			return errors.New("route already exists")
+		}
+	}
+
+	routes := append(r.rib[key], route)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return ribLess(routes[i], routes[j])
+	})
+	r.rib[key] = routes
+	return nil
+}
+
+// ribRemove removes a normalized route from the routing information base and
+// returns false if it was not in it. The caller must hold the routing table lock.
+func (r *VRouter) ribRemove(route Route) bool {
+	key := route.Network.String()
+	for i, existing := range r.rib[key] {
+		if sameRibRoute(existing, route) {
+			r.rib[key] = append(r.rib[key][:i:i], r.rib[key][i+1:]...)
+			if len(r.rib[key]) == 0 {
+				delete(r.rib, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRoute returns the forwarding table entry of route, with its next hop
+// resolved through fib to a neighbor in a connected network and the port it is
+// reached through. It returns false if the next hop cannot be resolved.
+func resolveRoute(fib *routingTable, route Route) (Route, bool) {
+	switch {
+	case route.Port != nil:
+		// connected networks and routes out of a port need no resolution
+		return route, true
+	case route.Via == nil:
+		// without a next hop, the network has to be directly attached
+		connected, ok := fib.lookup(route.Network.IP)
+		if !ok || connected.Via != nil {
+			return Route{}, false
+		}
+		route.Port = connected.Port
+		return route, true
+	}
+
+	// a route cannot be resolved through itself
+	match, ok := fib.lookup(route.Via)
+	if !ok || match.Network.String() == route.Network.String() {
+		return Route{}, false
+	}
+
+	route.Port = match.Port
+	if match.Via != nil {
+		route.Via = match.Via
+	}
+	return route, true
+}
+
+// compileRoutes rebuilds the forwarding table from the best route to every network
+// whose next hop can be resolved. Next hops are resolved through the forwarding
+// table of the previous round, so every round resolves one more level of
+// recursion. The caller must hold the routing table lock.
+func (r *VRouter) compileRoutes() {
+	keys := make([]string, 0, len(r.rib))
+	for key := range r.rib {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var fib routingTable
+	var selected map[string]ribSelection
+	for round := 0; round <= maxRouteRecursion; round++ {
+		var next routingTable
+		nextSelected := make(map[string]ribSelection, len(keys))
+
+		for _, key := range keys {
+			for _, route := range r.rib[key] {
+				if entry, ok := resolveRoute(&fib, route); ok {
+					_ = next.insert(entry)
+					nextSelected[key] = ribSelection{route: route, entry: entry}
+					break
+				}
+			}
+		}
+
+		fib = next
+		converged := sameSelection(selected, nextSelected)
+		selected = nextSelected
+		if converged {
+			break
+		}
+	}
+
+	r.routingTable = fib
+	r.ribSelected = selected
+
+	log.WithFields(log.Fields{
+		"device": r.name,
+		"routes": len(selected),
+	}).Trace("compiled forwarding table")
+}
+
+// sameSelection returns true if two rounds of compileRoutes selected the same
+// routes and resolved them the same way.
+func sameSelection(a, b map[string]ribSelection) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+
+	for key, selection := range a {
+		other, ok := b[key]
+		if !ok || !sameRibRoute(selection.route, other.route) || !sameRoute(selection.entry, other.entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package exu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// routingTable is a binary patricia trie of IPv4 routes keyed by their network.
+// Nodes only exist where routes are or where two prefixes branch, so a lookup
+// visits at most 33 nodes, no matter how many routes there are.
+type routingTable struct {
+	root *routingTableNode
+}
+
+type routingTableNode struct {
+	prefix   uint32
+	length   int
+	routes   []Route
+	children [2]*routingTableNode
+}
+
+// prefixMask returns the network mask of a prefix length.
+func prefixMask(length int) uint32 {
+	return ^uint32(0) << (32 - length)
+}
+
+// prefixBit returns the bit of ip following the first length bits.
+func prefixBit(ip uint32, length int) int {
+	return int(ip>>(31-length)) & 1
+}
+
+// routeKey returns the network of route as prefix and prefix length.
+func routeKey(route Route) (uint32, int, error) {
+	ip := route.Network.IP.To4()
+	length, size := route.Network.Mask.Size()
+	if ip == nil || size != 32 {
+		return 0, 0, errors.New("route must be to an ipv4 network")
+	}
+
+	return binary.BigEndian.Uint32(ip) & prefixMask(length), length, nil
+}
+
+// insert adds route to the table. Routes to the same network are kept sorted by
+// routeLess, adding a route twice does nothing.
+func (t *routingTable) insert(route Route) error {
+	prefix, length, err := routeKey(route)
+	if err != nil {
+		return err
+	}
+
+	node := &t.root
+	for {
+		current := *node
+		if current == nil {
+			*node = &routingTableNode{prefix: prefix, length: length, routes: []Route{route}}
+			return nil
+		}
+
+		common := bits.LeadingZeros32(current.prefix ^ prefix)
+		if common > length {
+			common = length
+		}
+		if common > current.length {
+			common = current.length
+		}
+
+		// the new route branches off above the current node
+		if common < current.length {
+			branch := &routingTableNode{prefix: prefix & prefixMask(common), length: common}
+			branch.children[prefixBit(current.prefix, common)] = current
+			*node = branch
+
+			if common == length {
+				branch.routes = []Route{route}
+			} else {
+				branch.children[prefixBit(prefix, common)] = &routingTableNode{prefix: prefix, length: length, routes: []Route{route}}
+			}
+			return nil
+		}
+
+		if current.length == length {
+			current.addRoute(route)
+			return nil
+		}
+
+		node = &current.children[prefixBit(prefix, current.length)]
+	}
+}
+
+// sameRoute returns true if a and b are the same route to the same network.
+func sameRoute(a, b Route) bool {
+	return a.Via.Equal(b.Via) && a.Port == b.Port
+}
+
+// routeLess orders routes to the same network, connected routes first and the
+// others by their next hop.
+func routeLess(a, b Route) bool {
+	if c := bytes.Compare(a.Via.To4(), b.Via.To4()); c != 0 {
+		return c < 0
+	}
+	if (a.Port == nil) != (b.Port == nil) {
+		return a.Port != nil
+	}
+	return a.Port != nil && a.Port.portCname < b.Port.portCname
+}
+
+func (n *routingTableNode) addRoute(route Route) {
+	for _, existing := range n.routes {
+		if sameRoute(existing, route) {
+			return
+		}
+	}
+
+	n.routes = append(n.routes, route)
+	sort.SliceStable(n.routes, func(i, j int) bool {
+		return routeLess(n.routes[i], n.routes[j])
+	})
+}
+
+// lookup returns the route with the longest prefix containing ip. Of several routes
+// to the same network, the first by routeLess is returned.
+func (t *routingTable) lookup(ip net.IP) (Route, bool) {
+	ip = ip.To4()
+	if ip == nil {
+		return Route{}, false
+	}
+	key := binary.BigEndian.Uint32(ip)
+
+	var best *routingTableNode
+	for node := t.root; node != nil; {
+		if (key^node.prefix)&prefixMask(node.length) != 0 {
+			break
+		}
+
+		if len(node.routes) > 0 {
+			best = node
+		}
+
+		if node.length == 32 {
+			break
+		}
+		node = node.children[prefixBit(key, node.length)]
+	}
+
+	if best == nil {
+		return Route{}, false
+	}
+	return best.routes[0], true
+}
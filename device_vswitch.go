@@ -11,11 +11,58 @@ type PortMode int
 const (
 	Access PortMode = iota
 	Trunk
+	// PrivateVlanHost is an isolated or community port of a private VLAN
+	PrivateVlanHost
+	// PrivateVlanPromiscuous is a port that reaches all hosts of a private VLAN
+	PrivateVlanPromiscuous
+	// Dot1qTunnel is a customer facing QinQ port. All frames received on it, tagged
+	// or not, belong to the service VLAN of the port and keep their customer tag.
+	// Trunk ports add an 802.1ad service tag on top of the customer tag, also in
+	// their native VLAN.
+	Dot1qTunnel
 )
 
+// DefaultVlan is the VLAN every access port is assigned to and the VLAN untagged
+// frames on a trunk port belong to.
+const DefaultVlan uint16 = 1
+
 type PortModeConfig struct {
 	Mode PortMode
+	// Vlan is the VLAN of an access port, the secondary VLAN of a private VLAN host
+	// port, the primary VLAN of a promiscuous port or the service VLAN of a QinQ
+	// port
 	Vlan uint16
+	// NativeVlan is the VLAN untagged frames on a trunk port belong to. Frames of
+	// the native VLAN leave a trunk port untagged. Defaults to DefaultVlan.
+	NativeVlan uint16
+	// AllowedVlans is the list of VLANs a trunk port carries. If empty, the trunk
+	// carries all VLANs.
+	AllowedVlans []uint16
+	// L2ProtocolTunnel tunnels BPDUs received on a QinQ port to the other QinQ ports
+	// of its service VLAN instead of dropping them
+	L2ProtocolTunnel bool
+}
+
+// nativeVlan returns the native VLAN of a trunk port.
+func (c PortModeConfig) nativeVlan() uint16 {
+	if c.NativeVlan == 0 {
+		return DefaultVlan
+	}
+	return c.NativeVlan
+}
+
+// allowsVlan returns true if a trunk port carries the given VLAN.
+func (c PortModeConfig) allowsVlan(vlan uint16) bool {
+	if len(c.AllowedVlans) == 0 {
+		return true
+	}
+
+	for _, allowed := range c.AllowedVlans {
+		if allowed == vlan {
+			return true
+		}
+	}
+	return false
 }
 
 var PortModeTrunk = PortModeConfig{
@@ -26,20 +73,68 @@ type VSwitch struct {
 	*EthernetDevice
 	portMode   map[*VPort]PortModeConfig
 	portModeMu sync.RWMutex
+	// privateVlans maps primary VLANs to their private VLAN, privateVlanSecondaries
+	// maps secondary VLANs to their primary VLAN
+	privateVlans           map[uint16]PrivateVlanConfig
+	privateVlanSecondaries map[uint16]privateVlanSecondary
+	// serviceVlans are the VLANs frames with an 802.1ad service tag were received
+	// in on a trunk port, they are guarded by portModeMu
+	serviceVlans  map[uint16]bool
+	stp           stpBridge
+	portSecurity  portSecurityTable
+	stormControl  stormControlTable
+	mirror        mirrorTable
+	igmp          igmpTable
+	dhcpSnooping  dhcpSnoopingTable
+	arpInspection arpInspectionTable
 }
 
 func NewVSwitch(name string, numberOfPorts int) *VSwitch {
 	vSwitch := &VSwitch{
-		portMode:   make(map[*VPort]PortModeConfig),
-		portModeMu: sync.RWMutex{},
+		portMode:               make(map[*VPort]PortModeConfig),
+		portModeMu:             sync.RWMutex{},
+		privateVlans:           make(map[uint16]PrivateVlanConfig),
+		privateVlanSecondaries: make(map[uint16]privateVlanSecondary),
+		serviceVlans:           make(map[uint16]bool),
+		portSecurity: portSecurityTable{
+			ports: make(map[*VPort]*portSecurity),
+		},
+		stormControl: stormControlTable{
+			ports: make(map[*VPort]*stormControl),
+		},
+		mirror: mirrorTable{
+			sessions:   make(map[int]MirrorSessionConfig),
+			rspanVlans: make(map[uint16]bool),
+		},
+		dhcpSnooping: dhcpSnoopingTable{
+			trusted:  make(map[*VPort]bool),
+			bindings: make(map[dhcpBindingKey]*dhcpBinding),
+		},
+		arpInspection: arpInspectionTable{
+			vlans:   make(map[uint16]bool),
+			trusted: make(map[*VPort]bool),
+		},
 	}
 
-	vSwitch.EthernetDevice = NewEthernetDevice(name, numberOfPorts, vSwitch.onReceive, func(*VPort) {}, vSwitch.onDisconnect)
+	vSwitch.EthernetDevice = NewEthernetDevice(name, numberOfPorts, vSwitch.onReceive, vSwitch.onConnect, vSwitch.onDisconnect)
+	vSwitch.classifyFn = vSwitch.learningVlan
+	vSwitch.macTableVlanFn = vSwitch.macTableVlan
+	vSwitch.macTableSharedFn = vSwitch.sharedMacTables
+	vSwitch.onPortChannelFn = vSwitch.stpPortChannel
+	vSwitch.ingressFilters = append(vSwitch.ingressFilters, vSwitch.stormControlFilter, vSwitch.portSecurityFilter,
+		vSwitch.dhcpSnoopingFilter, vSwitch.arpInspectionFilter)
+	vSwitch.capabilities = append(vSwitch.capabilities, CapabilityLldp{
+		EthernetDevice: vSwitch.EthernetDevice,
+	})
+	vSwitch.capabilities = append(vSwitch.capabilities, CapabilityStp{
+		VSwitch: vSwitch,
+	})
+	vSwitch.initStp()
 
 	for i := 0; i < numberOfPorts; i++ {
 		vSwitch.portMode[vSwitch.ports[i]] = PortModeConfig{
 			Mode: Access,
-			Vlan: 1,
+			Vlan: DefaultVlan,
 		}
 	}
 
@@ -53,27 +148,223 @@ func (s *VSwitch) SetPortMode(port *VPort, mode PortModeConfig) {
 	s.portMode[port] = mode
 }
 
-func (s *VSwitch) flood(srcPort *VPort, data *EthernetFrame) {
+// portModeOf returns the mode of port, ports without a configured mode (e.g.
+// port-channels) are access ports in the default VLAN.
+func (s *VSwitch) portModeOf(port *VPort) PortModeConfig {
+	s.portModeMu.RLock()
+	defer s.portModeMu.RUnlock()
+
+	if mode, ok := s.portMode[port]; ok {
+		return mode
+	}
+	return PortModeConfig{
+		Mode: Access,
+		Vlan: DefaultVlan,
+	}
+}
+
+// ingressVlan returns the VLAN a frame received on srcPort belongs to. The second
+// return value is false if the frame is not allowed to enter the switch on srcPort.
+func (s *VSwitch) ingressVlan(srcPort *VPort, data *EthernetFrame) (uint16, bool) {
+	// blocked ports neither learn nor forward
+	if !s.stpLearning(srcPort) {
+		return 0, false
+	}
+
+	// mirror destination ports only send mirrored traffic
+	if s.isMirrorDestination(srcPort) {
+		return 0, false
+	}
+
+	mode := s.portModeOf(srcPort)
+
+	tagging := data.Tagging()
+
+	switch mode.Mode {
+	case Access:
+		// access ports only accept untagged frames
+		if tagging != TaggingUntagged {
+			return 0, false
+		}
+		return mode.Vlan, true
+	case Trunk:
+		vlan := mode.nativeVlan()
+		if tagging != TaggingUntagged {
+			vlan = data.VlanID()
+		}
+
+		// frames of VLANs that are pruned from the trunk are dropped
+		if !mode.allowsVlan(vlan) {
+			return 0, false
+		}
+		return vlan, true
+	case PrivateVlanHost, PrivateVlanPromiscuous:
+		if tagging != TaggingUntagged {
+			return 0, false
+		}
+		return s.privateVlanIngress(mode)
+	case Dot1qTunnel:
+		// there is no room for a service tag on a double tagged frame
+		if tagging == TaggingDoubleTagged {
+			return 0, false
+		}
+		return mode.Vlan, true
+	}
+
+	return 0, false
+}
+
+// learningVlan returns the VLAN the source address of a frame received on srcPort
+// is learned in. Addresses in RSPAN VLANs are never learned.
+func (s *VSwitch) learningVlan(srcPort *VPort, data *EthernetFrame) (uint16, bool) {
+	vlan, ok := s.ingressVlan(srcPort, data)
+	if !ok || s.isRspanVlan(vlan) {
+		return 0, false
+	}
+	return s.macTableVlan(vlan), true
+}
+
+// egressFrame returns the frame as it should leave the switch on port, or false if
+// port does not carry vlan. The frame passed in is expected to have its ingress
+// tag removed already and is never modified.
+func (s *VSwitch) egressFrame(port *VPort, vlan uint16, data *EthernetFrame) (*EthernetFrame, bool) {
+	mode := s.portModeOf(port)
+
+	switch mode.Mode {
+	case Access:
+		if mode.Vlan != vlan {
+			return nil, false
+		}
+		return data.Clone(), true
+	case Trunk:
+		if !mode.allowsVlan(vlan) {
+			return nil, false
+		}
+
+		// frames of service VLANs always get an 802.1ad service tag, even in the
+		// native VLAN, their customer tag is kept and its priority copied to the
+		// service tag
+		if s.isServiceVlan(vlan) {
+			frame := data.Clone()
+			if err := frame.PushServiceTag(VlanTag{PCP: data.PCP(), VID: vlan}); err != nil {
+				return nil, false
+			}
+			return frame, true
+		}
+
+		// the native VLAN is sent untagged
+		if vlan == mode.nativeVlan() {
+			return data.Clone(), true
+		}
+
+		frame := data.Clone()
+		if err := frame.PushTag(VlanTag{PCP: data.PCP(), VID: vlan}); err != nil {
+			return nil, false
+		}
+		return frame, true
+	case PrivateVlanHost, PrivateVlanPromiscuous:
+		if !s.privateVlanEgress(mode, vlan) {
+			return nil, false
+		}
+		return data.Clone(), true
+	case Dot1qTunnel:
+		return s.tunnelEgress(mode, vlan, data)
+	}
+
+	return nil, false
+}
+
+// forward writes the frame to port if the port carries vlan and returns whether
+// the frame was sent.
+func (s *VSwitch) forward(port *VPort, vlan uint16, data *EthernetFrame) bool {
+	if !s.stpForwarding(port) || s.portSecurityErrDisabled(port) || s.stormControlErrDisabled(port) {
+		return false
+	}
+
+	frame, ok := s.egressFrame(port, vlan, data)
+	if !ok {
+		return false
+	}
+
+	s.mirrorFrame(port, vlan, frame, MirrorEgress)
+	_ = port.Write(frame)
+	return true
+}
+
+// carriesVlan returns true if frames of vlan may leave through port.
+func (s *VSwitch) carriesVlan(port *VPort, vlan uint16) bool {
+	mode := s.portModeOf(port)
+
+	switch mode.Mode {
+	case Access, Dot1qTunnel:
+		return mode.Vlan == vlan
+	case Trunk:
+		return mode.allowsVlan(vlan)
+	case PrivateVlanHost, PrivateVlanPromiscuous:
+		return s.privateVlanEgress(mode, vlan)
+	}
+
+	return false
+}
+
+// flood sends the frame to every port carrying vlan except srcPort.
+func (s *VSwitch) flood(srcPort *VPort, vlan uint16, data *EthernetFrame) {
 	s.portsMu.RLock()
 	defer s.portsMu.RUnlock()
 
-	for _, port := range s.ports {
-		if port != srcPort {
-			_ = s.WriteFromPort(port, data)
+	for _, port := range s.floodPorts() {
+		if port != srcPort && port.connected() && !s.isMirrorDestination(port) {
+			s.forward(port, vlan, data)
 		}
 	}
 }
 
 func (s *VSwitch) onReceive(srcPort *VPort, data *EthernetFrame) {
-	// TODO: handle vlan
-	// Lookup tag of the incoming frame, if it is not the same as the dst port, drop the frame
-	// If the tag is the same, forward the frame to the dst port
-	// If we don't have the mac address in the mac address table, flood the frame to all trunk
-	// ports and all access ports in the same vlan
-
-	// If the dst MAC is a broadcast MAC, flood the frame to all trunk ports and all access ports
-	if bytes.Equal(data.Destination(), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
-		s.flood(srcPort, data)
+	vlan, ok := s.ingressVlan(srcPort, data)
+	if !ok {
+		log.WithField("port", srcPort.portCname).
+			WithField("device", s.name).
+			Trace("dropped frame not allowed on port")
+		return
+	}
+
+	// ports in the learning state learn the source address but do not forward
+	if !s.stpForwarding(srcPort) {
+		return
+	}
+
+	s.mirrorFrame(srcPort, vlan, data, MirrorIngress)
+
+	// from here on we work with the frame without its service tag, the egress port
+	// decides whether it has to be tagged again. The tag of a frame received on a
+	// QinQ port belongs to the customer and is kept.
+	if mode := s.portModeOf(srcPort); mode.Mode == Dot1qTunnel {
+		if data, ok = s.tunnelIngress(mode, data); !ok {
+			return
+		}
+	} else if data.Tagging() != TaggingUntagged {
+		if data.serviceTagged() {
+			s.learnServiceVlan(vlan)
+		}
+		data = data.Clone()
+		_, _ = data.PopTag()
+	}
+
+	// mirrored traffic is always flooded
+	if s.isRspanVlan(vlan) {
+		s.rspanReceive(srcPort, vlan, data)
+		return
+	}
+
+	// If the dst MAC is a broadcast MAC, flood the frame to all trunk ports and all
+	// access ports in the same vlan
+	if bytes.Equal(data.Destination(), BroadcastMAC) {
+		s.flood(srcPort, vlan, data)
+		return
+	}
+
+	// IPv4 multicast is only sent to group members if IGMP snooping is enabled
+	if s.multicastReceive(srcPort, vlan, data) {
 		return
 	}
 
@@ -82,26 +373,42 @@ func (s *VSwitch) onReceive(srcPort *VPort, data *EthernetFrame) {
 
 	log.WithField("src", srcString).
 		WithField("dst", dstString).
+		WithField("vlan", vlan).
 		WithField("device", s.name).
 		Trace("received frame")
 
-	s.macAddressMapMu.RLock()
-	defer s.macAddressMapMu.RUnlock()
+	if dstPort, ok := s.lookupMacAddress(s.macTableVlan(vlan), data.Destination()); ok {
+		// the destination is on the port the frame came from, nothing to do
+		if dstPort == srcPort {
+			return
+		}
 
-	if dstPort, ok := s.macAddressMap[dstString]; ok {
-		_ = s.WriteFromPort(dstPort, data)
-		return
+		// frames to known destinations that must not receive them (e.g. another
+		// isolated host of a private VLAN) are dropped, not flooded
+		if s.forward(dstPort, vlan, data) || dstPort.connected() {
+			return
+		}
 	}
 
-	s.flood(srcPort, data)
+	// If we don't have the mac address in the mac address table of the vlan, flood
+	// the frame to all trunk ports and all access ports in the same vlan
+	s.flood(srcPort, vlan, data)
+}
+
+func (s *VSwitch) onConnect(port *VPort) {
+	s.stpPortChanged(port)
 }
 
 func (s *VSwitch) onDisconnect(port *VPort) {
 	s.portModeMu.Lock()
-	defer s.portModeMu.Unlock()
-
 	s.portMode[port] = PortModeConfig{
 		Mode: Access,
-		Vlan: 1,
+		Vlan: DefaultVlan,
 	}
+	s.portModeMu.Unlock()
+
+	s.portSecurityDisconnect(port)
+	s.igmpDisconnect(port)
+	s.dhcpSnoopingDisconnect(port)
+	s.stpPortChanged(port)
 }
@@ -0,0 +1,417 @@
+package exu
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DhcpSnoopingConfig struct {
+	// Vlans are the VLANs DHCP traffic is snooped in. If empty, all VLANs are snooped.
+	Vlans []uint16
+	// VerifyMac drops DHCP messages from untrusted ports whose client hardware
+	// address does not match the source MAC address of the frame
+	VerifyMac bool
+}
+
+// DhcpSnoopingBinding binds an IP address to the MAC address, VLAN and port of a
+// host.
+type DhcpSnoopingBinding struct {
+	Mac  net.HardwareAddr
+	IP   net.IP
+	Vlan uint16
+	Port *VPort
+	// ExpiresIn is the remaining lease time, zero for static bindings
+	ExpiresIn time.Duration
+	Static    bool
+}
+
+// DhcpSnoopingStatistics counts the DHCP messages seen on untrusted ports.
+type DhcpSnoopingStatistics struct {
+	Forwarded uint64
+	Dropped   uint64
+}
+
+// ArpInspectionStatistics counts the ARP packets inspected on untrusted ports.
+type ArpInspectionStatistics struct {
+	Forwarded uint64
+	Dropped   uint64
+}
+
+type dhcpBindingKey struct {
+	vlan uint16
+	mac  string
+}
+
+type dhcpBinding struct {
+	ip      net.IP
+	port    *VPort
+	expires time.Time
+	static  bool
+}
+
+type dhcpSnoopingTable struct {
+	mu       sync.Mutex
+	enabled  bool
+	config   DhcpSnoopingConfig
+	trusted  map[*VPort]bool
+	bindings map[dhcpBindingKey]*dhcpBinding
+	stats    DhcpSnoopingStatistics
+}
+
+type arpInspectionTable struct {
+	mu      sync.Mutex
+	vlans   map[uint16]bool
+	trusted map[*VPort]bool
+	stats   ArpInspectionStatistics
+}
+
+// EnableDhcpSnooping drops DHCP server messages received on untrusted ports and
+// builds a binding table from the addresses handed out by trusted servers.
+func (s *VSwitch) EnableDhcpSnooping(config DhcpSnoopingConfig) {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	s.dhcpSnooping.enabled = true
+	s.dhcpSnooping.config = config
+
+	log.WithField("device", s.name).
+		Info("enabled dhcp snooping")
+}
+
+// DisableDhcpSnooping stops snooping DHCP traffic. Static bindings are kept, all
+// learned bindings are removed.
+func (s *VSwitch) DisableDhcpSnooping() {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	s.dhcpSnooping.enabled = false
+	for key, binding := range s.dhcpSnooping.bindings {
+		if !binding.static {
+			delete(s.dhcpSnooping.bindings, key)
+		}
+	}
+}
+
+// SetDhcpSnoopingTrusted marks port as trusted or untrusted. DHCP servers are only
+// accepted on trusted ports. Ports are untrusted by default.
+func (s *VSwitch) SetDhcpSnoopingTrusted(port *VPort, trusted bool) {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	if trusted {
+		s.dhcpSnooping.trusted[port] = true
+	} else {
+		delete(s.dhcpSnooping.trusted, port)
+	}
+}
+
+// AddDhcpSnoopingBinding adds a static binding, e.g. for a host with a statically
+// configured address. Static bindings never expire.
+func (s *VSwitch) AddDhcpSnoopingBinding(vlan uint16, mac net.HardwareAddr, ip net.IP, port *VPort) error {
+	if len(mac) != 6 || mac[0]&0x01 != 0 {
+		return errors.New("binding mac address must be a unicast address")
+	}
+
+	if ip.To4() == nil {
+		return errors.New("binding ip address must be an ipv4 address")
+	}
+
+	if !s.isSwitchPort(port) {
+		return errors.New("port does not belong to this switch")
+	}
+
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	s.dhcpSnooping.bindings[dhcpBindingKey{vlan: vlan, mac: mac.String()}] = &dhcpBinding{
+		ip:     ip.To4(),
+		port:   port,
+		static: true,
+	}
+	return nil
+}
+
+// RemoveDhcpSnoopingBinding removes the binding of mac in vlan.
+func (s *VSwitch) RemoveDhcpSnoopingBinding(vlan uint16, mac net.HardwareAddr) error {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	key := dhcpBindingKey{vlan: vlan, mac: mac.String()}
+	if _, ok := s.dhcpSnooping.bindings[key]; !ok {
+		return errors.New("binding not found")
+	}
+
+	delete(s.dhcpSnooping.bindings, key)
+	return nil
+}
+
+// DhcpSnoopingBindings returns all bindings that have not expired, sorted by VLAN
+// and IP address.
+func (s *VSwitch) DhcpSnoopingBindings() []DhcpSnoopingBinding {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	now := time.Now()
+	bindings := make([]DhcpSnoopingBinding, 0, len(s.dhcpSnooping.bindings))
+	for key, binding := range s.dhcpSnooping.bindings {
+		if binding.expired(now) {
+			delete(s.dhcpSnooping.bindings, key)
+			continue
+		}
+
+		mac, _ := net.ParseMAC(key.mac)
+		entry := DhcpSnoopingBinding{
+			Mac:    mac,
+			IP:     binding.ip,
+			Vlan:   key.vlan,
+			Port:   binding.port,
+			Static: binding.static,
+		}
+		if !binding.static {
+			entry.ExpiresIn = binding.expires.Sub(now)
+		}
+		bindings = append(bindings, entry)
+	}
+
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Vlan != bindings[j].Vlan {
+			return bindings[i].Vlan < bindings[j].Vlan
+		}
+		return bytes.Compare(bindings[i].IP, bindings[j].IP) < 0
+	})
+
+	return bindings
+}
+
+// DhcpSnoopingStatistics returns the DHCP snooping counters of the switch.
+func (s *VSwitch) DhcpSnoopingStatistics() DhcpSnoopingStatistics {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	return s.dhcpSnooping.stats
+}
+
+// EnableArpInspection drops ARP packets received on untrusted ports in vlans
+// whose sender addresses do not match a DHCP snooping binding of the port.
+func (s *VSwitch) EnableArpInspection(vlans ...uint16) {
+	s.arpInspection.mu.Lock()
+	defer s.arpInspection.mu.Unlock()
+
+	for _, vlan := range vlans {
+		s.arpInspection.vlans[vlan] = true
+	}
+
+	log.WithField("device", s.name).
+		WithField("vlans", vlans).
+		Info("enabled dynamic arp inspection")
+}
+
+// DisableArpInspection stops inspecting ARP packets in vlans. If no VLAN is
+// given, ARP inspection is disabled in all VLANs.
+func (s *VSwitch) DisableArpInspection(vlans ...uint16) {
+	s.arpInspection.mu.Lock()
+	defer s.arpInspection.mu.Unlock()
+
+	if len(vlans) == 0 {
+		s.arpInspection.vlans = make(map[uint16]bool)
+		return
+	}
+
+	for _, vlan := range vlans {
+		delete(s.arpInspection.vlans, vlan)
+	}
+}
+
+// SetArpInspectionTrusted marks port as trusted or untrusted for ARP inspection.
+// ARP packets received on trusted ports are not inspected. Ports are untrusted by
+// default.
+func (s *VSwitch) SetArpInspectionTrusted(port *VPort, trusted bool) {
+	s.arpInspection.mu.Lock()
+	defer s.arpInspection.mu.Unlock()
+
+	if trusted {
+		s.arpInspection.trusted[port] = true
+	} else {
+		delete(s.arpInspection.trusted, port)
+	}
+}
+
+// ArpInspectionStatistics returns the ARP inspection counters of the switch.
+func (s *VSwitch) ArpInspectionStatistics() ArpInspectionStatistics {
+	s.arpInspection.mu.Lock()
+	defer s.arpInspection.mu.Unlock()
+
+	return s.arpInspection.stats
+}
+
+// expired returns true if a learned binding ran out of lease time.
+func (b *dhcpBinding) expired(now time.Time) bool {
+	return !b.static && !now.Before(b.expires)
+}
+
+// dhcpSnoopingFilter is the ingress filter enforcing DHCP snooping on untrusted
+// ports and learning bindings from trusted ones.
+func (s *VSwitch) dhcpSnoopingFilter(port *VPort, vlan uint16, data *EthernetFrame) bool {
+	s.dhcpSnooping.mu.Lock()
+	enabled := s.dhcpSnooping.enabled &&
+		(len(s.dhcpSnooping.config.Vlans) == 0 || containsVlan(s.dhcpSnooping.config.Vlans, vlan))
+	s.dhcpSnooping.mu.Unlock()
+
+	if !enabled {
+		return true
+	}
+
+	dhcp, ok := dhcpMessage(data)
+	if !ok {
+		return true
+	}
+
+	// the client port is looked up before taking the snooping lock
+	var clientPort *VPort
+	if dhcp.MessageType == DHCPAck {
+		clientPort, _ = s.lookupMacAddress(vlan, dhcp.ClientMac)
+	}
+
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	key := dhcpBindingKey{vlan: vlan, mac: dhcp.ClientMac.String()}
+
+	if s.dhcpSnooping.trusted[port] {
+		switch dhcp.MessageType {
+		case DHCPAck:
+			if clientPort == nil || dhcp.YourIP.Equal(net.IPv4zero) {
+				break
+			}
+			if binding, ok := s.dhcpSnooping.bindings[key]; ok && binding.static {
+				break
+			}
+
+			s.dhcpSnooping.bindings[key] = &dhcpBinding{
+				ip:      dhcp.YourIP.To4(),
+				port:    clientPort,
+				expires: time.Now().Add(dhcp.LeaseTime),
+			}
+
+			log.WithField("device", s.name).
+				WithField("mac", key.mac).
+				WithField("ip", dhcp.YourIP).
+				WithField("vlan", vlan).
+				Debug("added dhcp snooping binding")
+		case DHCPNak:
+			s.removeDhcpBinding(key, nil)
+		}
+		return true
+	}
+
+	drop := false
+	switch {
+	case dhcp.Opcode == DHCPOpcodeReply || dhcp.MessageType == DHCPOffer ||
+		dhcp.MessageType == DHCPAck || dhcp.MessageType == DHCPNak:
+		// only trusted ports may have DHCP servers behind them
+		drop = true
+	case s.dhcpSnooping.config.VerifyMac && !bytes.Equal(dhcp.ClientMac, data.Source()):
+		drop = true
+	case dhcp.MessageType == DHCPRelease || dhcp.MessageType == DHCPDecline:
+		// a release is only accepted from the port the binding was learned on
+		if binding, ok := s.dhcpSnooping.bindings[key]; ok && !binding.static && binding.port != port {
+			drop = true
+		} else {
+			s.removeDhcpBinding(key, port)
+		}
+	}
+
+	if drop {
+		s.dhcpSnooping.stats.Dropped++
+
+		log.WithField("device", s.name).
+			WithField("port", port.portCname).
+			WithField("type", dhcp.MessageType).
+			Warn("dropped dhcp message on untrusted port")
+		return false
+	}
+
+	s.dhcpSnooping.stats.Forwarded++
+	return true
+}
+
+// removeDhcpBinding removes a learned binding. If port is not nil, the binding is
+// only removed if it was learned on port. The caller must hold the snooping lock.
+func (s *VSwitch) removeDhcpBinding(key dhcpBindingKey, port *VPort) {
+	binding, ok := s.dhcpSnooping.bindings[key]
+	if !ok || binding.static || (port != nil && binding.port != port) {
+		return
+	}
+
+	delete(s.dhcpSnooping.bindings, key)
+}
+
+// hasDhcpBinding returns true if ip is bound to mac in vlan on port.
+func (s *VSwitch) hasDhcpBinding(vlan uint16, mac net.HardwareAddr, ip net.IP, port *VPort) bool {
+	s.dhcpSnooping.mu.Lock()
+	defer s.dhcpSnooping.mu.Unlock()
+
+	binding, ok := s.dhcpSnooping.bindings[dhcpBindingKey{vlan: vlan, mac: mac.String()}]
+	return ok && !binding.expired(time.Now()) && binding.port == port && binding.ip.Equal(ip)
+}
+
+// arpInspectionFilter is the ingress filter dropping ARP packets on untrusted ports
+// whose sender does not match a binding.
+func (s *VSwitch) arpInspectionFilter(port *VPort, vlan uint16, data *EthernetFrame) bool {
+	if !data.EtherType().Equal(EtherTypeARP) {
+		return true
+	}
+
+	s.arpInspection.mu.Lock()
+	inspect := s.arpInspection.vlans[vlan] && !s.arpInspection.trusted[port]
+	s.arpInspection.mu.Unlock()
+
+	if !inspect {
+		return true
+	}
+
+	arp := &ArpPacket{}
+	valid := arp.FromBytes(data.Payload()) == nil && bytes.Equal(arp.SenderMac, data.Source())
+
+	// ARP probes have no sender address yet and are allowed
+	if valid && !arp.SenderIP.Equal(net.IPv4zero) {
+		valid = s.hasDhcpBinding(vlan, arp.SenderMac, arp.SenderIP, port)
+	}
+
+	s.arpInspection.mu.Lock()
+	defer s.arpInspection.mu.Unlock()
+
+	if !valid {
+		s.arpInspection.stats.Dropped++
+
+		log.WithField("device", s.name).
+			WithField("port", port.portCname).
+			WithField("vlan", vlan).
+			Warn("dropped arp packet without matching binding")
+		return false
+	}
+
+	s.arpInspection.stats.Forwarded++
+	return true
+}
+
+// dhcpSnoopingDisconnect removes the trust and all learned bindings of port.
+func (s *VSwitch) dhcpSnoopingDisconnect(port *VPort) {
+	s.dhcpSnooping.mu.Lock()
+	delete(s.dhcpSnooping.trusted, port)
+	for key, binding := range s.dhcpSnooping.bindings {
+		if binding.port == port && !binding.static {
+			delete(s.dhcpSnooping.bindings, key)
+		}
+	}
+	s.dhcpSnooping.mu.Unlock()
+
+	s.arpInspection.mu.Lock()
+	delete(s.arpInspection.trusted, port)
+	s.arpInspection.mu.Unlock()
+}
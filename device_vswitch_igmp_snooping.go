@@ -0,0 +1,466 @@
+package exu
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIgmpQueryInterval           = 125 * time.Second
+	DefaultIgmpQueryResponseInterval   = 10 * time.Second
+	DefaultIgmpLastMemberQueryInterval = time.Second
+	// igmpRobustness is the number of queries a member may miss before it is removed
+	igmpRobustness = 2
+)
+
+type IgmpSnoopingConfig struct {
+	// QueryInterval is the time between general queries, defaults to DefaultIgmpQueryInterval
+	QueryInterval time.Duration
+	// QueryResponseInterval is the max response time advertised in general queries,
+	// defaults to DefaultIgmpQueryResponseInterval
+	QueryResponseInterval time.Duration
+	// LastMemberQueryInterval is the max response time advertised in group specific
+	// queries after a leave, defaults to DefaultIgmpLastMemberQueryInterval
+	LastMemberQueryInterval time.Duration
+	// QuerierVlans are the VLANs the switch sends queries in if there is no other
+	// querier with a lower address
+	QuerierVlans []uint16
+	// QuerierAddress is the source address of queries sent by the switch. The
+	// switch only acts as querier if it has an address.
+	QuerierAddress net.IP
+	// FastLeave removes a port from a group as soon as a leave is received on it
+	// instead of querying for remaining members first
+	FastLeave bool
+	// FloodUnregistered floods multicast for groups without members instead of
+	// only sending it to router ports
+	FloodUnregistered bool
+	// RouterPorts are static multicast router ports, they receive all multicast
+	RouterPorts []*VPort
+}
+
+// membershipInterval is the time a membership is kept without a new report.
+func (c IgmpSnoopingConfig) membershipInterval() time.Duration {
+	return igmpRobustness*c.QueryInterval + c.QueryResponseInterval
+}
+
+// IgmpGroupEntry is a multicast group joined in a VLAN.
+type IgmpGroupEntry struct {
+	Vlan  uint16
+	Group net.IP
+	Ports []*VPort
+}
+
+type igmpGroupKey struct {
+	vlan  uint16
+	group string
+}
+
+type igmpTable struct {
+	mu      sync.Mutex
+	enabled bool
+	config  IgmpSnoopingConfig
+	stop    chan struct{}
+	// groups maps each group to its member ports and the time their membership expires
+	groups map[igmpGroupKey]map[*VPort]time.Time
+	// routers maps each VLAN to the ports queries were received on
+	routers map[uint16]map[*VPort]time.Time
+	// otherQuerier is the time until which another querier is present in a VLAN
+	otherQuerier map[uint16]time.Time
+}
+
+// EnableIgmpSnooping constrains IPv4 multicast to the ports that joined a group
+// and the ports multicast routers are connected to.
+func (s *VSwitch) EnableIgmpSnooping(config IgmpSnoopingConfig) {
+	if config.QueryInterval == 0 {
+		config.QueryInterval = DefaultIgmpQueryInterval
+	}
+	if config.QueryResponseInterval == 0 {
+		config.QueryResponseInterval = DefaultIgmpQueryResponseInterval
+	}
+	if config.LastMemberQueryInterval == 0 {
+		config.LastMemberQueryInterval = DefaultIgmpLastMemberQueryInterval
+	}
+	s.igmp.mu.Lock()
+	if s.igmp.enabled {
+		close(s.igmp.stop)
+	}
+
+	s.igmp.enabled = true
+	s.igmp.config = config
+	s.igmp.stop = make(chan struct{})
+	s.igmp.groups = make(map[igmpGroupKey]map[*VPort]time.Time)
+	s.igmp.routers = make(map[uint16]map[*VPort]time.Time)
+	s.igmp.otherQuerier = make(map[uint16]time.Time)
+	stop := s.igmp.stop
+	s.igmp.mu.Unlock()
+
+	log.WithField("device", s.name).
+		Info("enabled igmp snooping")
+
+	if len(config.QuerierVlans) == 0 {
+		return
+	}
+	if config.QuerierAddress.To4() == nil {
+		log.WithField("device", s.name).
+			Warn("igmp querier needs an address, not sending queries")
+		return
+	}
+	go s.igmpRunQuerier(stop, config)
+}
+
+// DisableIgmpSnooping stops snooping, multicast is flooded again.
+func (s *VSwitch) DisableIgmpSnooping() {
+	s.igmp.mu.Lock()
+	defer s.igmp.mu.Unlock()
+
+	if !s.igmp.enabled {
+		return
+	}
+
+	close(s.igmp.stop)
+	s.igmp.enabled = false
+}
+
+// IgmpGroups returns the multicast groups with at least one member, sorted by
+// VLAN and group. Only groups of the given VLANs are returned if any are passed.
+func (s *VSwitch) IgmpGroups(vlans ...uint16) []IgmpGroupEntry {
+	s.igmp.mu.Lock()
+	defer s.igmp.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]IgmpGroupEntry, 0)
+	for key, members := range s.igmp.groups {
+		if len(vlans) > 0 && !containsVlan(vlans, key.vlan) {
+			continue
+		}
+
+		entry := IgmpGroupEntry{
+			Vlan:  key.vlan,
+			Group: net.ParseIP(key.group).To4(),
+		}
+		for port, expires := range members {
+			if now.Before(expires) {
+				entry.Ports = append(entry.Ports, port)
+			}
+		}
+		if len(entry.Ports) == 0 {
+			continue
+		}
+
+		sort.Slice(entry.Ports, func(i, j int) bool {
+			return entry.Ports[i].portCname < entry.Ports[j].portCname
+		})
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Vlan != entries[j].Vlan {
+			return entries[i].Vlan < entries[j].Vlan
+		}
+		return bytes.Compare(entries[i].Group, entries[j].Group) < 0
+	})
+
+	return entries
+}
+
+// IgmpRouterPorts returns the static and learned multicast router ports of vlan.
+func (s *VSwitch) IgmpRouterPorts(vlan uint16) []*VPort {
+	s.igmp.mu.Lock()
+	defer s.igmp.mu.Unlock()
+
+	ports := make([]*VPort, 0)
+	for port := range s.igmpRouterPorts(vlan, time.Now()) {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].portCname < ports[j].portCname
+	})
+
+	return ports
+}
+
+func containsVlan(vlans []uint16, vlan uint16) bool {
+	for _, v := range vlans {
+		if v == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+// igmpRouterPorts returns the router ports of vlan. The caller must hold the igmp lock.
+func (s *VSwitch) igmpRouterPorts(vlan uint16, now time.Time) map[*VPort]bool {
+	ports := make(map[*VPort]bool)
+	for _, port := range s.igmp.config.RouterPorts {
+		ports[port] = true
+	}
+	for port, expires := range s.igmp.routers[vlan] {
+		if now.Before(expires) {
+			ports[port] = true
+		}
+	}
+	return ports
+}
+
+// igmpDisconnect removes all memberships and router ports learned on port.
+func (s *VSwitch) igmpDisconnect(port *VPort) {
+	s.igmp.mu.Lock()
+	defer s.igmp.mu.Unlock()
+
+	for _, members := range s.igmp.groups {
+		delete(members, port)
+	}
+	for _, routers := range s.igmp.routers {
+		delete(routers, port)
+	}
+}
+
+// multicastReceive handles an IPv4 multicast frame received in vlan and returns
+// false if the frame has to be handled like any other frame.
+func (s *VSwitch) multicastReceive(srcPort *VPort, vlan uint16, data *EthernetFrame) bool {
+	group, ok := ipv4MulticastGroup(data)
+	if !ok {
+		return false
+	}
+
+	s.igmp.mu.Lock()
+	if !s.igmp.enabled {
+		s.igmp.mu.Unlock()
+		return false
+	}
+
+	now := time.Now()
+	config := s.igmp.config
+
+	igmp, source, isIgmp := igmpMessage(data)
+	if isIgmp && igmp == nil {
+		s.igmp.mu.Unlock()
+
+		log.WithField("device", s.name).
+			WithField("port", srcPort.portCname).
+			Trace("dropped malformed igmp message")
+		return true
+	}
+	if isIgmp {
+		targets, flood := s.igmpSnoop(srcPort, vlan, igmp, source, now)
+		s.igmp.mu.Unlock()
+
+		if flood {
+			s.flood(srcPort, vlan, data)
+		} else {
+			s.forwardToPorts(srcPort, vlan, data, targets)
+		}
+		return true
+	}
+
+	// link local groups are always flooded
+	if group[0] == 224 && group[1] == 0 && group[2] == 0 {
+		s.igmp.mu.Unlock()
+		s.flood(srcPort, vlan, data)
+		return true
+	}
+
+	targets := s.igmpRouterPorts(vlan, now)
+	registered := false
+	for port, expires := range s.igmp.groups[igmpGroupKey{vlan: vlan, group: group.String()}] {
+		if now.Before(expires) {
+			targets[port] = true
+			registered = true
+		}
+	}
+	s.igmp.mu.Unlock()
+
+	if !registered && config.FloodUnregistered {
+		s.flood(srcPort, vlan, data)
+		return true
+	}
+
+	s.forwardToPorts(srcPort, vlan, data, targets)
+	return true
+}
+
+// igmpSnoop updates the group membership from an IGMP message and returns the
+// ports the message has to be forwarded to, or true if it has to be flooded. The
+// caller must hold the igmp lock.
+func (s *VSwitch) igmpSnoop(srcPort *VPort, vlan uint16, igmp *IGMPPacket, source net.IP, now time.Time) (map[*VPort]bool, bool) {
+	config := s.igmp.config
+
+	switch igmp.Type {
+	case IGMPTypeMembershipQuery:
+		// queries come from multicast routers or other queriers
+		if s.igmp.routers[vlan] == nil {
+			s.igmp.routers[vlan] = make(map[*VPort]time.Time)
+		}
+		s.igmp.routers[vlan][srcPort] = now.Add(config.membershipInterval())
+
+		// the querier with the lowest address wins the election
+		if bytes.Compare(source.To4(), config.QuerierAddress.To4()) < 0 {
+			s.igmp.otherQuerier[vlan] = now.Add(igmpRobustness*config.QueryInterval + config.QueryResponseInterval/2)
+		}
+		return nil, true
+	case IGMPTypeV1MembershipReport, IGMPTypeV2MembershipReport:
+		s.igmpJoin(srcPort, vlan, igmp.Group, now)
+	case IGMPTypeLeaveGroup:
+		s.igmpLeave(srcPort, vlan, igmp.Group, now)
+	case IGMPTypeV3MembershipReport:
+		for _, record := range igmp.Records {
+			if record.joins() {
+				s.igmpJoin(srcPort, vlan, record.Group, now)
+			} else if record.leaves() {
+				s.igmpLeave(srcPort, vlan, record.Group, now)
+			}
+		}
+	default:
+		return nil, true
+	}
+
+	// reports and leaves are only sent to the multicast routers
+	return s.igmpRouterPorts(vlan, now), false
+}
+
+// igmpJoin adds port to group. The caller must hold the igmp lock.
+func (s *VSwitch) igmpJoin(port *VPort, vlan uint16, group net.IP, now time.Time) {
+	if !group.IsMulticast() {
+		return
+	}
+
+	key := igmpGroupKey{vlan: vlan, group: group.String()}
+	if s.igmp.groups[key] == nil {
+		s.igmp.groups[key] = make(map[*VPort]time.Time)
+	}
+
+	if _, ok := s.igmp.groups[key][port]; !ok {
+		log.WithField("device", s.name).
+			WithField("port", port.portCname).
+			WithField("vlan", vlan).
+			WithField("group", group.String()).
+			Debug("port joined multicast group")
+	}
+	s.igmp.groups[key][port] = now.Add(s.igmp.config.membershipInterval())
+}
+
+// igmpLeave removes port from group, either immediately or after the remaining
+// members had the chance to answer a group specific query. The caller must hold
+// the igmp lock.
+func (s *VSwitch) igmpLeave(port *VPort, vlan uint16, group net.IP, now time.Time) {
+	key := igmpGroupKey{vlan: vlan, group: group.String()}
+	members, ok := s.igmp.groups[key]
+	if !ok {
+		return
+	}
+	if _, ok := members[port]; !ok {
+		return
+	}
+
+	if s.igmp.config.FastLeave {
+		delete(members, port)
+		return
+	}
+
+	expires := now.Add(igmpRobustness * s.igmp.config.LastMemberQueryInterval)
+	if members[port].After(expires) {
+		members[port] = expires
+	}
+
+	if s.igmpIsQuerier(vlan, now) {
+		query := s.igmpQuery(group, s.igmp.config.LastMemberQueryInterval)
+		if query != nil {
+			WithWaitGroup(func() {
+				s.flood(nil, vlan, query)
+			})
+		}
+	}
+}
+
+// igmpIsQuerier returns true if the switch is the querier of vlan. The caller must
+// hold the igmp lock.
+func (s *VSwitch) igmpIsQuerier(vlan uint16, now time.Time) bool {
+	return s.igmp.config.QuerierAddress.To4() != nil && containsVlan(s.igmp.config.QuerierVlans, vlan) &&
+		now.After(s.igmp.otherQuerier[vlan])
+}
+
+// igmpQuery builds a general query if group is nil, otherwise a group specific query.
+func (s *VSwitch) igmpQuery(group net.IP, maxResponse time.Duration) *EthernetFrame {
+	dst := IGMPAllHosts
+	if group != nil {
+		dst = group.To4()
+	}
+
+	igmp := &IGMPPacket{
+		Type:        IGMPTypeMembershipQuery,
+		MaxRespTime: uint8(maxResponse / (100 * time.Millisecond)),
+		Group:       group,
+	}
+	igmp.Checksum = igmp.CalculateChecksum()
+	igmpBytes, _ := igmp.MarshalBinary()
+
+	ipv4Packet := &IPv4Packet{
+		Header: IPv4Header{
+			Version:       4,
+			IHL:           5,
+			TotalLength:   uint16(20 + len(igmpBytes)),
+			TTL:           1,
+			Protocol:      IPv4ProtocolIGMP,
+			SourceIP:      s.igmp.config.QuerierAddress,
+			DestinationIP: dst,
+		},
+		Payload: igmpBytes,
+	}
+	ipv4Packet.Header.HeaderChecksum = ipv4Packet.Header.CalculateChecksum()
+
+	frame, err := NewEthernetFrame(multicastMAC(dst), s.ports[0].mac, WithTagging(TaggingUntagged), ipv4Packet)
+	if err != nil {
+		return nil
+	}
+	return frame
+}
+
+func (s *VSwitch) igmpRunQuerier(stop chan struct{}, config IgmpSnoopingConfig) {
+	ticker := time.NewTicker(config.QueryInterval)
+	defer ticker.Stop()
+
+	now := time.Now()
+	for {
+		s.igmp.mu.Lock()
+		vlans := make([]uint16, 0)
+		for _, vlan := range config.QuerierVlans {
+			if s.igmpIsQuerier(vlan, now) {
+				vlans = append(vlans, vlan)
+			}
+		}
+		query := s.igmpQuery(nil, config.QueryResponseInterval)
+		s.igmp.mu.Unlock()
+
+		for _, vlan := range vlans {
+			if query != nil {
+				s.flood(nil, vlan, query)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+// forwardToPorts sends the frame to the ports in targets that carry vlan.
+func (s *VSwitch) forwardToPorts(srcPort *VPort, vlan uint16, data *EthernetFrame, targets map[*VPort]bool) {
+	if len(targets) == 0 {
+		return
+	}
+
+	s.portsMu.RLock()
+	defer s.portsMu.RUnlock()
+
+	for _, port := range s.floodPorts() {
+		if targets[port] && port != srcPort && port.connected() && !s.isMirrorDestination(port) {
+			s.forward(port, vlan, data)
+		}
+	}
+}
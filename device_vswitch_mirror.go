@@ -0,0 +1,265 @@
+package exu
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+type MirrorDirection int
+
+const (
+	MirrorIngress MirrorDirection = 1 << iota
+	MirrorEgress
+	MirrorBoth = MirrorIngress | MirrorEgress
+)
+
+// MirrorSessionConfig configures a SPAN or RSPAN session.
+//
+// A local SPAN session copies the traffic of its sources to Destination. An RSPAN
+// source session has a RspanVlan and floods the copies into that VLAN instead of
+// (or in addition to) sending them to Destination. An RSPAN destination session
+// has a RspanVlan, a Destination and no sources, it delivers all frames of the
+// RSPAN VLAN to Destination.
+type MirrorSessionConfig struct {
+	// SourcePorts are the ports whose traffic is mirrored
+	SourcePorts []*VPort
+	// SourceVlans are the VLANs whose traffic is mirrored, no matter the port
+	SourceVlans []uint16
+	// Direction of the traffic that is mirrored, defaults to MirrorBoth
+	Direction MirrorDirection
+	// Destination receives the mirrored frames, it does not take part in switching
+	// anymore while it is the destination of a session
+	Destination *VPort
+	// RspanVlan carries mirrored frames to other switches
+	RspanVlan uint16
+}
+
+// hasSource returns true if the session mirrors frames of vlan on port in direction.
+func (c MirrorSessionConfig) hasSource(port *VPort, vlan uint16, direction MirrorDirection) bool {
+	if c.Direction&direction == 0 {
+		return false
+	}
+
+	for _, source := range c.SourcePorts {
+		if source == port {
+			return true
+		}
+	}
+	for _, source := range c.SourceVlans {
+		if source == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+// isRspanDestination returns true if the session delivers an RSPAN VLAN to a
+// local port.
+func (c MirrorSessionConfig) isRspanDestination() bool {
+	return c.RspanVlan != 0 && c.Destination != nil && len(c.SourcePorts) == 0 && len(c.SourceVlans) == 0
+}
+
+type mirrorTable struct {
+	mu       sync.RWMutex
+	sessions map[int]MirrorSessionConfig
+	// rspanVlans are the VLANs enabled with EnableRspanVlan, the VLANs of RSPAN
+	// sessions are RSPAN VLANs while the sessions exist
+	rspanVlans map[uint16]bool
+}
+
+// isRspanVlan returns true if vlan was enabled as RSPAN VLAN or is used by a
+// session. The caller must hold the lock.
+func (m *mirrorTable) isRspanVlan(vlan uint16) bool {
+	if m.rspanVlans[vlan] {
+		return true
+	}
+
+	for _, session := range m.sessions {
+		if session.RspanVlan == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableMirrorSession adds or replaces the mirror session with the given id.
+func (s *VSwitch) EnableMirrorSession(id int, config MirrorSessionConfig) error {
+	if config.Destination == nil && config.RspanVlan == 0 {
+		return errors.New("mirror session needs a destination port or an RSPAN VLAN")
+	}
+
+	if config.Destination != nil {
+		if !s.isSwitchPort(config.Destination) {
+			return errors.New("destination port not found on machine")
+		}
+
+		for _, source := range config.SourcePorts {
+			if source == config.Destination {
+				return errors.New("destination port can not be a source port")
+			}
+		}
+	}
+
+	if config.Direction == 0 {
+		config.Direction = MirrorBoth
+	}
+
+	s.mirror.mu.Lock()
+	s.mirror.sessions[id] = config
+	s.mirror.mu.Unlock()
+
+	// a destination port does not switch anymore, forget everything learned on it
+	if config.Destination != nil {
+		s.FlushMacAddressesOnPort(config.Destination)
+	}
+
+	log.WithField("device", s.name).
+		WithField("session", id).
+		Info("enabled mirror session")
+
+	return nil
+}
+
+// DisableMirrorSession removes the mirror session with the given id. Its RSPAN VLAN
+// becomes a regular VLAN again unless another session uses it or it was enabled
+// with EnableRspanVlan.
+func (s *VSwitch) DisableMirrorSession(id int) {
+	s.mirror.mu.Lock()
+	defer s.mirror.mu.Unlock()
+
+	delete(s.mirror.sessions, id)
+}
+
+// MirrorSession returns the config of the mirror session with the given id and
+// false if there is no such session.
+func (s *VSwitch) MirrorSession(id int) (MirrorSessionConfig, bool) {
+	s.mirror.mu.RLock()
+	defer s.mirror.mu.RUnlock()
+
+	config, ok := s.mirror.sessions[id]
+	return config, ok
+}
+
+// EnableRspanVlan marks vlan as an RSPAN VLAN. Switches carrying an RSPAN VLAN
+// between the source and the destination switch need this so they flood the
+// mirrored frames without learning their addresses. Switches with an RSPAN
+// session treat the VLAN of the session as RSPAN VLAN while the session exists.
+func (s *VSwitch) EnableRspanVlan(vlan uint16) {
+	s.mirror.mu.Lock()
+	defer s.mirror.mu.Unlock()
+
+	s.mirror.rspanVlans[vlan] = true
+}
+
+// DisableRspanVlan turns vlan back into a regular VLAN, unless a session of the
+// switch uses it.
+func (s *VSwitch) DisableRspanVlan(vlan uint16) {
+	s.mirror.mu.Lock()
+	defer s.mirror.mu.Unlock()
+
+	delete(s.mirror.rspanVlans, vlan)
+}
+
+// isRspanVlan returns true if vlan carries mirrored traffic.
+func (s *VSwitch) isRspanVlan(vlan uint16) bool {
+	s.mirror.mu.RLock()
+	defer s.mirror.mu.RUnlock()
+
+	return s.mirror.isRspanVlan(vlan)
+}
+
+// isMirrorDestination returns true if port is the destination of a mirror session.
+func (s *VSwitch) isMirrorDestination(port *VPort) bool {
+	s.mirror.mu.RLock()
+	defer s.mirror.mu.RUnlock()
+
+	for _, session := range s.mirror.sessions {
+		if session.Destination == port {
+			return true
+		}
+	}
+	return false
+}
+
+// isSwitchPort returns true if port is a physical port or a port-channel of the switch.
+func (s *VSwitch) isSwitchPort(port *VPort) bool {
+	s.portsMu.RLock()
+	defer s.portsMu.RUnlock()
+
+	for _, p := range s.floodPorts() {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorFrame copies a frame seen on port in vlan to all sessions mirroring it.
+// data is the frame exactly as it was received or sent on port.
+func (s *VSwitch) mirrorFrame(port *VPort, vlan uint16, data *EthernetFrame, direction MirrorDirection) {
+	s.mirror.mu.RLock()
+	if len(s.mirror.sessions) == 0 || s.mirror.isRspanVlan(vlan) {
+		// mirrored frames are never mirrored again
+		s.mirror.mu.RUnlock()
+		return
+	}
+
+	destinations := make([]*VPort, 0)
+	rspanVlans := make([]uint16, 0)
+	for _, session := range s.mirror.sessions {
+		if !session.hasSource(port, vlan, direction) {
+			continue
+		}
+
+		if session.Destination != nil && session.Destination != port {
+			destinations = append(destinations, session.Destination)
+		}
+		if session.RspanVlan != 0 {
+			rspanVlans = append(rspanVlans, session.RspanVlan)
+		}
+	}
+	s.mirror.mu.RUnlock()
+
+	for _, destination := range destinations {
+		_ = destination.Write(data.Clone())
+	}
+
+	if len(rspanVlans) == 0 {
+		return
+	}
+
+	frame := data.Clone()
+	if frame.Tagging() != TaggingUntagged {
+		_, _ = frame.PopTag()
+	}
+
+	// mirroring may happen while flooding, the RSPAN flood runs on its own so the
+	// port lock is not taken twice
+	for _, rspanVlan := range rspanVlans {
+		rspanVlan := rspanVlan
+		WithWaitGroup(func() {
+			s.flood(nil, rspanVlan, frame)
+		})
+	}
+}
+
+// rspanReceive handles a frame received in an RSPAN VLAN. It is delivered to the
+// destination ports of RSPAN destination sessions and flooded to all other ports
+// carrying the VLAN.
+func (s *VSwitch) rspanReceive(srcPort *VPort, vlan uint16, data *EthernetFrame) {
+	s.mirror.mu.RLock()
+	destinations := make([]*VPort, 0)
+	for _, session := range s.mirror.sessions {
+		if session.isRspanDestination() && session.RspanVlan == vlan {
+			destinations = append(destinations, session.Destination)
+		}
+	}
+	s.mirror.mu.RUnlock()
+
+	for _, destination := range destinations {
+		_ = destination.Write(data.Clone())
+	}
+
+	s.flood(srcPort, vlan, data)
+}
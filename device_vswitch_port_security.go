@@ -0,0 +1,251 @@
+package exu
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+type PortSecurityViolationMode int
+
+const (
+	// PortSecurityProtect silently drops frames from unknown MAC addresses
+	PortSecurityProtect PortSecurityViolationMode = iota
+	// PortSecurityRestrict drops frames from unknown MAC addresses, counts the
+	// violation and raises an event
+	PortSecurityRestrict
+	// PortSecurityShutdown err-disables the port on a violation, counts the
+	// violation and raises an event
+	PortSecurityShutdown
+)
+
+func (m PortSecurityViolationMode) String() string {
+	switch m {
+	case PortSecurityRestrict:
+		return "restrict"
+	case PortSecurityShutdown:
+		return "shutdown"
+	}
+	return "protect"
+}
+
+type PortSecurityConfig struct {
+	// MaxMacAddresses is the number of secure MAC addresses allowed on the port,
+	// including AllowedMacs. Defaults to 1.
+	MaxMacAddresses int
+	// Sticky keeps learned MAC addresses when the port is disconnected
+	Sticky bool
+	// AllowedMacs are static secure MAC addresses
+	AllowedMacs   []net.HardwareAddr
+	ViolationMode PortSecurityViolationMode
+}
+
+// PortSecurityStatus is a snapshot of the port security state of a port.
+type PortSecurityStatus struct {
+	SecureMacs    []net.HardwareAddr
+	Violations    uint64
+	LastViolation net.HardwareAddr
+	Shutdown      bool
+}
+
+type portSecurity struct {
+	config        PortSecurityConfig
+	secureMacs    map[string]net.HardwareAddr
+	violations    uint64
+	lastViolation net.HardwareAddr
+	shutdown      bool
+}
+
+type portSecurityTable struct {
+	mu            sync.Mutex
+	ports         map[*VPort]*portSecurity
+	onViolationFn func(port *VPort, mac net.HardwareAddr, mode PortSecurityViolationMode)
+}
+
+// EnablePortSecurity enables port security on port. Frames from MAC addresses that
+// are not secure on the port are dropped once the port reached its limit.
+func (s *VSwitch) EnablePortSecurity(port *VPort, config PortSecurityConfig) {
+	if config.MaxMacAddresses == 0 {
+		config.MaxMacAddresses = 1
+	}
+
+	security := &portSecurity{
+		config:     config,
+		secureMacs: make(map[string]net.HardwareAddr),
+	}
+	for _, mac := range config.AllowedMacs {
+		security.secureMacs[mac.String()] = mac
+	}
+
+	s.portSecurity.mu.Lock()
+	s.portSecurity.ports[port] = security
+	s.portSecurity.mu.Unlock()
+
+	// addresses learned before port security was enabled are not secure
+	s.FlushMacAddressesOnPort(port)
+}
+
+// DisablePortSecurity disables port security on port.
+func (s *VSwitch) DisablePortSecurity(port *VPort) {
+	s.portSecurity.mu.Lock()
+	defer s.portSecurity.mu.Unlock()
+
+	delete(s.portSecurity.ports, port)
+}
+
+// ResetPortSecurity brings an err-disabled port back up and removes all secure MAC
+// addresses that were not configured or learned sticky.
+func (s *VSwitch) ResetPortSecurity(port *VPort) {
+	s.portSecurity.mu.Lock()
+	defer s.portSecurity.mu.Unlock()
+
+	if security, ok := s.portSecurity.ports[port]; ok {
+		security.shutdown = false
+		security.clearDynamic()
+	}
+}
+
+// PortSecurityStatus returns the port security state of port and false if port
+// security is not enabled on it.
+func (s *VSwitch) PortSecurityStatus(port *VPort) (PortSecurityStatus, bool) {
+	s.portSecurity.mu.Lock()
+	defer s.portSecurity.mu.Unlock()
+
+	security, ok := s.portSecurity.ports[port]
+	if !ok {
+		return PortSecurityStatus{}, false
+	}
+
+	status := PortSecurityStatus{
+		SecureMacs:    make([]net.HardwareAddr, 0, len(security.secureMacs)),
+		Violations:    security.violations,
+		LastViolation: security.lastViolation,
+		Shutdown:      security.shutdown,
+	}
+	for _, mac := range security.secureMacs {
+		status.SecureMacs = append(status.SecureMacs, mac)
+	}
+
+	return status, true
+}
+
+// SetOnPortSecurityViolation sets a function that is called whenever a frame from
+// a MAC address that is not secure on a port in restrict or shutdown mode arrives.
+func (s *VSwitch) SetOnPortSecurityViolation(onViolation func(port *VPort, mac net.HardwareAddr, mode PortSecurityViolationMode)) {
+	s.portSecurity.mu.Lock()
+	defer s.portSecurity.mu.Unlock()
+
+	s.portSecurity.onViolationFn = onViolation
+}
+
+// clearDynamic removes all learned secure MAC addresses unless they are sticky.
+func (p *portSecurity) clearDynamic() {
+	if p.config.Sticky {
+		return
+	}
+
+	p.secureMacs = make(map[string]net.HardwareAddr)
+	for _, mac := range p.config.AllowedMacs {
+		p.secureMacs[mac.String()] = mac
+	}
+}
+
+// portSecurityErrDisabled returns true if port was shut down by port security.
+func (s *VSwitch) portSecurityErrDisabled(port *VPort) bool {
+	s.portSecurity.mu.Lock()
+	defer s.portSecurity.mu.Unlock()
+
+	security, ok := s.portSecurity.ports[port]
+	return ok && security.shutdown
+}
+
+// portSecurityFilter is the ingress filter enforcing port security. It runs before
+// the source address of a frame is learned.
+func (s *VSwitch) portSecurityFilter(port *VPort, _ uint16, data *EthernetFrame) bool {
+	s.portSecurity.mu.Lock()
+
+	security, ok := s.portSecurity.ports[port]
+	if !ok {
+		s.portSecurity.mu.Unlock()
+		return true
+	}
+
+	if security.shutdown {
+		s.portSecurity.mu.Unlock()
+		return false
+	}
+
+	src := data.Source()
+	key := src.String()
+	if _, ok = security.secureMacs[key]; ok {
+		s.portSecurity.mu.Unlock()
+		return true
+	}
+
+	// a MAC that is secure on another port must not show up here
+	securedElsewhere := false
+	for other, otherSecurity := range s.portSecurity.ports {
+		if _, ok = otherSecurity.secureMacs[key]; ok && other != port {
+			securedElsewhere = true
+			break
+		}
+	}
+
+	if !securedElsewhere && len(security.secureMacs) < security.config.MaxMacAddresses {
+		mac := make(net.HardwareAddr, len(src))
+		copy(mac, src)
+		security.secureMacs[key] = mac
+		s.portSecurity.mu.Unlock()
+
+		log.WithField("device", s.name).
+			WithField("port", port.portCname).
+			WithField("mac", key).
+			WithField("sticky", security.config.Sticky).
+			Debug("learned secure mac address")
+		return true
+	}
+
+	mode := security.config.ViolationMode
+	if mode == PortSecurityProtect {
+		s.portSecurity.mu.Unlock()
+		return false
+	}
+
+	violator := make(net.HardwareAddr, len(src))
+	copy(violator, src)
+
+	security.violations++
+	security.lastViolation = violator
+	if mode == PortSecurityShutdown {
+		security.shutdown = true
+	}
+	onViolation := s.portSecurity.onViolationFn
+	s.portSecurity.mu.Unlock()
+
+	log.WithField("device", s.name).
+		WithField("port", port.portCname).
+		WithField("mac", key).
+		WithField("mode", mode).
+		Warn("port security violation")
+
+	if mode == PortSecurityShutdown {
+		s.FlushMacAddressesOnPort(port)
+	}
+
+	if onViolation != nil {
+		onViolation(port, violator, mode)
+	}
+
+	return false
+}
+
+// portSecurityDisconnect forgets the learned secure addresses of a port that was
+// disconnected.
+func (s *VSwitch) portSecurityDisconnect(port *VPort) {
+	s.portSecurity.mu.Lock()
+	defer s.portSecurity.mu.Unlock()
+
+	if security, ok := s.portSecurity.ports[port]; ok {
+		security.clearDynamic()
+	}
+}
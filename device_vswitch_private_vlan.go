@@ -0,0 +1,164 @@
+package exu
+
+import "errors"
+
+// PrivateVlanConfig associates secondary VLANs with a primary VLAN. Hosts in the
+// isolated VLAN only reach promiscuous ports, hosts in a community VLAN reach
+// promiscuous ports and the other hosts of their community.
+type PrivateVlanConfig struct {
+	Primary   uint16
+	Isolated  uint16
+	Community []uint16
+}
+
+type privateVlanSecondary struct {
+	primary  uint16
+	isolated bool
+}
+
+// SetPrivateVlan adds or replaces the private VLAN with the given primary VLAN.
+// Host ports are configured with the PrivateVlanHost mode and their secondary
+// VLAN, promiscuous ports with the PrivateVlanPromiscuous mode and the primary VLAN.
+func (s *VSwitch) SetPrivateVlan(config PrivateVlanConfig) error {
+	if config.Primary == 0 {
+		return errors.New("private vlan needs a primary vlan")
+	}
+
+	secondaries := make([]uint16, 0, len(config.Community)+1)
+	if config.Isolated != 0 {
+		secondaries = append(secondaries, config.Isolated)
+	}
+	secondaries = append(secondaries, config.Community...)
+
+	s.portModeMu.Lock()
+	defer s.portModeMu.Unlock()
+
+	if _, ok := s.privateVlanSecondaries[config.Primary]; ok {
+		return errors.New("primary vlan is a secondary vlan of another private vlan")
+	}
+
+	seen := map[uint16]bool{config.Primary: true}
+	for _, vlan := range secondaries {
+		if seen[vlan] {
+			return errors.New("vlan is used twice in private vlan")
+		}
+		seen[vlan] = true
+
+		if _, ok := s.privateVlans[vlan]; ok {
+			return errors.New("secondary vlan is the primary vlan of another private vlan")
+		}
+		if secondary, ok := s.privateVlanSecondaries[vlan]; ok && secondary.primary != config.Primary {
+			return errors.New("secondary vlan is associated with another primary vlan")
+		}
+	}
+
+	s.removePrivateVlan(config.Primary)
+	s.privateVlans[config.Primary] = config
+	for _, vlan := range secondaries {
+		s.privateVlanSecondaries[vlan] = privateVlanSecondary{
+			primary:  config.Primary,
+			isolated: vlan == config.Isolated,
+		}
+	}
+
+	return nil
+}
+
+// RemovePrivateVlan removes the association of the private VLAN with the given
+// primary VLAN. Host ports of its secondary VLANs drop all traffic until the
+// VLAN is associated again.
+func (s *VSwitch) RemovePrivateVlan(primary uint16) {
+	s.portModeMu.Lock()
+	defer s.portModeMu.Unlock()
+
+	s.removePrivateVlan(primary)
+}
+
+// removePrivateVlan removes a private VLAN. The caller must hold portModeMu.
+func (s *VSwitch) removePrivateVlan(primary uint16) {
+	delete(s.privateVlans, primary)
+	for vlan, secondary := range s.privateVlanSecondaries {
+		if secondary.primary == primary {
+			delete(s.privateVlanSecondaries, vlan)
+		}
+	}
+}
+
+// privateVlanSecondary returns the association of a secondary VLAN and false if
+// vlan is not a secondary VLAN.
+func (s *VSwitch) privateVlanSecondary(vlan uint16) (privateVlanSecondary, bool) {
+	s.portModeMu.RLock()
+	defer s.portModeMu.RUnlock()
+
+	secondary, ok := s.privateVlanSecondaries[vlan]
+	return secondary, ok
+}
+
+// macTableVlan returns the VLAN addresses of vlan are learned and looked up in.
+// All VLANs of a private VLAN share the MAC address table of the primary VLAN.
+func (s *VSwitch) macTableVlan(vlan uint16) uint16 {
+	if secondary, ok := s.privateVlanSecondary(vlan); ok {
+		return secondary.primary
+	}
+	return vlan
+}
+
+// sharedMacTables returns the secondary VLANs of every private VLAN keyed by
+// their primary VLAN, they share its MAC address table.
+func (s *VSwitch) sharedMacTables() map[uint16][]uint16 {
+	s.portModeMu.RLock()
+	defer s.portModeMu.RUnlock()
+
+	shared := make(map[uint16][]uint16, len(s.privateVlans))
+	for vlan, secondary := range s.privateVlanSecondaries {
+		shared[secondary.primary] = append(shared[secondary.primary], vlan)
+	}
+	return shared
+}
+
+// privateVlanIngress returns the VLAN of frames received on a private VLAN port
+// and false if the port is not associated with a private VLAN.
+func (s *VSwitch) privateVlanIngress(mode PortModeConfig) (uint16, bool) {
+	s.portModeMu.RLock()
+	defer s.portModeMu.RUnlock()
+
+	switch mode.Mode {
+	case PrivateVlanHost:
+		_, ok := s.privateVlanSecondaries[mode.Vlan]
+		return mode.Vlan, ok
+	case PrivateVlanPromiscuous:
+		_, ok := s.privateVlans[mode.Vlan]
+		return mode.Vlan, ok
+	}
+
+	return 0, false
+}
+
+// privateVlanEgress returns true if a frame of vlan may leave a private VLAN port.
+// Promiscuous ports receive the traffic of every VLAN of their private VLAN, host
+// ports receive traffic of the primary VLAN and, in a community, of their own
+// secondary VLAN.
+func (s *VSwitch) privateVlanEgress(mode PortModeConfig, vlan uint16) bool {
+	s.portModeMu.RLock()
+	defer s.portModeMu.RUnlock()
+
+	switch mode.Mode {
+	case PrivateVlanHost:
+		own, ok := s.privateVlanSecondaries[mode.Vlan]
+		if !ok {
+			return false
+		}
+		return vlan == own.primary || (vlan == mode.Vlan && !own.isolated)
+	case PrivateVlanPromiscuous:
+		if _, ok := s.privateVlans[mode.Vlan]; !ok {
+			return false
+		}
+		if vlan == mode.Vlan {
+			return true
+		}
+		secondary, ok := s.privateVlanSecondaries[vlan]
+		return ok && secondary.primary == mode.Vlan
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+package exu
+
+import (
+	"bytes"
+	"net"
+)
+
+// L2ProtocolTunnelMAC replaces the destination of customer BPDUs while they are
+// tunneled through the provider network, so provider switches do not process them.
+var L2ProtocolTunnelMAC = net.HardwareAddr{0x01, 0x00, 0x0c, 0xcd, 0xcd, 0xd0}
+
+// isTunnelPort returns true if port is a customer facing QinQ port.
+func (s *VSwitch) isTunnelPort(port *VPort) bool {
+	return s.portModeOf(port).Mode == Dot1qTunnel
+}
+
+// isServiceVlan returns true if vlan is the service VLAN of a QinQ port or if
+// frames of vlan were received with a service tag. Switches in the provider core
+// only have trunk ports, they keep the service tag of the frames they pass on.
+func (s *VSwitch) isServiceVlan(vlan uint16) bool {
+	s.portModeMu.RLock()
+	defer s.portModeMu.RUnlock()
+
+	if s.serviceVlans[vlan] {
+		return true
+	}
+
+	for _, mode := range s.portMode {
+		if mode.Mode == Dot1qTunnel && mode.Vlan == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+// learnServiceVlan marks vlan as a service VLAN after a frame with a service tag
+// was received in it.
+func (s *VSwitch) learnServiceVlan(vlan uint16) {
+	s.portModeMu.RLock()
+	known := s.serviceVlans[vlan]
+	s.portModeMu.RUnlock()
+
+	if known {
+		return
+	}
+
+	s.portModeMu.Lock()
+	s.serviceVlans[vlan] = true
+	s.portModeMu.Unlock()
+}
+
+// tunnelIngress handles frames received on a customer facing QinQ port before they
+// are switched. Customer BPDUs are either dropped or, with layer 2 protocol
+// tunneling, sent on with the tunnel MAC as destination. It returns the frame to
+// switch and false if the frame is dropped.
+func (s *VSwitch) tunnelIngress(mode PortModeConfig, data *EthernetFrame) (*EthernetFrame, bool) {
+	if !isBpdu(data) {
+		return data, true
+	}
+
+	if !mode.L2ProtocolTunnel {
+		return nil, false
+	}
+
+	frame := data.Clone()
+	copy((*frame)[0:6], L2ProtocolTunnelMAC)
+	return frame, true
+}
+
+// tunnelEgress returns the frame as it leaves a customer facing QinQ port, restoring
+// the destination of tunneled BPDUs. It returns false if the frame is dropped.
+func (s *VSwitch) tunnelEgress(mode PortModeConfig, vlan uint16, data *EthernetFrame) (*EthernetFrame, bool) {
+	if mode.Vlan != vlan {
+		return nil, false
+	}
+
+	frame := data.Clone()
+	if bytes.Equal(frame.Destination(), L2ProtocolTunnelMAC) {
+		if !mode.L2ProtocolTunnel {
+			return nil, false
+		}
+		copy((*frame)[0:6], BpduMAC)
+	}
+
+	return frame, true
+}
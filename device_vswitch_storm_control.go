@@ -0,0 +1,278 @@
+package exu
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type StormControlClass int
+
+const (
+	StormControlBroadcast StormControlClass = iota
+	StormControlMulticast
+	StormControlUnknownUnicast
+)
+
+func (c StormControlClass) String() string {
+	switch c {
+	case StormControlMulticast:
+		return "multicast"
+	case StormControlUnknownUnicast:
+		return "unknown-unicast"
+	}
+	return "broadcast"
+}
+
+type StormControlAction int
+
+const (
+	// StormControlDrop drops frames exceeding the threshold until the next interval
+	StormControlDrop StormControlAction = iota
+	// StormControlShutdown err-disables the port when a threshold is exceeded
+	StormControlShutdown
+)
+
+// DefaultLinkSpeed is the link speed in bits per second used to calculate
+// percentage thresholds if none is configured.
+const DefaultLinkSpeed uint64 = 1_000_000_000
+
+// stormControlInterval is the interval traffic is measured in.
+const stormControlInterval = time.Second
+
+// StormControlThreshold limits the traffic of a class either in packets per second
+// or in percent of the link speed. If both are set, both limits apply.
+type StormControlThreshold struct {
+	PacketsPerSecond uint64
+	Percent          float64
+}
+
+type StormControlConfig struct {
+	// LinkSpeed in bits per second, defaults to DefaultLinkSpeed
+	LinkSpeed  uint64
+	Thresholds map[StormControlClass]StormControlThreshold
+	Action     StormControlAction
+}
+
+// StormControlStatus is a snapshot of the storm control counters of a port.
+type StormControlStatus struct {
+	Dropped  map[StormControlClass]uint64
+	Shutdown bool
+}
+
+type stormControlCounter struct {
+	windowStart time.Time
+	packets     uint64
+	bytes       uint64
+	exceeded    bool
+	dropped     uint64
+}
+
+type stormControl struct {
+	config   StormControlConfig
+	counters map[StormControlClass]*stormControlCounter
+	shutdown bool
+}
+
+type stormControlTable struct {
+	mu        sync.Mutex
+	ports     map[*VPort]*stormControl
+	onStormFn func(port *VPort, class StormControlClass, action StormControlAction)
+}
+
+// EnableStormControl limits the broadcast, multicast and unknown unicast traffic
+// that is accepted on port.
+func (s *VSwitch) EnableStormControl(port *VPort, config StormControlConfig) {
+	if config.LinkSpeed == 0 {
+		config.LinkSpeed = DefaultLinkSpeed
+	}
+
+	control := &stormControl{
+		config:   config,
+		counters: make(map[StormControlClass]*stormControlCounter),
+	}
+	for class := range config.Thresholds {
+		control.counters[class] = &stormControlCounter{}
+	}
+
+	s.stormControl.mu.Lock()
+	defer s.stormControl.mu.Unlock()
+
+	s.stormControl.ports[port] = control
+}
+
+// DisableStormControl removes all storm control thresholds from port.
+func (s *VSwitch) DisableStormControl(port *VPort) {
+	s.stormControl.mu.Lock()
+	defer s.stormControl.mu.Unlock()
+
+	delete(s.stormControl.ports, port)
+}
+
+// ResetStormControl brings a port that was err-disabled by storm control back up
+// and resets its counters.
+func (s *VSwitch) ResetStormControl(port *VPort) {
+	s.stormControl.mu.Lock()
+	defer s.stormControl.mu.Unlock()
+
+	if control, ok := s.stormControl.ports[port]; ok {
+		control.shutdown = false
+		for class := range control.counters {
+			control.counters[class] = &stormControlCounter{}
+		}
+	}
+}
+
+// StormControlStatus returns the storm control counters of port and false if
+// storm control is not enabled on it.
+func (s *VSwitch) StormControlStatus(port *VPort) (StormControlStatus, bool) {
+	s.stormControl.mu.Lock()
+	defer s.stormControl.mu.Unlock()
+
+	control, ok := s.stormControl.ports[port]
+	if !ok {
+		return StormControlStatus{}, false
+	}
+
+	status := StormControlStatus{
+		Dropped:  make(map[StormControlClass]uint64),
+		Shutdown: control.shutdown,
+	}
+	for class, counter := range control.counters {
+		status.Dropped[class] = counter.dropped
+	}
+
+	return status, true
+}
+
+// SetOnStormControl sets a function that is called whenever a port exceeds a
+// storm control threshold.
+func (s *VSwitch) SetOnStormControl(onStorm func(port *VPort, class StormControlClass, action StormControlAction)) {
+	s.stormControl.mu.Lock()
+	defer s.stormControl.mu.Unlock()
+
+	s.stormControl.onStormFn = onStorm
+}
+
+// stormControlErrDisabled returns true if port was shut down by storm control.
+func (s *VSwitch) stormControlErrDisabled(port *VPort) bool {
+	s.stormControl.mu.Lock()
+	defer s.stormControl.mu.Unlock()
+
+	control, ok := s.stormControl.ports[port]
+	return ok && control.shutdown
+}
+
+// trafficClass returns the storm control class of a frame and false if the frame
+// is known unicast. Frames to the link-local addresses 01:80:c2:00:00:0x carry
+// control protocols like STP, LACP and LLDP and are never limited.
+func (s *VSwitch) trafficClass(vlan uint16, data *EthernetFrame) (StormControlClass, bool) {
+	dst := data.Destination()
+	if bytes.Equal(dst, BroadcastMAC) {
+		return StormControlBroadcast, true
+	}
+	if bytes.Equal(dst[:5], BpduMAC[:5]) && dst[5] <= 0x0f {
+		return 0, false
+	}
+	if dst[0]&0x01 != 0 {
+		return StormControlMulticast, true
+	}
+	if _, ok := s.lookupMacAddress(vlan, dst); !ok {
+		return StormControlUnknownUnicast, true
+	}
+	return 0, false
+}
+
+// exceeds returns true if the counter is above threshold in the current interval.
+func (c *stormControlCounter) exceeds(threshold StormControlThreshold, linkSpeed uint64) bool {
+	if threshold.PacketsPerSecond > 0 && c.packets > threshold.PacketsPerSecond {
+		return true
+	}
+
+	if threshold.Percent > 0 {
+		bytesPerSecond := float64(linkSpeed) / 8 * threshold.Percent / 100
+		if float64(c.bytes) > bytesPerSecond {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stormControlFilter is the ingress filter enforcing storm control thresholds.
+func (s *VSwitch) stormControlFilter(port *VPort, vlan uint16, data *EthernetFrame) bool {
+	s.stormControl.mu.Lock()
+	control, ok := s.stormControl.ports[port]
+	if !ok {
+		s.stormControl.mu.Unlock()
+		return true
+	}
+
+	if control.shutdown {
+		s.stormControl.mu.Unlock()
+		return false
+	}
+	s.stormControl.mu.Unlock()
+
+	// the MAC table lookup happens outside of the storm control lock
+	class, ok := s.trafficClass(vlan, data)
+	if !ok {
+		return true
+	}
+
+	s.stormControl.mu.Lock()
+
+	threshold, ok := control.config.Thresholds[class]
+	if !ok {
+		s.stormControl.mu.Unlock()
+		return true
+	}
+
+	counter := control.counters[class]
+	now := time.Now()
+	if now.Sub(counter.windowStart) >= stormControlInterval {
+		counter.windowStart = now
+		counter.packets = 0
+		counter.bytes = 0
+		counter.exceeded = false
+	}
+
+	counter.packets++
+	counter.bytes += uint64(len(*data))
+
+	if !counter.exceeds(threshold, control.config.LinkSpeed) {
+		s.stormControl.mu.Unlock()
+		return true
+	}
+
+	counter.dropped++
+	action := control.config.Action
+	// only the first frame over the threshold in an interval raises an event
+	firstDrop := !counter.exceeded
+	counter.exceeded = true
+	if action == StormControlShutdown {
+		control.shutdown = true
+	}
+	onStorm := s.stormControl.onStormFn
+	s.stormControl.mu.Unlock()
+
+	if !firstDrop {
+		return false
+	}
+
+	log.WithField("device", s.name).
+		WithField("port", port.portCname).
+		WithField("class", class).
+		Warn("storm control threshold exceeded")
+
+	if action == StormControlShutdown {
+		s.FlushMacAddressesOnPort(port)
+	}
+
+	if onStorm != nil {
+		onStorm(port, class, action)
+	}
+
+	return false
+}
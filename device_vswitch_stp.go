@@ -0,0 +1,1041 @@
+package exu
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type StpMode int
+
+const (
+	// StpModeSTP is the classic 802.1D spanning tree protocol
+	StpModeSTP StpMode = iota
+	// StpModeRSTP is the 802.1w rapid spanning tree protocol
+	StpModeRSTP
+)
+
+type StpPortRole int
+
+const (
+	StpPortRoleDisabled StpPortRole = iota
+	StpPortRoleRoot
+	StpPortRoleDesignated
+	StpPortRoleAlternate
+	StpPortRoleBackup
+)
+
+func (r StpPortRole) String() string {
+	switch r {
+	case StpPortRoleRoot:
+		return "root"
+	case StpPortRoleDesignated:
+		return "designated"
+	case StpPortRoleAlternate:
+		return "alternate"
+	case StpPortRoleBackup:
+		return "backup"
+	}
+	return "disabled"
+}
+
+// bpduRole returns the role as encoded in the flags of an RST BPDU.
+func (r StpPortRole) bpduRole() uint8 {
+	switch r {
+	case StpPortRoleRoot:
+		return 2
+	case StpPortRoleDesignated:
+		return 3
+	case StpPortRoleAlternate, StpPortRoleBackup:
+		return 1
+	}
+	return 0
+}
+
+type StpPortState int
+
+const (
+	// StpPortStateBlocking is called discarding in RSTP
+	StpPortStateBlocking StpPortState = iota
+	StpPortStateListening
+	StpPortStateLearning
+	StpPortStateForwarding
+)
+
+func (s StpPortState) String() string {
+	switch s {
+	case StpPortStateListening:
+		return "listening"
+	case StpPortStateLearning:
+		return "learning"
+	case StpPortStateForwarding:
+		return "forwarding"
+	}
+	return "blocking"
+}
+
+// Default spanning tree parameters as defined by 802.1D
+const (
+	DefaultStpBridgePriority uint16 = 32768
+	DefaultStpPortPriority   uint8  = 128
+	DefaultStpPathCost       uint32 = 20000
+	DefaultStpHelloTime             = 2 * time.Second
+	DefaultStpMaxAge                = 20 * time.Second
+	DefaultStpForwardDelay          = 15 * time.Second
+)
+
+type StpConfig struct {
+	Mode           StpMode
+	BridgePriority uint16
+	HelloTime      time.Duration
+	MaxAge         time.Duration
+	ForwardDelay   time.Duration
+}
+
+type StpPortConfig struct {
+	Priority uint8
+	PathCost uint32
+	// Edge ports are expected to connect to end hosts and start forwarding right
+	// away in RSTP mode. A port stops being an edge port as soon as it receives a BPDU.
+	Edge bool
+}
+
+// stpPriorityVector is the information a bridge compares to elect the root bridge
+// and the port roles. Lower vectors are better.
+type stpPriorityVector struct {
+	rootID             BridgeID
+	rootPathCost       uint32
+	designatedBridgeID BridgeID
+	designatedPortID   uint16
+}
+
+func (v stpPriorityVector) compare(other stpPriorityVector) int {
+	if c := v.rootID.Compare(other.rootID); c != 0 {
+		return c
+	}
+	if v.rootPathCost != other.rootPathCost {
+		if v.rootPathCost < other.rootPathCost {
+			return -1
+		}
+		return 1
+	}
+	if c := v.designatedBridgeID.Compare(other.designatedBridgeID); c != 0 {
+		return c
+	}
+	if v.designatedPortID != other.designatedPortID {
+		if v.designatedPortID < other.designatedPortID {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+type stpPort struct {
+	port *VPort
+	// channel is the port-channel of a port-channel port, its members do not take
+	// part in the spanning tree themselves
+	channel *PortChannel
+	id      uint16
+	config  StpPortConfig
+	edge    bool
+	role    StpPortRole
+	state   StpPortState
+
+	// information received from the designated bridge of the attached segment
+	received           *stpPriorityVector
+	receivedMessageAge uint16
+	infoExpires        time.Time
+
+	// stateTimer is when the port moves on to the next state, zero if no transition
+	// is pending
+	stateTimer time.Time
+	proposing  bool
+	agreed     bool
+	tcWhile    time.Time
+	tcAck      bool
+}
+
+type stpBridge struct {
+	mu      sync.Mutex
+	enabled bool
+	config  StpConfig
+	id      BridgeID
+
+	ports     []*stpPort
+	portIndex map[*VPort]*stpPort
+
+	rootVector          stpPriorityVector
+	rootPort            *stpPort
+	topologyChangeUntil time.Time
+	tcnPending          bool
+	nextHello           time.Time
+	stop                chan struct{}
+
+	// callbacks are queued while holding mu and run after it was released
+	events              []func()
+	onTopologyChangeFn  func()
+	onPortStateChangeFn func(port *VPort, state StpPortState)
+}
+
+// toBpduTime converts a duration to the 1/256 second units used in BPDUs.
+func toBpduTime(d time.Duration) uint16 {
+	return uint16(d * 256 / time.Second)
+}
+
+func fromBpduTime(t uint16) time.Duration {
+	return time.Duration(t) * time.Second / 256
+}
+
+func (s *VSwitch) initStp() {
+	s.stp.portIndex = make(map[*VPort]*stpPort)
+	for i, port := range s.ports {
+		p := &stpPort{
+			port: port,
+			config: StpPortConfig{
+				Priority: DefaultStpPortPriority,
+				PathCost: DefaultStpPathCost,
+			},
+			state: StpPortStateForwarding,
+		}
+		p.id = stpPortID(p.config.Priority, i+1)
+		s.stp.ports = append(s.stp.ports, p)
+		s.stp.portIndex[port] = p
+	}
+}
+
+// linkUp returns true if the port can reach another bridge. A port-channel is up
+// as long as one of its members is.
+func (p *stpPort) linkUp() bool {
+	if p.channel != nil {
+		return len(p.channel.ActiveMembers()) > 0
+	}
+	return p.port.peer() != nil
+}
+
+// stpPortChannel makes a port-channel take part in the spanning tree as a single
+// port instead of its members, or hands the members back to the spanning tree
+// once the port-channel was removed. The port-channel is numbered like its first
+// member.
+func (s *VSwitch) stpPortChannel(pc *PortChannel, added bool) {
+	pc.mu.Lock()
+	members := append([]*portChannelMember{}, pc.members...)
+	pc.mu.Unlock()
+
+	s.stp.mu.Lock()
+	defer s.stpUnlock()
+
+	state := StpPortStateForwarding
+	if s.stp.enabled {
+		state = StpPortStateBlocking
+	}
+	newPort := func(port *VPort, number uint16) *stpPort {
+		p := &stpPort{
+			port: port,
+			config: StpPortConfig{
+				Priority: DefaultStpPortPriority,
+				PathCost: DefaultStpPathCost,
+			},
+			role:  StpPortRoleDisabled,
+			state: state,
+		}
+		p.id = stpPortID(p.config.Priority, int(number))
+		return p
+	}
+
+	if added {
+		channel := newPort(pc.port, members[0].number)
+		channel.channel = pc
+		if first, ok := s.stp.portIndex[members[0].port]; ok {
+			channel.config = first.config
+			channel.edge = first.config.Edge
+			channel.id = stpPortID(first.config.Priority, int(members[0].number))
+		}
+
+		for _, member := range members {
+			s.stpRemovePort(member.port)
+		}
+		s.stp.ports = append(s.stp.ports, channel)
+		s.stp.portIndex[pc.port] = channel
+	} else {
+		s.stpRemovePort(pc.port)
+		for _, member := range members {
+			p := newPort(member.port, member.number)
+			s.stp.ports = append(s.stp.ports, p)
+			s.stp.portIndex[member.port] = p
+		}
+	}
+
+	if s.stp.enabled {
+		s.stpRecompute(time.Now())
+	}
+}
+
+// stpRemovePort removes port from the spanning tree. The caller must hold stp.mu.
+func (s *VSwitch) stpRemovePort(port *VPort) {
+	p, ok := s.stp.portIndex[port]
+	if !ok {
+		return
+	}
+
+	delete(s.stp.portIndex, port)
+	for i, other := range s.stp.ports {
+		if other == p {
+			s.stp.ports = append(s.stp.ports[:i], s.stp.ports[i+1:]...)
+			break
+		}
+	}
+	if s.stp.rootPort == p {
+		s.stp.rootPort = nil
+	}
+}
+
+func stpPortID(priority uint8, number int) uint16 {
+	return uint16(priority&0xf0)<<8 | uint16(number)&0x0fff
+}
+
+// EnableStp starts the spanning tree protocol on the switch. All ports start out
+// blocking and transition to forwarding once the spanning tree has converged.
+func (s *VSwitch) EnableStp(config StpConfig) {
+	if config.BridgePriority == 0 {
+		config.BridgePriority = DefaultStpBridgePriority
+	}
+	if config.HelloTime == 0 {
+		config.HelloTime = DefaultStpHelloTime
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = DefaultStpMaxAge
+	}
+	if config.ForwardDelay == 0 {
+		config.ForwardDelay = DefaultStpForwardDelay
+	}
+
+	s.stp.mu.Lock()
+	if s.stp.enabled {
+		close(s.stp.stop)
+	}
+
+	now := time.Now()
+	s.stp.enabled = true
+	s.stp.config = config
+	s.stp.id = BridgeID{
+		Priority: config.BridgePriority,
+		Mac:      s.ports[0].mac,
+	}
+	s.stp.rootVector = s.stpOwnVector()
+	s.stp.rootPort = nil
+	s.stp.tcnPending = false
+	s.stp.stop = make(chan struct{})
+
+	for _, p := range s.stp.ports {
+		p.edge = p.config.Edge
+		p.role = StpPortRoleDisabled
+		p.state = StpPortStateBlocking
+		p.received = nil
+		p.stateTimer = time.Time{}
+		p.proposing = false
+		p.agreed = false
+		p.tcWhile = time.Time{}
+		p.tcAck = false
+	}
+
+	log.WithField("device", s.name).
+		WithField("bridge_id", s.stp.id).
+		WithField("mode", config.Mode).
+		Info("enabled spanning tree")
+
+	s.stpRecompute(now)
+	s.stpSendHellos(now)
+	go s.stpRun(s.stp.stop, config.HelloTime)
+	s.stpUnlock()
+}
+
+// DisableStp stops the spanning tree protocol. Alternate and backup ports stay
+// blocked, as they break the loops the spanning tree found and nothing would
+// detect them anymore, all other ports go to forwarding. The MAC address table is
+// flushed, the active topology changed. The blocked ports only break those loops
+// as long as the topology stays the same: once any port of the switch is
+// connected or disconnected, every port goes to forwarding.
+func (s *VSwitch) DisableStp() {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	if !s.stp.enabled {
+		return
+	}
+
+	close(s.stp.stop)
+	s.stp.enabled = false
+	for _, p := range s.stp.ports {
+		switch p.role {
+		case StpPortRoleAlternate, StpPortRoleBackup:
+			p.state = StpPortStateBlocking
+		default:
+			p.state = StpPortStateForwarding
+		}
+	}
+	s.FlushMacAddresses()
+}
+
+// stpUnblock puts every port of a disabled spanning tree into forwarding and
+// flushes the MAC address table if a port was blocked. The caller must hold
+// stp.mu.
+func (s *VSwitch) stpUnblock() {
+	unblocked := false
+	for _, p := range s.stp.ports {
+		if p.state != StpPortStateForwarding {
+			p.state = StpPortStateForwarding
+			unblocked = true
+		}
+	}
+
+	if unblocked {
+		s.FlushMacAddresses()
+	}
+}
+
+// SetStpPortConfig changes the spanning tree parameters of a port.
+func (s *VSwitch) SetStpPortConfig(port *VPort, config StpPortConfig) {
+	if config.Priority == 0 {
+		config.Priority = DefaultStpPortPriority
+	}
+	if config.PathCost == 0 {
+		config.PathCost = DefaultStpPathCost
+	}
+
+	s.stp.mu.Lock()
+	p, ok := s.stp.portIndex[port]
+	if !ok {
+		s.stp.mu.Unlock()
+		return
+	}
+
+	p.config = config
+	p.edge = config.Edge
+	p.id = stpPortID(config.Priority, int(p.id&0x0fff))
+
+	if s.stp.enabled {
+		s.stpRecompute(time.Now())
+	}
+	s.stpUnlock()
+}
+
+// SetOnStpTopologyChange sets a function that is called whenever the switch
+// detects or is notified of a topology change.
+func (s *VSwitch) SetOnStpTopologyChange(onTopologyChange func()) {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	s.stp.onTopologyChangeFn = onTopologyChange
+}
+
+// SetOnStpPortStateChange sets a function that is called whenever a port changes
+// its spanning tree state.
+func (s *VSwitch) SetOnStpPortStateChange(onPortStateChange func(port *VPort, state StpPortState)) {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	s.stp.onPortStateChangeFn = onPortStateChange
+}
+
+// StpBridgeID returns the bridge ID of the switch.
+func (s *VSwitch) StpBridgeID() BridgeID {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	return s.stp.id
+}
+
+// StpRootID returns the bridge ID of the current root bridge.
+func (s *VSwitch) StpRootID() BridgeID {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	return s.stp.rootVector.rootID
+}
+
+// StpRootPort returns the root port of the switch, or nil if the switch is the
+// root bridge.
+func (s *VSwitch) StpRootPort() *VPort {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	if s.stp.rootPort == nil {
+		return nil
+	}
+	return s.stp.rootPort.port
+}
+
+// StpPortRole returns the spanning tree role of a port.
+func (s *VSwitch) StpPortRole(port *VPort) StpPortRole {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	if p, ok := s.stp.portIndex[port]; ok {
+		return p.role
+	}
+	return StpPortRoleDisabled
+}
+
+// StpPortState returns the spanning tree state of a port.
+func (s *VSwitch) StpPortState(port *VPort) StpPortState {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	if p, ok := s.stp.portIndex[port]; ok {
+		return p.state
+	}
+	return StpPortStateBlocking
+}
+
+// stpLearning returns true if the switch may learn MAC addresses on port.
+func (s *VSwitch) stpLearning(port *VPort) bool {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	p, ok := s.stp.portIndex[port]
+	return !ok || p.state >= StpPortStateLearning
+}
+
+// stpForwarding returns true if the switch may forward frames on port.
+func (s *VSwitch) stpForwarding(port *VPort) bool {
+	s.stp.mu.Lock()
+	defer s.stp.mu.Unlock()
+
+	p, ok := s.stp.portIndex[port]
+	return !ok || p.state == StpPortStateForwarding
+}
+
+// stpUnlock releases the spanning tree lock and runs all queued callbacks.
+func (s *VSwitch) stpUnlock() {
+	events := s.stp.events
+	s.stp.events = nil
+	s.stp.mu.Unlock()
+
+	for _, event := range events {
+		event()
+	}
+}
+
+func (s *VSwitch) stpRun(stop chan struct{}, helloTime time.Duration) {
+	tick := helloTime / 10
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.stp.mu.Lock()
+			if s.stp.enabled {
+				s.stpTick(now)
+			}
+			s.stpUnlock()
+		}
+	}
+}
+
+// stpTick handles all spanning tree timers. The caller must hold the stp lock.
+func (s *VSwitch) stpTick(now time.Time) {
+	expired := false
+	for _, p := range s.stp.ports {
+		// ports can be connected from the other side without us being notified
+		if (p.role == StpPortRoleDisabled) == p.linkUp() {
+			expired = true
+		}
+
+		if p.received != nil && now.After(p.infoExpires) {
+			log.WithField("device", s.name).
+				WithField("port", p.port.portCname).
+				Debug("spanning tree information aged out")
+
+			p.received = nil
+			expired = true
+		}
+	}
+
+	if expired {
+		s.stpRecompute(now)
+	}
+
+	for _, p := range s.stp.ports {
+		if p.stateTimer.IsZero() || now.Before(p.stateTimer) {
+			continue
+		}
+
+		switch p.state {
+		case StpPortStateBlocking, StpPortStateListening:
+			s.stpSetState(p, StpPortStateLearning, now)
+			p.stateTimer = now.Add(s.stp.config.ForwardDelay)
+		case StpPortStateLearning:
+			p.stateTimer = time.Time{}
+			p.proposing = false
+			s.stpSetState(p, StpPortStateForwarding, now)
+		}
+	}
+
+	if !now.Before(s.stp.nextHello) {
+		s.stpSendHellos(now)
+	}
+}
+
+// stpSendHellos sends BPDUs on all designated ports. The caller must hold the stp lock.
+func (s *VSwitch) stpSendHellos(now time.Time) {
+	s.stp.nextHello = now.Add(s.stp.config.HelloTime)
+
+	for _, p := range s.stp.ports {
+		if p.role == StpPortRoleDesignated {
+			s.stpSendBpdu(p, 0, now)
+		}
+	}
+
+	if s.stp.tcnPending && s.stp.rootPort != nil {
+		s.stpSendTcn(s.stp.rootPort)
+	}
+}
+
+func (s *VSwitch) stpOwnVector() stpPriorityVector {
+	return stpPriorityVector{
+		rootID:             s.stp.id,
+		designatedBridgeID: s.stp.id,
+	}
+}
+
+func (s *VSwitch) stpIsRoot() bool {
+	return s.stp.rootPort == nil
+}
+
+// stpDesignatedVector returns the vector the switch would advertise on p.
+func (s *VSwitch) stpDesignatedVector(p *stpPort) stpPriorityVector {
+	return stpPriorityVector{
+		rootID:             s.stp.rootVector.rootID,
+		rootPathCost:       s.stp.rootVector.rootPathCost,
+		designatedBridgeID: s.stp.id,
+		designatedPortID:   p.id,
+	}
+}
+
+// stpRecompute elects the root bridge, the root port and the role of every port
+// from the received information. The caller must hold the stp lock.
+func (s *VSwitch) stpRecompute(now time.Time) {
+	rootVector := s.stpOwnVector()
+	var rootPort *stpPort
+
+	for _, p := range s.stp.ports {
+		if p.received == nil || !p.linkUp() {
+			continue
+		}
+
+		// our own BPDUs looped back, this makes the port a backup port but can
+		// never make it a root port
+		if p.received.designatedBridgeID.Compare(s.stp.id) == 0 {
+			continue
+		}
+
+		candidate := *p.received
+		candidate.rootPathCost += p.config.PathCost
+
+		c := candidate.compare(rootVector)
+		if c < 0 || (c == 0 && rootPort != nil && p.id < rootPort.id) {
+			rootVector = candidate
+			rootPort = p
+		}
+	}
+
+	oldRoot := s.stp.rootVector.rootID
+	oldRootPort := s.stp.rootPort
+	s.stp.rootVector = rootVector
+	s.stp.rootPort = rootPort
+
+	if rootVector.rootID.Compare(oldRoot) != 0 {
+		log.WithField("device", s.name).
+			WithField("root_id", rootVector.rootID).
+			WithField("cost", rootVector.rootPathCost).
+			Info("elected new root bridge")
+	}
+
+	if rootPort != oldRootPort {
+		for _, p := range s.stp.ports {
+			p.agreed = false
+		}
+	}
+
+	for _, p := range s.stp.ports {
+		role := StpPortRoleDesignated
+		switch {
+		case !p.linkUp():
+			role = StpPortRoleDisabled
+		case p == rootPort:
+			role = StpPortRoleRoot
+		case p.received == nil || s.stpDesignatedVector(p).compare(*p.received) < 0:
+			role = StpPortRoleDesignated
+		case p.received.designatedBridgeID.Compare(s.stp.id) == 0:
+			role = StpPortRoleBackup
+		default:
+			role = StpPortRoleAlternate
+		}
+
+		s.stpSetRole(p, role, now)
+	}
+}
+
+func (s *VSwitch) stpSetRole(p *stpPort, role StpPortRole, now time.Time) {
+	if p.role == role {
+		return
+	}
+
+	log.WithField("device", s.name).
+		WithField("port", p.port.portCname).
+		WithField("role", role).
+		Debug("spanning tree port role changed")
+
+	p.role = role
+
+	switch role {
+	case StpPortRoleRoot, StpPortRoleDesignated:
+		if p.state == StpPortStateBlocking {
+			s.stpStartTransition(p, now)
+		} else if s.stp.config.Mode == StpModeRSTP && role == StpPortRoleRoot && p.state != StpPortStateForwarding {
+			// a root port does not need to wait for an agreement
+			p.stateTimer = time.Time{}
+			s.stpSetState(p, StpPortStateForwarding, now)
+		}
+	default:
+		p.stateTimer = time.Time{}
+		p.proposing = false
+		s.stpSetState(p, StpPortStateBlocking, now)
+	}
+}
+
+// stpStartTransition moves a blocked port towards forwarding.
+func (s *VSwitch) stpStartTransition(p *stpPort, now time.Time) {
+	if s.stp.config.Mode == StpModeSTP {
+		s.stpSetState(p, StpPortStateListening, now)
+		p.stateTimer = now.Add(s.stp.config.ForwardDelay)
+		return
+	}
+
+	// edge and root ports move to forwarding right away, designated ports ask
+	// their neighbor for an agreement and fall back to the forward delay timer
+	if p.edge || p.role == StpPortRoleRoot {
+		p.stateTimer = time.Time{}
+		s.stpSetState(p, StpPortStateForwarding, now)
+		return
+	}
+
+	p.proposing = true
+	p.stateTimer = now.Add(s.stp.config.ForwardDelay)
+	s.stpSendBpdu(p, 0, now)
+}
+
+func (s *VSwitch) stpSetState(p *stpPort, state StpPortState, now time.Time) {
+	if p.state == state {
+		return
+	}
+
+	oldState := p.state
+	p.state = state
+
+	log.WithField("device", s.name).
+		WithField("port", p.port.portCname).
+		WithField("state", state).
+		Debug("spanning tree port state changed")
+
+	if onPortStateChange := s.stp.onPortStateChangeFn; onPortStateChange != nil {
+		port := p.port
+		s.stp.events = append(s.stp.events, func() {
+			onPortStateChange(port, state)
+		})
+	}
+
+	if state == StpPortStateBlocking {
+		s.FlushMacAddressesOnPort(p.port)
+	}
+
+	// RSTP only treats non-edge ports moving to forwarding as a topology change,
+	// STP also treats ports that stop forwarding as a topology change
+	if (state == StpPortStateForwarding && !p.edge) ||
+		(s.stp.config.Mode == StpModeSTP && oldState == StpPortStateForwarding) {
+		s.stpTopologyChange(p, now)
+	}
+}
+
+// stpTopologyChange handles a topology change detected on p.
+func (s *VSwitch) stpTopologyChange(origin *stpPort, now time.Time) {
+	log.WithField("device", s.name).
+		WithField("port", origin.port.portCname).
+		Info("spanning tree topology change")
+
+	s.stpNotifyTopologyChange()
+
+	if s.stp.config.Mode == StpModeSTP {
+		s.stpFlushExcept(nil)
+		if s.stpIsRoot() {
+			s.stp.topologyChangeUntil = now.Add(s.stp.config.MaxAge + s.stp.config.ForwardDelay)
+		} else {
+			s.stp.tcnPending = true
+			s.stpSendTcn(s.stp.rootPort)
+		}
+		return
+	}
+
+	s.stpPropagateTopologyChange(origin, now)
+}
+
+// stpPropagateTopologyChange flushes the MAC addresses learned on all ports except
+// origin and sets the TC flag on their BPDUs for a while.
+func (s *VSwitch) stpPropagateTopologyChange(origin *stpPort, now time.Time) {
+	s.stpFlushExcept(origin)
+
+	for _, p := range s.stp.ports {
+		if p == origin || p.edge {
+			continue
+		}
+
+		if p.role == StpPortRoleRoot || p.role == StpPortRoleDesignated {
+			p.tcWhile = now.Add(2 * s.stp.config.HelloTime)
+			s.stpSendBpdu(p, 0, now)
+		}
+	}
+}
+
+func (s *VSwitch) stpFlushExcept(origin *stpPort) {
+	for _, p := range s.stp.ports {
+		if p != origin && !p.edge {
+			s.FlushMacAddressesOnPort(p.port)
+		}
+	}
+}
+
+func (s *VSwitch) stpNotifyTopologyChange() {
+	if onTopologyChange := s.stp.onTopologyChangeFn; onTopologyChange != nil {
+		s.stp.events = append(s.stp.events, onTopologyChange)
+	}
+}
+
+func (s *VSwitch) stpSendBpdu(p *stpPort, flags uint8, now time.Time) {
+	if !p.linkUp() {
+		return
+	}
+
+	bpdu := &BpduPacket{
+		Version:      BpduVersionSTP,
+		Type:         BpduTypeConfig,
+		Flags:        flags,
+		RootID:       s.stp.rootVector.rootID,
+		RootPathCost: s.stp.rootVector.rootPathCost,
+		BridgeID:     s.stp.id,
+		PortID:       p.id,
+		MaxAge:       toBpduTime(s.stp.config.MaxAge),
+		HelloTime:    toBpduTime(s.stp.config.HelloTime),
+		ForwardDelay: toBpduTime(s.stp.config.ForwardDelay),
+	}
+
+	// 802.1D increments the message age by one second per hop, which limits the
+	// diameter of the network to MaxAge / 1s bridges with default timers. Scaling
+	// the increment with MaxAge keeps that limit for shorter timers.
+	if s.stp.rootPort != nil {
+		bpdu.MessageAge = s.stp.rootPort.receivedMessageAge + toBpduTime(s.stp.config.MaxAge/20)
+	}
+
+	if s.stp.config.Mode == StpModeRSTP {
+		bpdu.Version = BpduVersionRSTP
+		bpdu.Type = BpduTypeRST
+		bpdu.Flags |= p.role.bpduRole() << bpduFlagRoleShift
+		if p.state >= StpPortStateLearning {
+			bpdu.Flags |= BpduFlagLearning
+		}
+		if p.state == StpPortStateForwarding {
+			bpdu.Flags |= BpduFlagForwarding
+		}
+		if p.proposing && p.role == StpPortRoleDesignated {
+			bpdu.Flags |= BpduFlagProposal
+		}
+		if now.Before(p.tcWhile) {
+			bpdu.Flags |= BpduFlagTopologyChange
+		}
+	} else {
+		if now.Before(s.stp.topologyChangeUntil) {
+			bpdu.Flags |= BpduFlagTopologyChange
+		}
+		if p.tcAck {
+			bpdu.Flags |= BpduFlagTopologyChangeAck
+			p.tcAck = false
+		}
+	}
+
+	s.stpWrite(p, bpdu)
+}
+
+func (s *VSwitch) stpSendTcn(p *stpPort) {
+	if !p.linkUp() {
+		return
+	}
+
+	s.stpWrite(p, &BpduPacket{
+		Version: BpduVersionSTP,
+		Type:    BpduTypeTCN,
+	})
+}
+
+func (s *VSwitch) stpWrite(p *stpPort, bpdu *BpduPacket) {
+	// our BPDUs are not sent into the customer network behind a QinQ port
+	if s.isTunnelPort(p.port) {
+		return
+	}
+
+	frame, err := NewEthernetFrame(BpduMAC, p.port.mac, WithTagging(TaggingUntagged), bpdu)
+	if err != nil {
+		return
+	}
+
+	_ = p.port.Write(frame)
+}
+
+// stpReceive processes a BPDU received on port.
+func (s *VSwitch) stpReceive(port *VPort, bpdu *BpduPacket) {
+	s.stp.mu.Lock()
+	defer s.stpUnlock()
+
+	p, ok := s.stp.portIndex[port]
+	if !s.stp.enabled || !ok {
+		return
+	}
+
+	now := time.Now()
+
+	// a port receiving BPDUs is connected to a bridge, not to an end host
+	p.edge = false
+
+	if bpdu.Type == BpduTypeTCN {
+		if p.role != StpPortRoleDesignated {
+			return
+		}
+
+		p.tcAck = true
+		s.stpNotifyTopologyChange()
+		s.stpFlushExcept(nil)
+		if s.stpIsRoot() {
+			s.stp.topologyChangeUntil = now.Add(s.stp.config.MaxAge + s.stp.config.ForwardDelay)
+		} else {
+			s.stp.tcnPending = true
+			s.stpSendTcn(s.stp.rootPort)
+		}
+		s.stpSendBpdu(p, 0, now)
+		return
+	}
+
+	if bpdu.MessageAge >= bpdu.MaxAge {
+		return
+	}
+
+	vector := stpPriorityVector{
+		rootID:             bpdu.RootID,
+		rootPathCost:       bpdu.RootPathCost,
+		designatedBridgeID: bpdu.BridgeID,
+		designatedPortID:   bpdu.PortID,
+	}
+
+	fromDesignated := p.received != nil &&
+		p.received.designatedBridgeID.Compare(vector.designatedBridgeID) == 0 &&
+		p.received.designatedPortID == vector.designatedPortID
+
+	// RST BPDUs are also sent by root and alternate ports, only BPDUs of designated
+	// ports carry information about the segment
+	designatedInfo := bpdu.Type == BpduTypeConfig || bpdu.Role() == StpPortRoleDesignated.bpduRole()
+
+	if designatedInfo && (vector.compare(s.stpDesignatedVector(p)) < 0 || fromDesignated) {
+		// superior information or an update from the designated bridge of the segment
+		p.received = &vector
+		p.receivedMessageAge = bpdu.MessageAge
+		if s.stp.config.Mode == StpModeRSTP {
+			p.infoExpires = now.Add(3 * s.stp.config.HelloTime)
+		} else {
+			p.infoExpires = now.Add(s.stp.config.MaxAge - fromBpduTime(bpdu.MessageAge))
+		}
+		s.stpRecompute(now)
+	} else if p.role == StpPortRoleDesignated {
+		// the neighbor needs to learn about our better information
+		if s.stp.config.Mode == StpModeRSTP && bpdu.Flags&BpduFlagAgreement != 0 && p.proposing {
+			p.proposing = false
+			p.stateTimer = time.Time{}
+			s.stpSetState(p, StpPortStateForwarding, now)
+		} else if designatedInfo {
+			s.stpSendBpdu(p, 0, now)
+		}
+	}
+
+	if bpdu.Flags&BpduFlagTopologyChange != 0 && (p.role == StpPortRoleRoot || p.role == StpPortRoleDesignated) {
+		s.stpNotifyTopologyChange()
+		if s.stp.config.Mode == StpModeRSTP {
+			s.stpPropagateTopologyChange(p, now)
+		} else if p.role == StpPortRoleRoot {
+			// relay the topology change of the root bridge
+			s.stpFlushExcept(nil)
+			s.stp.topologyChangeUntil = now.Add(2 * s.stp.config.HelloTime)
+		}
+	}
+
+	if bpdu.Flags&BpduFlagTopologyChangeAck != 0 && p.role == StpPortRoleRoot {
+		s.stp.tcnPending = false
+	}
+
+	if s.stp.config.Mode == StpModeRSTP && bpdu.Flags&BpduFlagProposal != 0 {
+		switch p.role {
+		case StpPortRoleRoot:
+			if !p.agreed {
+				s.stpSync(p, now)
+				p.agreed = true
+			}
+			s.stpSendBpdu(p, BpduFlagAgreement, now)
+		case StpPortRoleAlternate, StpPortRoleBackup:
+			// discarding ports are always in sync and can agree right away
+			s.stpSendBpdu(p, BpduFlagAgreement, now)
+		}
+	}
+}
+
+// stpSync blocks all non-edge designated ports so the root port can agree to a
+// proposal without creating a loop. The designated ports then start their own
+// proposal towards the next bridge.
+func (s *VSwitch) stpSync(root *stpPort, now time.Time) {
+	for _, p := range s.stp.ports {
+		if p == root || p.edge || p.role != StpPortRoleDesignated || !p.linkUp() {
+			continue
+		}
+
+		p.stateTimer = time.Time{}
+		s.stpSetState(p, StpPortStateBlocking, now)
+		s.stpStartTransition(p, now)
+	}
+}
+
+// stpPortChanged recomputes the spanning tree after a port was connected or
+// disconnected. Without a spanning tree the ports DisableStp left blocked are
+// unblocked, the loops they were blocked for may be gone.
+func (s *VSwitch) stpPortChanged(port *VPort) {
+	// members of a port-channel change the port-channel
+	port = s.logicalPort(port)
+
+	s.stp.mu.Lock()
+	defer s.stpUnlock()
+
+	p, ok := s.stp.portIndex[port]
+	if !ok {
+		return
+	}
+
+	if !s.stp.enabled {
+		s.stpUnblock()
+		return
+	}
+
+	p.received = nil
+	p.edge = p.config.Edge
+	s.stpRecompute(time.Now())
+}
@@ -0,0 +1,370 @@
+package exu
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+)
+
+// vxlanNativeVlan is the native VLAN of the tunnel port. It is reserved, so every
+// frame sent to the tunnel port is tagged with its VLAN.
+const vxlanNativeVlan uint16 = 4095
+
+// vxlanSourcePortBase is the start of the source port range used for entropy
+const vxlanSourcePortBase = 49152
+
+// VxlanRemoteMac is a MAC address learned behind a remote VTEP.
+type VxlanRemoteMac struct {
+	Vni  uint32
+	Mac  net.HardwareAddr
+	Vtep net.IP
+}
+
+// VVtep is a switch that extends VLANs over an IP network by encapsulating frames
+// in VXLAN. Every VLAN mapped to a VNI is carried by a tunnel port, frames leaving
+// through it are sent to the remote VTEP the destination was learned behind, or
+// replicated to all remote VTEPs of the VNI if the destination is unknown.
+type VVtep struct {
+	*VSwitch
+	underlay *IpDevice
+	nve      *VPort
+
+	mu          sync.RWMutex
+	gateway     net.IP
+	vlanVnis    map[uint16]uint32
+	vniVlans    map[uint32]uint16
+	remoteVteps map[uint32][]net.IP
+	remoteMacs  map[macAddressKey]net.IP
+}
+
+func NewVVtep(name string, numberOfPorts int) *VVtep {
+	vVtep := &VVtep{
+		VSwitch:     NewVSwitch(name, numberOfPorts),
+		vlanVnis:    make(map[uint16]uint32),
+		vniVlans:    make(map[uint32]uint16),
+		remoteVteps: make(map[uint32][]net.IP),
+		remoteMacs:  make(map[macAddressKey]net.IP),
+	}
+	vVtep.underlay = NewIpDevice(name, 1, vVtep.underlayReceive, func(*VPort) {}, func(*VPort) {})
+
+	vVtep.nve = NewVPort(vVtep.underlay.ports[0].mac, "nve1")
+	vVtep.nve.writeFn = vVtep.nveWrite
+
+	vVtep.addVirtualPort(vVtep.nve)
+
+	vVtep.SetPortMode(vVtep.nve, PortModeConfig{
+		Mode:       Trunk,
+		NativeVlan: vxlanNativeVlan,
+	})
+
+	return vVtep
+}
+
+// Underlay returns the IP device connecting the VTEP to the IP network.
+func (v *VVtep) Underlay() *IpDevice {
+	return v.underlay
+}
+
+// TunnelPort returns the port carrying all VLANs mapped to a VNI.
+func (v *VVtep) TunnelPort() *VPort {
+	return v.nve
+}
+
+// SetUnderlayIPNet sets the source address of the VTEP and the gateway remote VTEPs
+// outside of its network are reached through.
+func (v *VVtep) SetUnderlayIPNet(ipNet net.IPNet, gateway net.IP) {
+	v.underlay.SetPortIPNet(v.underlay.ports[0], ipNet)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.gateway = gateway
+}
+
+// MapVlanToVni extends vlan over the VXLAN segment vni.
+func (v *VVtep) MapVlanToVni(vlan uint16, vni uint32) error {
+	if vni == 0 || vni > MaxVni {
+		return errors.New("vni must be between 1 and 16777215")
+	}
+
+	if vlan == 0 || vlan >= vxlanNativeVlan {
+		return errors.New("vlan must be between 1 and 4094")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if mapped, ok := v.vlanVnis[vlan]; ok && mapped != vni {
+		return errors.New("vlan is already mapped to another vni")
+	}
+	if mapped, ok := v.vniVlans[vni]; ok && mapped != vlan {
+		return errors.New("vni is already mapped to another vlan")
+	}
+
+	v.vlanVnis[vlan] = vni
+	v.vniVlans[vni] = vlan
+
+	log.WithField("device", v.name).
+		WithField("vlan", vlan).
+		WithField("vni", vni).
+		Info("mapped vlan to vni")
+	return nil
+}
+
+// MapPortToVni puts all traffic received on port into vni, tagged or not. The port
+// becomes a QinQ port in the VLAN mapped to vni, so customer tags are carried
+// through the VXLAN segment.
+func (v *VVtep) MapPortToVni(port *VPort, vni uint32) error {
+	v.mu.RLock()
+	vlan, ok := v.vniVlans[vni]
+	v.mu.RUnlock()
+
+	if !ok {
+		return errors.New("vni is not mapped to a vlan")
+	}
+
+	v.SetPortMode(port, PortModeConfig{
+		Mode: Dot1qTunnel,
+		Vlan: vlan,
+	})
+	return nil
+}
+
+// UnmapVni removes vni, its remote VTEPs and the MAC addresses learned behind them.
+func (v *VVtep) UnmapVni(vni uint32) {
+	v.mu.Lock()
+	vlan, ok := v.vniVlans[vni]
+	if ok {
+		delete(v.vniVlans, vni)
+		delete(v.vlanVnis, vlan)
+		delete(v.remoteVteps, vni)
+		for key := range v.remoteMacs {
+			if key.vlan == vlan {
+				delete(v.remoteMacs, key)
+			}
+		}
+	}
+	v.mu.Unlock()
+
+	if ok {
+		v.FlushMacAddresses(MacFilterVlan(vlan), MacFilterPort(v.nve))
+	}
+}
+
+// AddRemoteVtep adds ip to the flood list of vni. Broadcast, unknown unicast and
+// multicast frames of vni are replicated to every remote VTEP on the list.
+func (v *VVtep) AddRemoteVtep(vni uint32, ip net.IP) error {
+	if ip.To4() == nil {
+		return errors.New("remote vtep must be an ipv4 address")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, remote := range v.remoteVteps[vni] {
+		if remote.Equal(ip) {
+			return nil
+		}
+	}
+
+	v.remoteVteps[vni] = append(v.remoteVteps[vni], ip.To4())
+	return nil
+}
+
+// RemoveRemoteVtep removes ip from the flood list of vni.
+func (v *VVtep) RemoveRemoteVtep(vni uint32, ip net.IP) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// the flood list is copied, frames being replicated may still use the old one
+	remotes := make([]net.IP, 0, len(v.remoteVteps[vni]))
+	for _, remote := range v.remoteVteps[vni] {
+		if !remote.Equal(ip) {
+			remotes = append(remotes, remote)
+		}
+	}
+	v.remoteVteps[vni] = remotes
+}
+
+// RemoteMacs returns the MAC addresses currently reached through remote VTEPs,
+// sorted by VNI and MAC address.
+func (v *VVtep) RemoteMacs() []VxlanRemoteMac {
+	v.mu.RLock()
+	remoteMacs := make(map[macAddressKey]VxlanRemoteMac, len(v.remoteMacs))
+	for key, vtep := range v.remoteMacs {
+		mac, _ := net.ParseMAC(key.mac)
+		remoteMacs[key] = VxlanRemoteMac{
+			Vni:  v.vlanVnis[key.vlan],
+			Mac:  mac,
+			Vtep: vtep,
+		}
+	}
+	v.mu.RUnlock()
+
+	// entries that aged out of or moved in the MAC address table are stale
+	macs := make([]VxlanRemoteMac, 0, len(remoteMacs))
+	for key, mac := range remoteMacs {
+		if port, ok := v.lookupMacAddress(v.macTableVlan(key.vlan), mac.Mac); ok && port == v.nve {
+			macs = append(macs, mac)
+		}
+	}
+
+	sort.Slice(macs, func(i, j int) bool {
+		if macs[i].Vni != macs[j].Vni {
+			return macs[i].Vni < macs[j].Vni
+		}
+		return bytes.Compare(macs[i].Mac, macs[j].Mac) < 0
+	})
+	return macs
+}
+
+// nveWrite encapsulates a frame the switch sent to the tunnel port. The frame is
+// tagged with its VLAN.
+func (v *VVtep) nveWrite(data *EthernetFrame) error {
+	if data.Tagging() == TaggingUntagged {
+		return nil
+	}
+
+	vlan := data.VlanID()
+	inner := data.Clone()
+	_, _ = inner.PopTag()
+
+	v.mu.RLock()
+	vni, ok := v.vlanVnis[vlan]
+	if !ok {
+		v.mu.RUnlock()
+		return nil
+	}
+
+	remotes := v.remoteVteps[vni]
+	remote, known := v.remoteMacs[macAddressKey{vlan: vlan, mac: inner.Destination().String()}]
+	v.mu.RUnlock()
+
+	// known unicast goes to the VTEP the destination was learned behind, everything
+	// else is replicated to all remote VTEPs of the VNI
+	if known && inner.Destination()[0]&0x01 == 0 {
+		if port, ok := v.lookupMacAddress(v.macTableVlan(vlan), inner.Destination()); ok && port == v.nve {
+			remotes = []net.IP{remote}
+		}
+	}
+
+	for _, remote := range remotes {
+		v.encapsulate(vni, remote, inner)
+	}
+	return nil
+}
+
+// encapsulate sends inner to the remote VTEP with the given address.
+func (v *VVtep) encapsulate(vni uint32, remote net.IP, inner *EthernetFrame) {
+	port := v.underlay.ports[0]
+	local := v.underlay.portIP(port)
+	if local.IP == nil {
+		return
+	}
+
+	vxlan := &VXLANPacket{
+		Vni:   vni,
+		Frame: *inner,
+	}
+	vxlanData, err := vxlan.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	// the source port carries the entropy of the inner flow for ECMP in the underlay
+	udp := &UDPPacket{
+		SourcePort:      uint16(vxlanSourcePortBase + flowHash(inner)%(1<<16-vxlanSourcePortBase)),
+		DestinationPort: VxlanPort,
+		Payload:         vxlanData,
+	}
+	udpData, _ := udp.MarshalBinary()
+
+	packet := &IPv4Packet{
+		Header: IPv4Header{
+			Version:       4,
+			IHL:           5,
+			TotalLength:   uint16(20 + len(udpData)),
+			FlagsFragment: IPv4FlagDontFragment,
+			TTL:           64,
+			Protocol:      IPv4ProtocolUDP,
+			SourceIP:      local.IP.To4(),
+			DestinationIP: remote,
+		},
+		Payload: udpData,
+	}
+	packet.Header.HeaderChecksum = packet.Header.CalculateChecksum()
+
+	// remote VTEPs outside of our network are reached through the gateway
+	nextHop := remote
+	network := net.IPNet{IP: local.IP.Mask(local.Mask), Mask: local.Mask}
+	if !network.Contains(remote) {
+		v.mu.RLock()
+		nextHop = v.gateway
+		v.mu.RUnlock()
+
+		if nextHop == nil {
+			return
+		}
+	}
+
+	send := func(mac net.HardwareAddr) {
+		frame, err := NewEthernetFrame(mac, port.mac, WithTagging(TaggingUntagged), packet)
+		if err != nil {
+			return
+		}
+		_ = port.Write(frame)
+	}
+
+	v.underlay.arpTableMu.RLock()
+	mac, ok := v.underlay.arpTable[nextHop.String()]
+	v.underlay.arpTableMu.RUnlock()
+
+	if ok {
+		send(mac)
+		return
+	}
+
+	WithWaitGroup(func() {
+		if mac, _ := v.underlay.ArpResolve(nextHop); mac != nil {
+			send(mac)
+		}
+	})
+}
+
+// underlayReceive decapsulates VXLAN packets addressed to the VTEP and switches the
+// inner frame as if it was received on the tunnel port.
+func (v *VVtep) underlayReceive(port *VPort, data *EthernetFrame) {
+	header, udp, ok := ipv4Udp(data)
+	if !ok || udp.DestinationPort != VxlanPort || !header.DestinationIP.Equal(v.underlay.portIP(port).IP) {
+		return
+	}
+
+	vxlan := &VXLANPacket{}
+	if err := vxlan.UnmarshalBinary(udp.Payload); err != nil {
+		return
+	}
+
+	v.mu.Lock()
+	vlan, ok := v.vniVlans[vxlan.Vni]
+	if ok {
+		v.remoteMacs[macAddressKey{vlan: vlan, mac: vxlan.Frame.Source().String()}] = append(net.IP{}, header.SourceIP.To4()...)
+	}
+	v.mu.Unlock()
+
+	if !ok {
+		log.WithField("device", v.name).
+			WithField("vni", vxlan.Vni).
+			Trace("dropped vxlan packet of unknown vni")
+		return
+	}
+
+	inner := &vxlan.Frame
+	if err := inner.PushTag(VlanTag{PCP: inner.PCP(), VID: vlan}); err != nil {
+		return
+	}
+
+	v.receive(v.nve, inner)
+}
@@ -14,12 +14,14 @@ var (
 	EtherTypeIPv4                = EtherType{0x08, 0x00}
 	EtherTypeARP                 = EtherType{0x08, 0x06}
 	EtherTypeWakeOnLAN           = EtherType{0x08, 0x42}
+	EtherTypeVLAN                = EtherType{0x81, 0x00}
 	EtherTypeRARP                = EtherType{0x80, 0x35}
 	EtherTypeAppleTalk           = EtherType{0x80, 0x9B}
 	EtherTypeAARP                = EtherType{0x80, 0xF3}
 	EtherTypeQNXQnet             = EtherType{0x82, 0x04}
 	EtherTypeIPv6                = EtherType{0x86, 0xDD}
 	EtherTypeEthernetFlowControl = EtherType{0x88, 0x08}
+	EtherTypeSlowProtocols       = EtherType{0x88, 0x09}
 	EtherTypeCobraNet            = EtherType{0x88, 0x19}
 	EtherTypePPPoEDiscovery      = EtherType{0x88, 0x63}
 	EtherTypePPPoESession        = EtherType{0x88, 0x64}
@@ -33,6 +35,7 @@ var (
 	EtherTypeSERCOS3             = EtherType{0x88, 0xCD}
 	EtherTypeWSMP                = EtherType{0x88, 0xDC}
 	EtherTypeHomePlugAVMME       = EtherType{0x88, 0xE1}
+	EtherTypeQinQ                = EtherType{0x88, 0xA8}
 	EtherTypeMRP                 = EtherType{0x88, 0xE3}
 	EtherTypeFCoE                = EtherType{0x89, 0x06}
 	EtherTypeFCoEInit            = EtherType{0x89, 0x14}
@@ -43,7 +43,12 @@ func (f *EthernetFrame) Tagging() VlanTagging {
 	if (*f)[12] == 0x81 && (*f)[13] == 0x00 {
 		return TaggingTagged
 	} else if (*f)[12] == 0x88 && (*f)[13] == 0xa8 {
-		return TaggingDoubleTagged
+		// a service tag is only followed by a customer tag if the customer tagged
+		// the frame
+		if len(*f) >= 18 && (*f)[16] == 0x81 && (*f)[17] == 0x00 {
+			return TaggingDoubleTagged
+		}
+		return TaggingTagged
 	}
 	return TaggingUntagged
 }
@@ -93,6 +98,13 @@ func (f *EthernetFrame) resize(length int) {
 	}
 }
 
+// Clone returns a copy of the frame that does not share its underlying array with f.
+func (f *EthernetFrame) Clone() *EthernetFrame {
+	clone := make(EthernetFrame, len(*f))
+	copy(clone, *f)
+	return &clone
+}
+
 func (f *EthernetFrame) FromBytes(data []byte) error {
 	if len(data) < 14 {
 		return errors.New("ethernet frame must be at least 14 bytes")
@@ -122,9 +134,14 @@ func NewEthernetFrame(dst net.HardwareAddr, src net.HardwareAddr, tagData TagDat
 	if tagging == TaggingTagged {
 		(*f)[12] = 0x81
 		(*f)[13] = 0x00
+		copy((*f)[14:16], tagData[0:2])
 	} else if tagging == TaggingDoubleTagged {
 		(*f)[12] = 0x88
 		(*f)[13] = 0xa8
+		copy((*f)[14:16], tagData[0:2])
+		(*f)[16] = 0x81
+		(*f)[17] = 0x00
+		copy((*f)[18:20], tagData[2:4])
 	}
 	(*f)[12+tagging] = ethertype[0]
 	(*f)[12+tagging+1] = ethertype[1]
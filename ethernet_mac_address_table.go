@@ -0,0 +1,436 @@
+package exu
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"time"
+)
+
+// DefaultMacAgingTime is the time after which a learned MAC address is removed
+// from the MAC address table if no frame was received from it.
+const DefaultMacAgingTime = 300 * time.Second
+
+// macAddressKey identifies an entry in the MAC address table. Addresses are
+// learned independently per VLAN, so the same MAC may be on different ports in
+// different VLANs.
+type macAddressKey struct {
+	vlan uint16
+	mac  string
+}
+
+type macAddressEntry struct {
+	port     *VPort
+	lastSeen time.Time
+	// static entries are configured, they never age out, move or get flushed
+	static bool
+}
+
+// expired returns true if the entry was not refreshed within agingTime. An aging
+// time of 0 disables aging.
+func (m *macAddressEntry) expired(agingTime time.Duration, now time.Time) bool {
+	return !m.static && agingTime > 0 && now.Sub(m.lastSeen) > agingTime
+}
+
+type MacAddressType int
+
+const (
+	MacAddressDynamic MacAddressType = iota
+	MacAddressStatic
+)
+
+func (t MacAddressType) String() string {
+	if t == MacAddressStatic {
+		return "static"
+	}
+	return "dynamic"
+}
+
+// SetMacAgingTime sets the time after which learned MAC addresses are removed from
+// the MAC address table. An aging time of 0 disables aging.
+func (e *EthernetDevice) SetMacAgingTime(agingTime time.Duration) {
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	e.macAgingTime = agingTime
+}
+
+// SetMacTableLimit sets the maximum number of entries in the MAC address table.
+// When the table is full, the least recently seen dynamic entry is evicted to make
+// room for a new one. A limit of 0 means the table is unbounded.
+func (e *EthernetDevice) SetMacTableLimit(limit int) {
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	e.macTableLimit = limit
+	for e.macTableLimit > 0 && len(e.macAddressMap) > e.macTableLimit {
+		size := len(e.macAddressMap)
+		e.evictMacAddress(time.Now())
+
+		// static entries are never evicted
+		if len(e.macAddressMap) == size {
+			break
+		}
+	}
+}
+
+// SetOnMacMove sets a function that is called whenever a known MAC address is seen
+// on a different port than the one it was learned on.
+func (e *EthernetDevice) SetOnMacMove(onMacMove func(mac net.HardwareAddr, vlan uint16, from, to *VPort)) {
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	e.onMacMoveFn = onMacMove
+}
+
+// learnMacAddress adds or refreshes the entry for mac, moving it to port if it
+// was learned on another port before.
+func (e *EthernetDevice) learnMacAddress(port *VPort, vlan uint16, mac net.HardwareAddr) {
+	if mac.String() == BroadcastMAC.String() {
+		return
+	}
+
+	now := time.Now()
+	key := macAddressKey{vlan: vlan, mac: mac.String()}
+
+	e.macAddressMapMu.Lock()
+
+	entry, ok := e.macAddressMap[key]
+	if ok && entry.expired(e.macAgingTime, now) {
+		delete(e.macAddressMap, key)
+		ok = false
+	}
+
+	// static entries are neither refreshed nor moved by traffic
+	if ok && entry.static {
+		e.macAddressMapMu.Unlock()
+		return
+	}
+
+	if ok {
+		from := entry.port
+		entry.lastSeen = now
+		entry.port = port
+		onMacMove := e.onMacMoveFn
+		e.macAddressMapMu.Unlock()
+
+		if from != port {
+			log.WithField("mac", key.mac).
+				WithField("vlan", vlan).
+				WithField("from", from.portCname).
+				WithField("port", port.portCname).
+				WithField("device", e.name).
+				Debug("mac address moved")
+
+			if onMacMove != nil {
+				onMacMove(mac, vlan, from, port)
+			}
+		}
+		return
+	}
+
+	if e.macTableLimit > 0 && len(e.macAddressMap) >= e.macTableLimit {
+		e.evictMacAddress(now)
+	}
+
+	e.macAddressMap[key] = &macAddressEntry{
+		port:     port,
+		lastSeen: now,
+	}
+	e.macAddressMapMu.Unlock()
+
+	log.WithField("mac", key.mac).
+		WithField("vlan", vlan).
+		WithField("port", port.portCname).
+		WithField("device", e.name).
+		Trace("learned new mac address")
+}
+
+// evictMacAddress removes all expired entries or, if there are none, the least
+// recently seen entry. The caller must hold macAddressMapMu.
+func (e *EthernetDevice) evictMacAddress(now time.Time) {
+	oldestKey := macAddressKey{}
+	var oldest *macAddressEntry
+	evicted := false
+
+	for key, entry := range e.macAddressMap {
+		if entry.static {
+			continue
+		}
+
+		if entry.expired(e.macAgingTime, now) {
+			delete(e.macAddressMap, key)
+			evicted = true
+			continue
+		}
+
+		if oldest == nil || entry.lastSeen.Before(oldest.lastSeen) {
+			oldestKey = key
+			oldest = entry
+		}
+	}
+
+	if evicted || oldest == nil {
+		return
+	}
+
+	delete(e.macAddressMap, oldestKey)
+
+	log.WithField("mac", oldestKey.mac).
+		WithField("vlan", oldestKey.vlan).
+		WithField("port", oldest.port.portCname).
+		WithField("device", e.name).
+		Debug("evicted mac address, table full")
+}
+
+// lookupMacAddress returns the port a MAC address was learned on in vlan.
+func (e *EthernetDevice) lookupMacAddress(vlan uint16, mac net.HardwareAddr) (*VPort, bool) {
+	key := macAddressKey{vlan: vlan, mac: mac.String()}
+
+	e.macAddressMapMu.RLock()
+	entry, ok := e.macAddressMap[key]
+	if !ok {
+		e.macAddressMapMu.RUnlock()
+		return nil, false
+	}
+
+	if !entry.expired(e.macAgingTime, time.Now()) {
+		port := entry.port
+		e.macAddressMapMu.RUnlock()
+		return port, true
+	}
+	e.macAddressMapMu.RUnlock()
+
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	// check again, the entry might have been refreshed in the meantime
+	if entry, ok = e.macAddressMap[key]; ok && entry.expired(e.macAgingTime, time.Now()) {
+		delete(e.macAddressMap, key)
+
+		log.WithField("mac", key.mac).
+			WithField("vlan", key.vlan).
+			WithField("port", entry.port.portCname).
+			WithField("device", e.name).
+			Trace("mac address aged out")
+		return nil, false
+	}
+
+	if !ok {
+		return nil, false
+	}
+	return entry.port, true
+}
+
+// MacAddressEntry is an entry of the MAC address table of an EthernetDevice.
+type MacAddressEntry struct {
+	Mac  net.HardwareAddr
+	Vlan uint16
+	Port *VPort
+	Type MacAddressType
+	// Age is the time since a frame was last received from a dynamic entry, it is
+	// always 0 for static entries
+	Age time.Duration
+}
+
+// MacAddressFilter selects entries when querying the MAC address table.
+type MacAddressFilter func(entry MacAddressEntry) bool
+
+// MacFilterVlan selects entries learned in vlan. The addresses of a secondary
+// private VLAN are kept in its primary VLAN, they are selected by both VLANs.
+func MacFilterVlan(vlan uint16) MacAddressFilter {
+	return func(entry MacAddressEntry) bool {
+		return entry.Vlan == vlan
+	}
+}
+
+// MacFilterPort selects entries learned on port.
+func MacFilterPort(port *VPort) MacAddressFilter {
+	return func(entry MacAddressEntry) bool {
+		return entry.Port == port
+	}
+}
+
+// MacFilterType selects entries of the given type.
+func MacFilterType(macType MacAddressType) MacAddressFilter {
+	return func(entry MacAddressEntry) bool {
+		return entry.Type == macType
+	}
+}
+
+// MacFilterMac selects entries of mac.
+func MacFilterMac(mac net.HardwareAddr) MacAddressFilter {
+	return func(entry MacAddressEntry) bool {
+		return bytes.Equal(entry.Mac, mac)
+	}
+}
+
+// entryMatcher returns a function that matches table entries against every
+// filter. An entry also matches if it does so in a VLAN that shares its table.
+func (e *EthernetDevice) entryMatcher(filters []MacAddressFilter, now time.Time) func(key macAddressKey, entry *macAddressEntry) bool {
+	// taken before the MAC address table is locked
+	shared := e.macTableSharedFn()
+
+	return func(key macAddressKey, entry *macAddressEntry) bool {
+		macEntry := entry.publicEntry(key, now)
+		if macEntry.matches(filters) {
+			return true
+		}
+
+		for _, vlan := range shared[key.vlan] {
+			macEntry.Vlan = vlan
+			if macEntry.matches(filters) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matches returns true if the entry matches every filter.
+func (m MacAddressEntry) matches(filters []MacAddressFilter) bool {
+	for _, filter := range filters {
+		if !filter(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicEntry converts a table entry to a MacAddressEntry.
+func (m *macAddressEntry) publicEntry(key macAddressKey, now time.Time) MacAddressEntry {
+	mac, _ := net.ParseMAC(key.mac)
+	entry := MacAddressEntry{
+		Mac:  mac,
+		Vlan: key.vlan,
+		Port: m.port,
+		Type: MacAddressDynamic,
+		Age:  now.Sub(m.lastSeen),
+	}
+
+	if m.static {
+		entry.Type = MacAddressStatic
+		entry.Age = 0
+	}
+	return entry
+}
+
+// AddStaticMacAddress adds a static entry for mac in vlan on port. Static entries
+// replace dynamic entries for the same address, they never age out or move to
+// another port and are kept when the port goes down. Entries in a secondary
+// private VLAN are kept in the table of its primary VLAN.
+func (e *EthernetDevice) AddStaticMacAddress(vlan uint16, mac net.HardwareAddr, port *VPort) error {
+	if bytes.Equal(mac, BroadcastMAC) {
+		return errors.New("broadcast address can not be a static entry")
+	}
+
+	e.portsMu.RLock()
+	found := false
+	for _, p := range e.floodPorts() {
+		if p == port {
+			found = true
+			break
+		}
+	}
+	e.portsMu.RUnlock()
+
+	if !found {
+		return errors.New("port not found on machine")
+	}
+
+	key := macAddressKey{vlan: e.macTableVlanFn(vlan), mac: mac.String()}
+
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	e.macAddressMap[key] = &macAddressEntry{
+		port:     port,
+		lastSeen: time.Now(),
+		static:   true,
+	}
+
+	log.WithField("mac", mac.String()).
+		WithField("vlan", vlan).
+		WithField("port", port.portCname).
+		WithField("device", e.name).
+		Debug("added static mac address")
+
+	return nil
+}
+
+// RemoveStaticMacAddress removes the static entry for mac in vlan.
+func (e *EthernetDevice) RemoveStaticMacAddress(vlan uint16, mac net.HardwareAddr) error {
+	key := macAddressKey{vlan: e.macTableVlanFn(vlan), mac: mac.String()}
+
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	entry, ok := e.macAddressMap[key]
+	if !ok || !entry.static {
+		return errors.New("no static entry for mac address")
+	}
+
+	delete(e.macAddressMap, key)
+	return nil
+}
+
+// MacAddressTable returns all entries of the MAC address table that match every
+// filter, sorted by VLAN and MAC address.
+func (e *EthernetDevice) MacAddressTable(filters ...MacAddressFilter) []MacAddressEntry {
+	now := time.Now()
+	entries := make([]MacAddressEntry, 0)
+	matches := e.entryMatcher(filters, now)
+
+	e.macAddressMapMu.RLock()
+	for key, entry := range e.macAddressMap {
+		if !entry.expired(e.macAgingTime, now) && matches(key, entry) {
+			entries = append(entries, entry.publicEntry(key, now))
+		}
+	}
+	e.macAddressMapMu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Vlan != entries[j].Vlan {
+			return entries[i].Vlan < entries[j].Vlan
+		}
+		return bytes.Compare(entries[i].Mac, entries[j].Mac) < 0
+	})
+
+	return entries
+}
+
+// flushMacAddresses removes every dynamic entry for which match returns true.
+func (e *EthernetDevice) flushMacAddresses(match func(key macAddressKey, entry *macAddressEntry) bool) {
+	e.macAddressMapMu.Lock()
+	defer e.macAddressMapMu.Unlock()
+
+	for key, entry := range e.macAddressMap {
+		if !entry.static && match(key, entry) {
+			delete(e.macAddressMap, key)
+		}
+	}
+}
+
+// FlushMacAddresses removes all dynamic entries that match every filter from the
+// MAC address table. Static entries are only removed by RemoveStaticMacAddress.
+func (e *EthernetDevice) FlushMacAddresses(filters ...MacAddressFilter) {
+	e.flushMacAddresses(e.entryMatcher(filters, time.Now()))
+}
+
+// FlushMacAddressesOnPort removes all dynamic entries learned on port.
+func (e *EthernetDevice) FlushMacAddressesOnPort(port *VPort) {
+	e.flushMacAddresses(func(_ macAddressKey, entry *macAddressEntry) bool {
+		return entry.port == port
+	})
+}
+
+// FlushMacAddressesInVlan removes all dynamic entries learned in vlan. Flushing a
+// secondary private VLAN flushes the shared table of its primary VLAN.
+func (e *EthernetDevice) FlushMacAddressesInVlan(vlan uint16) {
+	tableVlan := e.macTableVlanFn(vlan)
+	e.flushMacAddresses(func(key macAddressKey, _ *macAddressEntry) bool {
+		return key.vlan == tableVlan
+	})
+}
@@ -1,5 +1,10 @@
 package exu
 
+import "errors"
+
+var FrameNotTaggedError = errors.New("frame is not tagged")
+var FrameTagLimitError = errors.New("frame already carries two tags")
+
 type TagData []byte
 
 func WithTagging(tagging VlanTagging, tags ...uint32) TagData {
@@ -31,3 +36,148 @@ func (t TagData) GetTagging() VlanTagging {
 	}
 	return TaggingDoubleTagged
 }
+
+// VlanTag is the decoded tag control information (TCI) of an 802.1Q tag.
+type VlanTag struct {
+	PCP uint8  // 3-bit Priority Code Point
+	DEI bool   // 1-bit Drop Eligible Indicator
+	VID uint16 // 12-bit VLAN Identifier
+}
+
+// NewVlanTag decodes a TCI into a VlanTag.
+func NewVlanTag(tci uint16) VlanTag {
+	return VlanTag{
+		PCP: uint8(tci >> 13),
+		DEI: tci&0x1000 != 0,
+		VID: tci & 0x0fff,
+	}
+}
+
+// TCI encodes the tag into its 16-bit wire representation.
+func (t VlanTag) TCI() uint16 {
+	tci := uint16(t.PCP&0x07)<<13 | t.VID&0x0fff
+	if t.DEI {
+		tci |= 0x1000
+	}
+	return tci
+}
+
+// tci returns the TCI of the index-th tag, it follows the TPID of the tag at
+// offset 12+4*index. The caller has to make sure the frame carries that many tags.
+func (f *EthernetFrame) tci(index int) uint16 {
+	pos := 14 + 4*index
+	return uint16((*f)[pos])<<8 | uint16((*f)[pos+1])
+}
+
+// OuterTag returns the outermost tag of the frame.
+func (f *EthernetFrame) OuterTag() (VlanTag, error) {
+	if f.Tagging() == TaggingUntagged {
+		return VlanTag{}, FrameNotTaggedError
+	}
+	return NewVlanTag(f.tci(0)), nil
+}
+
+// InnerTag returns the inner tag of a double tagged frame.
+func (f *EthernetFrame) InnerTag() (VlanTag, error) {
+	if f.Tagging() != TaggingDoubleTagged {
+		return VlanTag{}, FrameNotTaggedError
+	}
+	return NewVlanTag(f.tci(1)), nil
+}
+
+// VlanID returns the VLAN ID of the outermost tag, or 0 if the frame is untagged.
+func (f *EthernetFrame) VlanID() uint16 {
+	tag, _ := f.OuterTag()
+	return tag.VID
+}
+
+// InnerVlanID returns the VLAN ID of the inner tag of a double tagged frame, or 0
+// if the frame is not double tagged.
+func (f *EthernetFrame) InnerVlanID() uint16 {
+	tag, _ := f.InnerTag()
+	return tag.VID
+}
+
+// PCP returns the priority code point of the outermost tag, or 0 if the frame is
+// untagged.
+func (f *EthernetFrame) PCP() uint8 {
+	tag, _ := f.OuterTag()
+	return tag.PCP
+}
+
+// DEI returns the drop eligible indicator of the outermost tag, or false if the
+// frame is untagged.
+func (f *EthernetFrame) DEI() bool {
+	tag, _ := f.OuterTag()
+	return tag.DEI
+}
+
+// PushTag inserts a new outermost tag into the frame. An untagged frame becomes an
+// 802.1Q tagged frame, a tagged frame becomes an 802.1ad double tagged frame with
+// tag as the S-tag.
+func (f *EthernetFrame) PushTag(tag VlanTag) error {
+	tpid := EtherTypeVLAN
+	if f.Tagging() != TaggingUntagged {
+		tpid = EtherTypeQinQ
+	}
+	return f.pushTag(tpid, tag)
+}
+
+// PushServiceTag inserts an 802.1ad S-tag as the outermost tag of the frame, on top
+// of the customer tag if there is one.
+func (f *EthernetFrame) PushServiceTag(tag VlanTag) error {
+	return f.pushTag(EtherTypeQinQ, tag)
+}
+
+// serviceTagged returns true if the outermost tag of the frame is an 802.1ad S-tag.
+func (f *EthernetFrame) serviceTagged() bool {
+	return (EtherType{(*f)[12], (*f)[13]}).Equal(EtherTypeQinQ)
+}
+
+func (f *EthernetFrame) pushTag(tpid EtherType, tag VlanTag) error {
+	// a frame carries at most one service tag, on top of the customer tag
+	if f.serviceTagged() {
+		return FrameTagLimitError
+	}
+
+	oldLength := len(*f)
+	f.resize(oldLength + 4)
+	copy((*f)[16:], (*f)[12:oldLength])
+
+	tci := tag.TCI()
+	(*f)[12] = tpid[0]
+	(*f)[13] = tpid[1]
+	(*f)[14] = byte(tci >> 8)
+	(*f)[15] = byte(tci)
+
+	return nil
+}
+
+// PopTag removes the outermost tag from the frame and returns it. A double tagged
+// frame keeps its inner tag as a regular 802.1Q tag.
+func (f *EthernetFrame) PopTag() (VlanTag, error) {
+	tag, err := f.OuterTag()
+	if err != nil {
+		return tag, err
+	}
+
+	copy((*f)[12:], (*f)[16:])
+	*f = (*f)[:len(*f)-4]
+
+	return tag, nil
+}
+
+// SetVlan changes the VLAN ID of the outermost tag, keeping PCP and DEI.
+func (f *EthernetFrame) SetVlan(vlan uint16) error {
+	tag, err := f.OuterTag()
+	if err != nil {
+		return err
+	}
+
+	tag.VID = vlan
+	tci := tag.TCI()
+	(*f)[14] = byte(tci >> 8)
+	(*f)[15] = byte(tci)
+
+	return nil
+}
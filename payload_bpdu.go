@@ -0,0 +1,185 @@
+package exu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// BpduMAC is the destination address of spanning tree BPDUs.
+var BpduMAC = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x00}
+
+// BPDUs are sent as 802.3 frames with an LLC header instead of an EtherType.
+var bpduLlcHeader = []byte{0x42, 0x42, 0x03}
+
+type BpduVersion uint8
+
+const (
+	BpduVersionSTP  BpduVersion = 0
+	BpduVersionRSTP BpduVersion = 2
+)
+
+type BpduType uint8
+
+const (
+	BpduTypeConfig BpduType = 0x00
+	BpduTypeRST    BpduType = 0x02
+	BpduTypeTCN    BpduType = 0x80
+)
+
+// BPDU flags
+const (
+	BpduFlagTopologyChange    uint8 = 0x01
+	BpduFlagProposal          uint8 = 0x02
+	BpduFlagLearning          uint8 = 0x10
+	BpduFlagForwarding        uint8 = 0x20
+	BpduFlagAgreement         uint8 = 0x40
+	BpduFlagTopologyChangeAck uint8 = 0x80
+)
+
+// bpduFlagRoleShift is the position of the 2-bit port role in the RST BPDU flags.
+const bpduFlagRoleShift = 2
+
+// BridgeID identifies a bridge by its priority and MAC address. Lower IDs are
+// preferred in the root election.
+type BridgeID struct {
+	Priority uint16
+	Mac      net.HardwareAddr
+}
+
+// Compare returns -1 if b is preferred over other, 1 if other is preferred and 0
+// if both are equal.
+func (b BridgeID) Compare(other BridgeID) int {
+	if b.Priority != other.Priority {
+		if b.Priority < other.Priority {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(b.Mac, other.Mac)
+}
+
+func (b BridgeID) String() string {
+	return fmt.Sprintf("%d.%s", b.Priority, b.Mac)
+}
+
+func (b BridgeID) marshal(data []byte) {
+	binary.BigEndian.PutUint16(data[0:2], b.Priority)
+	copy(data[2:8], b.Mac)
+}
+
+func unmarshalBridgeID(data []byte) BridgeID {
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, data[2:8])
+	return BridgeID{
+		Priority: binary.BigEndian.Uint16(data[0:2]),
+		Mac:      mac,
+	}
+}
+
+// BpduPacket represents a configuration, RST or topology change notification BPDU.
+// Times are in units of 1/256 seconds, as on the wire.
+type BpduPacket struct {
+	Version      BpduVersion
+	Type         BpduType
+	Flags        uint8
+	RootID       BridgeID
+	RootPathCost uint32
+	BridgeID     BridgeID
+	PortID       uint16
+	MessageAge   uint16
+	MaxAge       uint16
+	HelloTime    uint16
+	ForwardDelay uint16
+}
+
+// Role returns the port role encoded in the flags of an RST BPDU.
+func (b *BpduPacket) Role() uint8 {
+	return (b.Flags >> bpduFlagRoleShift) & 0x03
+}
+
+func (b *BpduPacket) length() int {
+	switch b.Type {
+	case BpduTypeTCN:
+		return 4
+	case BpduTypeRST:
+		return 36
+	}
+	return 35
+}
+
+// EtherType returns the 802.3 length field of the frame, BPDUs have no EtherType.
+func (b *BpduPacket) EtherType() EtherType {
+	length := len(bpduLlcHeader) + b.length()
+	return EtherType{byte(length >> 8), byte(length)}
+}
+
+func (b *BpduPacket) MarshalBinary() ([]byte, error) {
+	data := make([]byte, len(bpduLlcHeader)+b.length())
+	copy(data, bpduLlcHeader)
+
+	bpdu := data[len(bpduLlcHeader):]
+	// protocol identifier is always 0
+	bpdu[2] = byte(b.Version)
+	bpdu[3] = byte(b.Type)
+
+	if b.Type == BpduTypeTCN {
+		return data, nil
+	}
+
+	bpdu[4] = b.Flags
+	b.RootID.marshal(bpdu[5:13])
+	binary.BigEndian.PutUint32(bpdu[13:17], b.RootPathCost)
+	b.BridgeID.marshal(bpdu[17:25])
+	binary.BigEndian.PutUint16(bpdu[25:27], b.PortID)
+	binary.BigEndian.PutUint16(bpdu[27:29], b.MessageAge)
+	binary.BigEndian.PutUint16(bpdu[29:31], b.MaxAge)
+	binary.BigEndian.PutUint16(bpdu[31:33], b.HelloTime)
+	binary.BigEndian.PutUint16(bpdu[33:35], b.ForwardDelay)
+	// version 1 length of an RST BPDU is always 0
+
+	return data, nil
+}
+
+// UnmarshalBinary parses a BPDU including its LLC header.
+func (b *BpduPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < len(bpduLlcHeader)+4 || !bytes.Equal(data[:len(bpduLlcHeader)], bpduLlcHeader) {
+		return errors.New("not a bpdu")
+	}
+
+	bpdu := data[len(bpduLlcHeader):]
+	if bpdu[0] != 0 || bpdu[1] != 0 {
+		return errors.New("invalid bpdu protocol identifier")
+	}
+
+	b.Version = BpduVersion(bpdu[2])
+	b.Type = BpduType(bpdu[3])
+
+	if b.Type == BpduTypeTCN {
+		return nil
+	}
+
+	if len(bpdu) < 35 {
+		return errors.New("bpdu must be at least 35 bytes")
+	}
+
+	b.Flags = bpdu[4]
+	b.RootID = unmarshalBridgeID(bpdu[5:13])
+	b.RootPathCost = binary.BigEndian.Uint32(bpdu[13:17])
+	b.BridgeID = unmarshalBridgeID(bpdu[17:25])
+	b.PortID = binary.BigEndian.Uint16(bpdu[25:27])
+	b.MessageAge = binary.BigEndian.Uint16(bpdu[27:29])
+	b.MaxAge = binary.BigEndian.Uint16(bpdu[29:31])
+	b.HelloTime = binary.BigEndian.Uint16(bpdu[31:33])
+	b.ForwardDelay = binary.BigEndian.Uint16(bpdu[33:35])
+
+	return nil
+}
+
+// isBpdu returns true if the frame is a spanning tree BPDU.
+func isBpdu(data *EthernetFrame) bool {
+	return len(*data) > 16 && bytes.Equal(data.Destination(), BpduMAC) &&
+		bytes.Equal((*data)[14:17], bpduLlcHeader)
+}
@@ -41,20 +41,73 @@ func (p *IPv4Packet) UnmarshalBinary(data []byte) error {
 		return err
 	}
 
-	// Set payload
+	// Set payload, without the padding of short ethernet frames
 	p.Payload = data[20:]
+	if int(p.Header.TotalLength) >= 20 && int(p.Header.TotalLength) <= len(data) {
+		p.Payload = data[20:p.Header.TotalLength]
+	}
 
 	return nil
 }
 
+// Fragment splits the packet into fragments with a total length of at most mtu
+// bytes. Fragments of fragments keep their offset.
+func (p *IPv4Packet) Fragment(mtu int) ([]*IPv4Packet, error) {
+	if p.Header.FlagsFragment&IPv4FlagDontFragment != 0 {
+		return nil, errors.New("packet must not be fragmented")
+	}
+
+	if p.Header.IHL != 5 {
+		return nil, errors.New("fragmenting packets with options is not supported")
+	}
+
+	// all fragments but the last carry a multiple of 8 bytes
+	chunk := (mtu - 20) &^ 7
+	if chunk <= 0 {
+		return nil, errors.New("mtu too small to fragment")
+	}
+
+	offset := int(p.Header.FlagsFragment&IPv4FragmentOffsetMask) * 8
+	moreFragments := p.Header.FlagsFragment & IPv4FlagMoreFragments
+
+	fragments := make([]*IPv4Packet, 0, len(p.Payload)/chunk+1)
+	for start := 0; start < len(p.Payload); start += chunk {
+		end := start + chunk
+		flags := uint16(IPv4FlagMoreFragments)
+		if end >= len(p.Payload) {
+			end = len(p.Payload)
+			flags = moreFragments
+		}
+
+		header := p.Header
+		header.FlagsFragment = flags | uint16((offset+start)/8)
+		header.TotalLength = uint16(20 + end - start)
+		header.HeaderChecksum = header.CalculateChecksum()
+
+		fragments = append(fragments, &IPv4Packet{
+			Header:  header,
+			Payload: p.Payload[start:end],
+		})
+	}
+
+	return fragments, nil
+}
+
 type IPv4Protocol uint8
 
 const (
 	IPv4ProtocolICMP IPv4Protocol = 1
+	IPv4ProtocolIGMP IPv4Protocol = 2
 	IPv4ProtocolTCP  IPv4Protocol = 6
 	IPv4ProtocolUDP  IPv4Protocol = 17
 )
 
+const (
+	IPv4FlagDontFragment   uint16 = 0x4000
+	IPv4FlagMoreFragments  uint16 = 0x2000
+	IPv4FragmentOffsetMask uint16 = 0x1fff
+)
+
 // IPv4Header represents the structure of an IPv4 header
 type IPv4Header struct {
 	Version        uint8        // 4-bit IP version
@@ -1,10 +1,32 @@
 package exu
 
+import "errors"
+
 type ICMPType uint8
 
 const (
-	ICMPTypeEchoReply ICMPType = 0
-	ICMPTypeEcho      ICMPType = 8
+	ICMPTypeEchoReply              ICMPType = 0
+	ICMPTypeDestinationUnreachable ICMPType = 3
+	ICMPTypeSourceQuench           ICMPType = 4
+	ICMPTypeRedirect               ICMPType = 5
+	ICMPTypeEcho                   ICMPType = 8
+	ICMPTypeTimeExceeded           ICMPType = 11
+	ICMPTypeParameterProblem       ICMPType = 12
+)
+
+// ICMP codes of destination unreachable messages
+const (
+	ICMPCodeNetUnreachable      uint8 = 0
+	ICMPCodeHostUnreachable     uint8 = 1
+	ICMPCodeProtocolUnreachable uint8 = 2
+	ICMPCodePortUnreachable     uint8 = 3
+	ICMPCodeFragmentationNeeded uint8 = 4
+)
+
+// ICMP codes of time exceeded messages
+const (
+	ICMPCodeTTLExceeded        uint8 = 0
+	ICMPCodeReassemblyExceeded uint8 = 1
 )
 
 type ICMPPayload struct {
@@ -25,6 +47,10 @@ func (i *ICMPPayload) MarshalBinary() ([]byte, error) {
 }
 
 func (i *ICMPPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("icmp message must be at least 4 bytes")
+	}
+
 	i.Type = ICMPType(data[0])
 	i.Code = data[1]
 	i.Checksum = uint16(data[2])<<8 | uint16(data[3])
@@ -35,10 +61,10 @@ func (i *ICMPPayload) UnmarshalBinary(data []byte) error {
 func (i *ICMPPayload) CalculateChecksum() uint16 {
 	data := i.Data
 	if len(data)%2 != 0 {
-		data = append(data, 0)
+		data = append(data[:len(data):len(data)], 0)
 	}
 
-	var sum uint32
+	sum := uint32(i.Type)<<8 | uint32(i.Code)
 	for i := 0; i < len(data); i += 2 {
 		sum += uint32(data[i])<<8 | uint32(data[i+1])
 	}
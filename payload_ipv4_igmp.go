@@ -0,0 +1,247 @@
+package exu
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+type IGMPType uint8
+
+const (
+	IGMPTypeMembershipQuery    IGMPType = 0x11
+	IGMPTypeV1MembershipReport IGMPType = 0x12
+	IGMPTypeV2MembershipReport IGMPType = 0x16
+	IGMPTypeLeaveGroup         IGMPType = 0x17
+	IGMPTypeV3MembershipReport IGMPType = 0x22
+)
+
+type IGMPRecordType uint8
+
+const (
+	IGMPRecordModeIsInclude   IGMPRecordType = 1
+	IGMPRecordModeIsExclude   IGMPRecordType = 2
+	IGMPRecordChangeToInclude IGMPRecordType = 3
+	IGMPRecordChangeToExclude IGMPRecordType = 4
+	IGMPRecordAllowNewSources IGMPRecordType = 5
+	IGMPRecordBlockOldSources IGMPRecordType = 6
+)
+
+const (
+	igmpV2Length             = 8
+	igmpV3ReportHeaderLength = 8
+	igmpV3RecordHeaderLength = 8
+)
+
+var (
+	// IGMPAllHosts is the group general queries are sent to
+	IGMPAllHosts = net.IPv4(224, 0, 0, 1).To4()
+	// IGMPAllRouters is the group IGMPv2 leaves are sent to
+	IGMPAllRouters = net.IPv4(224, 0, 0, 2).To4()
+	// IGMPv3Routers is the group IGMPv3 reports are sent to
+	IGMPv3Routers = net.IPv4(224, 0, 0, 22).To4()
+)
+
+// IGMPGroupRecord is a group record of an IGMPv3 membership report.
+type IGMPGroupRecord struct {
+	Type    IGMPRecordType
+	Group   net.IP
+	Sources []net.IP
+}
+
+// joins returns true if the record expresses interest in the group.
+func (r IGMPGroupRecord) joins() bool {
+	switch r.Type {
+	case IGMPRecordModeIsExclude, IGMPRecordChangeToExclude:
+		return true
+	case IGMPRecordModeIsInclude, IGMPRecordChangeToInclude, IGMPRecordAllowNewSources:
+		return len(r.Sources) > 0
+	}
+	return false
+}
+
+// leaves returns true if the record gives up all interest in the group.
+func (r IGMPGroupRecord) leaves() bool {
+	return (r.Type == IGMPRecordModeIsInclude || r.Type == IGMPRecordChangeToInclude) && len(r.Sources) == 0
+}
+
+// IGMPPacket represents an IGMPv1, v2 or v3 message. Group is used by queries,
+// v1/v2 reports and leaves, Records by v3 reports.
+type IGMPPacket struct {
+	Type        IGMPType
+	MaxRespTime uint8
+	Checksum    uint16
+	Group       net.IP
+	Records     []IGMPGroupRecord
+}
+
+func (i *IGMPPacket) MarshalBinary() ([]byte, error) {
+	if i.Type != IGMPTypeV3MembershipReport {
+		res := make([]byte, igmpV2Length)
+		res[0] = byte(i.Type)
+		res[1] = i.MaxRespTime
+		binary.BigEndian.PutUint16(res[2:4], i.Checksum)
+		group := i.Group.To4()
+		if group == nil {
+			group = net.IPv4zero.To4()
+		}
+		copy(res[4:8], group)
+		return res, nil
+	}
+
+	res := make([]byte, igmpV3ReportHeaderLength)
+	res[0] = byte(i.Type)
+	binary.BigEndian.PutUint16(res[2:4], i.Checksum)
+	binary.BigEndian.PutUint16(res[6:8], uint16(len(i.Records)))
+
+	for _, record := range i.Records {
+		data := make([]byte, igmpV3RecordHeaderLength+4*len(record.Sources))
+		data[0] = byte(record.Type)
+		binary.BigEndian.PutUint16(data[2:4], uint16(len(record.Sources)))
+		copy(data[4:8], record.Group.To4())
+		for j, source := range record.Sources {
+			copy(data[8+4*j:12+4*j], source.To4())
+		}
+		res = append(res, data...)
+	}
+
+	return res, nil
+}
+
+func (i *IGMPPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < igmpV2Length {
+		return errors.New("igmp message must be at least 8 bytes")
+	}
+
+	i.Type = IGMPType(data[0])
+	i.MaxRespTime = data[1]
+	i.Checksum = binary.BigEndian.Uint16(data[2:4])
+	i.Group = nil
+	i.Records = nil
+
+	if i.Type != IGMPTypeV3MembershipReport {
+		i.Group = net.IP(append([]byte{}, data[4:8]...))
+		return nil
+	}
+
+	i.MaxRespTime = 0
+	numberOfRecords := int(binary.BigEndian.Uint16(data[6:8]))
+	data = data[igmpV3ReportHeaderLength:]
+	for r := 0; r < numberOfRecords; r++ {
+		if len(data) < igmpV3RecordHeaderLength {
+			return errors.New("igmpv3 group record too short")
+		}
+
+		auxLength := int(data[1]) * 4
+		numberOfSources := int(binary.BigEndian.Uint16(data[2:4]))
+		length := igmpV3RecordHeaderLength + 4*numberOfSources + auxLength
+		if len(data) < length {
+			return errors.New("igmpv3 group record too short")
+		}
+
+		record := IGMPGroupRecord{
+			Type:  IGMPRecordType(data[0]),
+			Group: net.IP(append([]byte{}, data[4:8]...)),
+		}
+		for s := 0; s < numberOfSources; s++ {
+			record.Sources = append(record.Sources, net.IP(append([]byte{}, data[8+4*s:12+4*s]...)))
+		}
+
+		i.Records = append(i.Records, record)
+		data = data[length:]
+	}
+
+	return nil
+}
+
+// CalculateChecksum calculates the checksum over the whole IGMP message
+func (i *IGMPPacket) CalculateChecksum() uint16 {
+	oldChecksum := i.Checksum
+	i.Checksum = 0
+	data, _ := i.MarshalBinary()
+	i.Checksum = oldChecksum
+
+	if len(data)%2 != 0 {
+		data = append(data, 0)
+	}
+
+	var sum uint32
+	for j := 0; j < len(data); j += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[j : j+2]))
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return uint16(^sum)
+}
+
+// multicastMAC returns the MAC address an IPv4 multicast group is sent to.
+func multicastMAC(group net.IP) net.HardwareAddr {
+	group = group.To4()
+	return net.HardwareAddr{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+}
+
+// ipv4MulticastGroup returns the destination group of an IPv4 multicast frame and
+// false if the frame is not IPv4 multicast.
+func ipv4MulticastGroup(data *EthernetFrame) (net.IP, bool) {
+	dst := data.Destination()
+	if dst[0] != 0x01 || dst[1] != 0x00 || dst[2] != 0x5e || !data.EtherType().Equal(EtherTypeIPv4) {
+		return nil, false
+	}
+
+	payload := data.Payload()
+	if len(payload) < 20 {
+		return nil, false
+	}
+
+	group := net.IP(payload[16:20])
+	return group, group.IsMulticast()
+}
+
+// igmpChecksumValid returns true if the checksum of the IGMP message in data is correct.
+func igmpChecksumValid(data []byte) bool {
+	var sum uint32
+	for j := 0; j+1 < len(data); j += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[j : j+2]))
+	}
+	if len(data)%2 != 0 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return sum == 0xffff
+}
+
+// igmpMessage returns the IGMP message carried in an IPv4 frame and false if the
+// frame does not carry one. The message is nil if the frame carries a malformed
+// IGMP message or one with a bad checksum.
+func igmpMessage(data *EthernetFrame) (*IGMPPacket, net.IP, bool) {
+	if !data.EtherType().Equal(EtherTypeIPv4) {
+		return nil, nil, false
+	}
+
+	payload := data.Payload()
+	if len(payload) < 20 || IPv4Protocol(payload[9]) != IPv4ProtocolIGMP {
+		return nil, nil, false
+	}
+
+	// IGMP packets usually carry the router alert option
+	headerLength := int(payload[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(payload[2:4]))
+	source := net.IP(payload[12:16])
+	if headerLength < 20 || totalLength < headerLength || len(payload) < totalLength {
+		return nil, source, true
+	}
+
+	message := payload[headerLength:totalLength]
+	igmp := &IGMPPacket{}
+	if err := igmp.UnmarshalBinary(message); err != nil || !igmpChecksumValid(message) {
+		return nil, source, true
+	}
+
+	return igmp, source, true
+}
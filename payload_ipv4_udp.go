@@ -0,0 +1,69 @@
+package exu
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// UDPPacket represents a UDP datagram
+type UDPPacket struct {
+	SourcePort      uint16
+	DestinationPort uint16
+	Length          uint16
+	Checksum        uint16
+	Payload         []byte
+}
+
+func (u *UDPPacket) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 8+len(u.Payload))
+	binary.BigEndian.PutUint16(res[0:2], u.SourcePort)
+	binary.BigEndian.PutUint16(res[2:4], u.DestinationPort)
+	binary.BigEndian.PutUint16(res[4:6], uint16(8+len(u.Payload)))
+	binary.BigEndian.PutUint16(res[6:8], u.Checksum)
+	copy(res[8:], u.Payload)
+	return res, nil
+}
+
+func (u *UDPPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("udp datagram must be at least 8 bytes")
+	}
+
+	u.SourcePort = binary.BigEndian.Uint16(data[0:2])
+	u.DestinationPort = binary.BigEndian.Uint16(data[2:4])
+	u.Length = binary.BigEndian.Uint16(data[4:6])
+	u.Checksum = binary.BigEndian.Uint16(data[6:8])
+
+	if int(u.Length) < 8 || int(u.Length) > len(data) {
+		return errors.New("invalid udp length")
+	}
+	u.Payload = data[8:u.Length]
+
+	return nil
+}
+
+// ipv4Udp returns the IPv4 header and UDP datagram of a frame and false if the
+// frame does not carry UDP over IPv4.
+func ipv4Udp(data *EthernetFrame) (*IPv4Header, *UDPPacket, bool) {
+	if !data.EtherType().Equal(EtherTypeIPv4) {
+		return nil, nil, false
+	}
+
+	payload := data.Payload()
+	header := &IPv4Header{}
+	if err := header.UnmarshalBinary(payload); err != nil || header.Protocol != IPv4ProtocolUDP {
+		return nil, nil, false
+	}
+
+	headerLength := int(header.IHL) * 4
+	if headerLength < 20 || int(header.TotalLength) < headerLength || len(payload) < int(header.TotalLength) {
+		return nil, nil, false
+	}
+
+	udp := &UDPPacket{}
+	if err := udp.UnmarshalBinary(payload[headerLength:header.TotalLength]); err != nil {
+		return nil, nil, false
+	}
+
+	return header, udp, true
+}
@@ -0,0 +1,200 @@
+package exu
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	DHCPServerPort uint16 = 67
+	DHCPClientPort uint16 = 68
+)
+
+type DHCPOpcode uint8
+
+const (
+	DHCPOpcodeRequest DHCPOpcode = 1
+	DHCPOpcodeReply   DHCPOpcode = 2
+)
+
+type DHCPMessageType uint8
+
+const (
+	DHCPDiscover DHCPMessageType = 1
+	DHCPOffer    DHCPMessageType = 2
+	DHCPRequest  DHCPMessageType = 3
+	DHCPDecline  DHCPMessageType = 4
+	DHCPAck      DHCPMessageType = 5
+	DHCPNak      DHCPMessageType = 6
+	DHCPRelease  DHCPMessageType = 7
+	DHCPInform   DHCPMessageType = 8
+)
+
+func (t DHCPMessageType) String() string {
+	switch t {
+	case DHCPDiscover:
+		return "discover"
+	case DHCPOffer:
+		return "offer"
+	case DHCPRequest:
+		return "request"
+	case DHCPDecline:
+		return "decline"
+	case DHCPAck:
+		return "ack"
+	case DHCPNak:
+		return "nak"
+	case DHCPRelease:
+		return "release"
+	case DHCPInform:
+		return "inform"
+	}
+	return "unknown"
+}
+
+const (
+	dhcpOptionPad         = 0
+	dhcpOptionRequestedIP = 50
+	dhcpOptionLeaseTime   = 51
+	dhcpOptionMessageType = 53
+	dhcpOptionServerID    = 54
+	dhcpOptionEnd         = 255
+
+	dhcpHeaderLength = 236
+)
+
+var dhcpMagicCookie = []byte{0x63, 0x82, 0x53, 0x63}
+
+// DHCPPacket represents a DHCP message with the fields and options needed to
+// follow an address assignment.
+type DHCPPacket struct {
+	Opcode      DHCPOpcode
+	Xid         uint32
+	ClientIP    net.IP
+	YourIP      net.IP
+	ServerIP    net.IP
+	GatewayIP   net.IP
+	ClientMac   net.HardwareAddr
+	MessageType DHCPMessageType
+	RequestedIP net.IP
+	ServerID    net.IP
+	LeaseTime   time.Duration
+}
+
+func dhcpIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+func (d *DHCPPacket) MarshalBinary() ([]byte, error) {
+	res := make([]byte, dhcpHeaderLength)
+	res[0] = byte(d.Opcode)
+	res[1] = 1 // ethernet
+	res[2] = 6
+	binary.BigEndian.PutUint32(res[4:8], d.Xid)
+	copy(res[12:16], dhcpIP(d.ClientIP))
+	copy(res[16:20], dhcpIP(d.YourIP))
+	copy(res[20:24], dhcpIP(d.ServerIP))
+	copy(res[24:28], dhcpIP(d.GatewayIP))
+	copy(res[28:34], d.ClientMac)
+
+	res = append(res, dhcpMagicCookie...)
+	res = append(res, dhcpOptionMessageType, 1, byte(d.MessageType))
+	if d.RequestedIP != nil {
+		res = append(res, dhcpOptionRequestedIP, 4)
+		res = append(res, dhcpIP(d.RequestedIP)...)
+	}
+	if d.ServerID != nil {
+		res = append(res, dhcpOptionServerID, 4)
+		res = append(res, dhcpIP(d.ServerID)...)
+	}
+	if d.LeaseTime > 0 {
+		lease := make([]byte, 4)
+		binary.BigEndian.PutUint32(lease, uint32(d.LeaseTime/time.Second))
+		res = append(res, dhcpOptionLeaseTime, 4)
+		res = append(res, lease...)
+	}
+
+	return append(res, dhcpOptionEnd), nil
+}
+
+func (d *DHCPPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < dhcpHeaderLength+len(dhcpMagicCookie) {
+		return errors.New("dhcp message too short")
+	}
+
+	*d = DHCPPacket{
+		Opcode:    DHCPOpcode(data[0]),
+		Xid:       binary.BigEndian.Uint32(data[4:8]),
+		ClientIP:  net.IP(append([]byte{}, data[12:16]...)),
+		YourIP:    net.IP(append([]byte{}, data[16:20]...)),
+		ServerIP:  net.IP(append([]byte{}, data[20:24]...)),
+		GatewayIP: net.IP(append([]byte{}, data[24:28]...)),
+		ClientMac: net.HardwareAddr(append([]byte{}, data[28:34]...)),
+	}
+
+	options := data[dhcpHeaderLength:]
+	if string(options[:4]) != string(dhcpMagicCookie) {
+		return errors.New("invalid dhcp magic cookie")
+	}
+	options = options[4:]
+
+	for len(options) > 0 {
+		code := options[0]
+		if code == dhcpOptionEnd {
+			break
+		}
+		if code == dhcpOptionPad {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return errors.New("dhcp option too short")
+		}
+
+		value := options[2 : 2+int(options[1])]
+		options = options[2+int(options[1]):]
+
+		switch {
+		case code == dhcpOptionMessageType && len(value) == 1:
+			d.MessageType = DHCPMessageType(value[0])
+		case code == dhcpOptionRequestedIP && len(value) == 4:
+			d.RequestedIP = net.IP(append([]byte{}, value...))
+		case code == dhcpOptionServerID && len(value) == 4:
+			d.ServerID = net.IP(append([]byte{}, value...))
+		case code == dhcpOptionLeaseTime && len(value) == 4:
+			d.LeaseTime = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		}
+	}
+
+	if d.MessageType == 0 {
+		return errors.New("dhcp message type missing")
+	}
+
+	return nil
+}
+
+// dhcpMessage returns the DHCP message carried in a frame and false if the frame
+// does not carry one.
+func dhcpMessage(data *EthernetFrame) (*DHCPPacket, bool) {
+	_, udp, ok := ipv4Udp(data)
+	if !ok {
+		return nil, false
+	}
+
+	if !(udp.SourcePort == DHCPClientPort && udp.DestinationPort == DHCPServerPort) &&
+		!(udp.SourcePort == DHCPServerPort && udp.DestinationPort == DHCPClientPort) {
+		return nil, false
+	}
+
+	dhcp := &DHCPPacket{}
+	if err := dhcp.UnmarshalBinary(udp.Payload); err != nil {
+		return nil, false
+	}
+
+	return dhcp, true
+}
@@ -0,0 +1,47 @@
+package exu
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// VxlanPort is the IANA assigned UDP port of VXLAN.
+const VxlanPort uint16 = 4789
+
+// MaxVni is the largest VXLAN network identifier.
+const MaxVni uint32 = 1<<24 - 1
+
+// vxlanFlagVni is set if the VNI field of a VXLAN header is valid
+const vxlanFlagVni = 0x08
+
+// VXLANPacket represents a VXLAN header followed by the encapsulated frame.
+type VXLANPacket struct {
+	Vni   uint32
+	Frame EthernetFrame
+}
+
+func (v *VXLANPacket) MarshalBinary() ([]byte, error) {
+	if v.Vni > MaxVni {
+		return nil, errors.New("vni must fit in 24 bits")
+	}
+
+	res := make([]byte, 8+len(v.Frame))
+	res[0] = vxlanFlagVni
+	binary.BigEndian.PutUint32(res[4:8], v.Vni<<8)
+	copy(res[8:], v.Frame)
+	return res, nil
+}
+
+func (v *VXLANPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < 8+14 {
+		return errors.New("vxlan packet too short")
+	}
+
+	if data[0]&vxlanFlagVni == 0 {
+		return errors.New("vxlan vni flag not set")
+	}
+
+	v.Vni = binary.BigEndian.Uint32(data[4:8]) >> 8
+	v.Frame = append(EthernetFrame{}, data[8:]...)
+	return nil
+}
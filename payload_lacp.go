@@ -0,0 +1,128 @@
+package exu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// SlowProtocolsMAC is the destination address of LACPDUs.
+var SlowProtocolsMAC = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x02}
+
+const (
+	slowProtocolSubtypeLacp = 0x01
+	lacpVersion             = 0x01
+	lacpduLength            = 110
+)
+
+// LACP port state flags
+const (
+	LacpStateActivity        uint8 = 0x01
+	LacpStateTimeout         uint8 = 0x02
+	LacpStateAggregation     uint8 = 0x04
+	LacpStateSynchronization uint8 = 0x08
+	LacpStateCollecting      uint8 = 0x10
+	LacpStateDistributing    uint8 = 0x20
+	LacpStateDefaulted       uint8 = 0x40
+	LacpStateExpired         uint8 = 0x80
+)
+
+// LacpInfo is the actor or partner information carried in an LACPDU.
+type LacpInfo struct {
+	SystemPriority uint16
+	System         net.HardwareAddr
+	Key            uint16
+	PortPriority   uint16
+	Port           uint16
+	State          uint8
+}
+
+// sameLink returns true if both infos describe the same port of the same system.
+func (i LacpInfo) sameLink(other LacpInfo) bool {
+	return i.SystemPriority == other.SystemPriority && bytes.Equal(i.System, other.System) &&
+		i.Key == other.Key && i.Port == other.Port
+}
+
+func (i LacpInfo) marshal(tlvType byte, data []byte) {
+	data[0] = tlvType
+	data[1] = 20
+	binary.BigEndian.PutUint16(data[2:4], i.SystemPriority)
+	copy(data[4:10], i.System)
+	binary.BigEndian.PutUint16(data[10:12], i.Key)
+	binary.BigEndian.PutUint16(data[12:14], i.PortPriority)
+	binary.BigEndian.PutUint16(data[14:16], i.Port)
+	data[16] = i.State
+}
+
+func unmarshalLacpInfo(data []byte) LacpInfo {
+	system := make(net.HardwareAddr, 6)
+	copy(system, data[4:10])
+	return LacpInfo{
+		SystemPriority: binary.BigEndian.Uint16(data[2:4]),
+		System:         system,
+		Key:            binary.BigEndian.Uint16(data[10:12]),
+		PortPriority:   binary.BigEndian.Uint16(data[12:14]),
+		Port:           binary.BigEndian.Uint16(data[14:16]),
+		State:          data[16],
+	}
+}
+
+// LacpPacket represents an 802.3ad LACPDU.
+type LacpPacket struct {
+	Actor             LacpInfo
+	Partner           LacpInfo
+	CollectorMaxDelay uint16
+}
+
+func (l *LacpPacket) EtherType() EtherType {
+	return EtherTypeSlowProtocols
+}
+
+func (l *LacpPacket) MarshalBinary() ([]byte, error) {
+	data := make([]byte, lacpduLength)
+	data[0] = slowProtocolSubtypeLacp
+	data[1] = lacpVersion
+
+	if l.Partner.System == nil {
+		l.Partner.System = make(net.HardwareAddr, 6)
+	}
+
+	l.Actor.marshal(0x01, data[2:22])
+	l.Partner.marshal(0x02, data[22:42])
+
+	// collector information
+	data[42] = 0x03
+	data[43] = 16
+	binary.BigEndian.PutUint16(data[44:46], l.CollectorMaxDelay)
+
+	// the terminator TLV and the reserved bytes are all zero
+
+	return data, nil
+}
+
+func (l *LacpPacket) UnmarshalBinary(data []byte) error {
+	if len(data) < 60 {
+		return errors.New("lacpdu must be at least 60 bytes")
+	}
+
+	if data[0] != slowProtocolSubtypeLacp {
+		return errors.New("not a lacpdu")
+	}
+
+	if data[2] != 0x01 || data[22] != 0x02 {
+		return errors.New("invalid lacpdu tlv")
+	}
+
+	l.Actor = unmarshalLacpInfo(data[2:22])
+	l.Partner = unmarshalLacpInfo(data[22:42])
+	l.CollectorMaxDelay = binary.BigEndian.Uint16(data[44:46])
+
+	return nil
+}
+
+// isLacpdu returns true if the frame is an LACPDU.
+func isLacpdu(data *EthernetFrame) bool {
+	return len(*data) > 14 && data.EtherType().Equal(EtherTypeSlowProtocols) &&
+		data.Payload()[0] == slowProtocolSubtypeLacp
+}
@@ -0,0 +1,150 @@
+package exu
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// LldpMAC is the nearest bridge address LLDPDUs are sent to, bridges never
+// forward frames sent to it.
+var LldpMAC = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+const (
+	lldpTlvEnd               = 0
+	lldpTlvChassisID         = 1
+	lldpTlvPortID            = 2
+	lldpTlvTTL               = 3
+	lldpTlvPortDescription   = 4
+	lldpTlvSystemName        = 5
+	lldpTlvManagementAddress = 8
+
+	lldpChassisIDSubtypeMac   = 4
+	lldpChassisIDSubtypeLocal = 7
+	lldpPortIDSubtypeMac      = 3
+	lldpPortIDSubtypeName     = 5
+	lldpAddressFamilyIPv4     = 1
+	lldpIfNumberingIfIndex    = 2
+)
+
+// LldpPacket represents an LLDPDU with the TLVs we send and understand, all other
+// TLVs are skipped when parsing.
+type LldpPacket struct {
+	// ChassisID is sent as a MAC address if it is one, otherwise as a locally
+	// assigned string
+	ChassisID string
+	// PortID is sent as an interface name
+	PortID string
+	// TTL in seconds, 0 tells the neighbor to remove us
+	TTL               uint16
+	PortDescription   string
+	SystemName        string
+	ManagementAddress net.IP
+}
+
+func (l *LldpPacket) EtherType() EtherType {
+	return EtherTypeLLDP
+}
+
+func lldpTlv(tlvType uint8, value []byte) []byte {
+	header := uint16(tlvType)<<9 | uint16(len(value))&0x1ff
+	return append([]byte{byte(header >> 8), byte(header)}, value...)
+}
+
+func (l *LldpPacket) MarshalBinary() ([]byte, error) {
+	chassisID := append([]byte{lldpChassisIDSubtypeLocal}, l.ChassisID...)
+	if mac, err := net.ParseMAC(l.ChassisID); err == nil {
+		chassisID = append([]byte{lldpChassisIDSubtypeMac}, mac...)
+	}
+
+	ttl := make([]byte, 2)
+	binary.BigEndian.PutUint16(ttl, l.TTL)
+
+	data := lldpTlv(lldpTlvChassisID, chassisID)
+	data = append(data, lldpTlv(lldpTlvPortID, append([]byte{lldpPortIDSubtypeName}, l.PortID...))...)
+	data = append(data, lldpTlv(lldpTlvTTL, ttl)...)
+
+	if l.PortDescription != "" {
+		data = append(data, lldpTlv(lldpTlvPortDescription, []byte(l.PortDescription))...)
+	}
+	if l.SystemName != "" {
+		data = append(data, lldpTlv(lldpTlvSystemName, []byte(l.SystemName))...)
+	}
+	if ip := l.ManagementAddress.To4(); ip != nil {
+		// address string length, family and address, interface numbering and an
+		// empty OID
+		address := []byte{5, lldpAddressFamilyIPv4}
+		address = append(address, ip...)
+		address = append(address, lldpIfNumberingIfIndex, 0, 0, 0, 0, 0)
+		data = append(data, lldpTlv(lldpTlvManagementAddress, address)...)
+	}
+
+	return append(data, lldpTlv(lldpTlvEnd, nil)...), nil
+}
+
+func (l *LldpPacket) UnmarshalBinary(data []byte) error {
+	*l = LldpPacket{}
+	seen := 0
+
+	for len(data) >= 2 {
+		header := binary.BigEndian.Uint16(data[0:2])
+		tlvType := uint8(header >> 9)
+		length := int(header & 0x1ff)
+		if len(data) < 2+length {
+			return errors.New("lldp tlv too short")
+		}
+		value := data[2 : 2+length]
+		data = data[2+length:]
+
+		switch tlvType {
+		case lldpTlvEnd:
+			data = nil
+		case lldpTlvChassisID:
+			if length < 2 {
+				return errors.New("invalid lldp chassis id")
+			}
+			if value[0] == lldpChassisIDSubtypeMac && length == 7 {
+				l.ChassisID = net.HardwareAddr(value[1:]).String()
+			} else {
+				l.ChassisID = string(value[1:])
+			}
+			seen++
+		case lldpTlvPortID:
+			if length < 2 {
+				return errors.New("invalid lldp port id")
+			}
+			if value[0] == lldpPortIDSubtypeMac && length == 7 {
+				l.PortID = net.HardwareAddr(value[1:]).String()
+			} else {
+				l.PortID = string(value[1:])
+			}
+			seen++
+		case lldpTlvTTL:
+			if length < 2 {
+				return errors.New("invalid lldp ttl")
+			}
+			l.TTL = binary.BigEndian.Uint16(value)
+			seen++
+		case lldpTlvPortDescription:
+			l.PortDescription = string(value)
+		case lldpTlvSystemName:
+			l.SystemName = string(value)
+		case lldpTlvManagementAddress:
+			if length >= 7 && value[0] == 5 && value[1] == lldpAddressFamilyIPv4 && l.ManagementAddress == nil {
+				l.ManagementAddress = net.IP(append([]byte{}, value[2:6]...))
+			}
+		}
+	}
+
+	// chassis id, port id and ttl are mandatory
+	if seen < 3 {
+		return errors.New("lldpdu is missing mandatory tlvs")
+	}
+
+	return nil
+}
+
+// isLldpdu returns true if the frame is an LLDPDU.
+func isLldpdu(data *EthernetFrame) bool {
+	return len(*data) > 14 && data.EtherType().Equal(EtherTypeLLDP)
+}
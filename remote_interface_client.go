@@ -76,6 +76,7 @@ func (c *RemoteInterfaceClient) Run() {
 
 	portChan := make(chan uint16)
 	ipChan := make(chan uint32)
+	mtuChan := make(chan int, 1)
 
 	go func() {
 		// run udp server on random port
@@ -88,19 +89,28 @@ func (c *RemoteInterfaceClient) Run() {
 
 		portChan <- uint16(srv.LocalAddr().(*net.UDPAddr).Port)
 
-		// read ip address assigned to us
-		ipBytes := make([]byte, 4)
-		_, err = srv.Read(ipBytes)
+		// read ip address assigned to us, followed by the mtu of the port
+		ipBytes := make([]byte, 6)
+		n, err := srv.Read(ipBytes)
 		if err != nil {
 			panic(err)
 		}
+
+		// servers that do not send an mtu use the default
+		mtu := DefaultMTU
+		if n >= 6 {
+			mtu = int(binary.LittleEndian.Uint16(ipBytes[4:6]))
+		}
+		ipBytes = ipBytes[:4]
+		mtuChan <- mtu
+
 		ip := binary.LittleEndian.Uint32(ipBytes)
 		ipChan <- ip
 
 		log.WithField("ip", net.IP(ipBytes).String()).Info("received initial packet")
 
 		// forward to tap interface
-		buff := make([]byte, 4096)
+		buff := make([]byte, MaxFrameSize)
 		for {
 			n, err := srv.Read(buff)
 			if err != nil {
@@ -176,6 +186,14 @@ func (c *RemoteInterfaceClient) Run() {
 
 	log.WithField("ip", ipStr).Debug("added ip address to tap interface")
 
+	mtu := <-mtuChan
+	err = exec.Command("ip", "link", "set", "dev", c.ifce.Name(), "mtu", strconv.Itoa(mtu)).Run()
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithField("mtu", mtu).Debug("set mtu of tap interface")
+
 	err = exec.Command("ip", "link", "set", "dev", c.ifce.Name(), "up").Run()
 	if err != nil {
 		panic(err)
@@ -187,7 +205,7 @@ func (c *RemoteInterfaceClient) Run() {
 
 	var frame EthernetFrame
 	for {
-		frame.Resize(1500)
+		frame.resize(MaxFrameSize)
 		n, err := c.ifce.Read(frame)
 		if err != nil {
 			log.Fatal(err)
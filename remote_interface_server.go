@@ -10,7 +10,18 @@ import (
 	"time"
 )
 
-func NewRemoteVport(rxPort int, ip net.IP, onConnect, onDisconnect func(port *VPort)) (*VPort, error) {
+// RemoteVportOption configures a remote port before the client is told about it.
+type RemoteVportOption func(port *VPort) error
+
+// WithRemoteMTU sets the MTU of a remote port, the client configures its TAP
+// interface with the same MTU.
+func WithRemoteMTU(mtu int) RemoteVportOption {
+	return func(port *VPort) error {
+		return port.SetMTU(mtu)
+	}
+}
+
+func NewRemoteVport(rxPort int, ip net.IP, onConnect, onDisconnect func(port *VPort), options ...RemoteVportOption) (*VPort, error) {
 	log.WithField("ip", ip.String()).
 		WithField("rxPort", rxPort).
 		Info("creating new remote vport")
@@ -61,9 +72,20 @@ func NewRemoteVport(rxPort int, ip net.IP, onConnect, onDisconnect func(port *VP
 		WithField("port", port).
 		Debug("connected to remote tx port")
 
-	// send ip address to client
-	ipBytes := ip.To4()
-	_, err = tx.Write([]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]})
+	vPort := NewVPort(macBytes, remoteAddr.String())
+	for _, option := range options {
+		if err = option(vPort); err != nil {
+			break
+		}
+	}
+
+	// send ip address and mtu to client
+	if err == nil {
+		ipBytes := ip.To4()
+		mtuBytes := make([]byte, 2)
+		binary.LittleEndian.PutUint16(mtuBytes, uint16(vPort.MTU()))
+		_, err = tx.Write([]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3], mtuBytes[0], mtuBytes[1]})
+	}
 	if err != nil {
 		log.WithField("error", err).
 			WithField("remote_addr", remoteAddr.String()).
@@ -89,7 +111,6 @@ func NewRemoteVport(rxPort int, ip net.IP, onConnect, onDisconnect func(port *VP
 		WithField("ip", ip).
 		Debug("sent ip address to client")
 
-	vPort := NewVPort(macBytes, remoteAddr.String())
 	done := make(chan bool)
 
 	go func(ip net.IP, rx, tx *net.UDPConn, mac net.HardwareAddr, vPort *VPort, errChan chan error) {
@@ -130,7 +151,7 @@ func NewRemoteVport(rxPort int, ip net.IP, onConnect, onDisconnect func(port *VP
 		done <- true
 
 		for {
-			if vPort.connectedTo == nil {
+			if vPort.peer() == nil {
 				onConnect(vPort)
 				continue
 			}
@@ -146,7 +167,7 @@ func NewRemoteVport(rxPort int, ip net.IP, onConnect, onDisconnect func(port *VP
 				break
 			}
 
-			buff := make([]byte, 4096)
+			buff := make([]byte, MaxFrameSize)
 
 			_ = rx.SetReadDeadline(time.Now().Add(1 * time.Second))
 			n, _, err := rx.ReadFromUDP(buff)
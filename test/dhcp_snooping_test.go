@@ -0,0 +1,182 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func dhcpFrame(t *testing.T, src *capturePort, dhcp *exu.DHCPPacket) *exu.EthernetFrame {
+	data, err := dhcp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp := &exu.UDPPacket{
+		SourcePort:      exu.DHCPClientPort,
+		DestinationPort: exu.DHCPServerPort,
+		Payload:         data,
+	}
+	srcIP := net.IPv4zero
+	if dhcp.Opcode == exu.DHCPOpcodeReply {
+		udp.SourcePort, udp.DestinationPort = exu.DHCPServerPort, exu.DHCPClientPort
+		srcIP = dhcp.ServerID
+	}
+
+	data, err = udp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipv4Frame(t, src, srcIP, net.IPv4bcast, exu.IPv4ProtocolUDP, data)
+}
+
+func arpFrame(t *testing.T, src *capturePort, senderMac net.HardwareAddr, senderIP, targetIP net.IP) *exu.EthernetFrame {
+	arp := exu.NewArpPayload(exu.ArpHardwareTypeEthernet, exu.ArpProtocolTypeIPv4, exu.ArpOpcodeRequest,
+		senderMac, senderIP, make(net.HardwareAddr, 6), targetIP)
+	frame, err := exu.NewEthernetFrame(exu.BroadcastMAC, src.Mac(), exu.WithTagging(exu.TaggingUntagged), arp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestDhcpPacketMarshal(t *testing.T) {
+	packet := &exu.DHCPPacket{
+		Opcode:      exu.DHCPOpcodeReply,
+		Xid:         0x12345678,
+		YourIP:      net.ParseIP("10.0.0.10").To4(),
+		ClientMac:   mustParseMAC("42:69:00:00:00:01"),
+		MessageType: exu.DHCPAck,
+		ServerID:    net.ParseIP("10.0.0.1").To4(),
+		LeaseTime:   time.Hour,
+	}
+
+	data, err := packet.MarshalBinary()
+	assert.NoError(t, err)
+
+	res := &exu.DHCPPacket{}
+	assert.NoError(t, res.UnmarshalBinary(data))
+	assert.Equal(t, packet.Xid, res.Xid)
+	assert.Equal(t, packet.YourIP, res.YourIP)
+	assert.Equal(t, packet.ClientMac, res.ClientMac)
+	assert.Equal(t, packet.MessageType, res.MessageType)
+	assert.Equal(t, packet.ServerID, res.ServerID)
+	assert.Equal(t, packet.LeaseTime, res.LeaseTime)
+	assert.Nil(t, res.RequestedIP)
+
+	assert.Error(t, res.UnmarshalBinary(data[:100]))
+}
+
+func TestDhcpSnooping(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 4)
+	sw1.EnableDhcpSnooping(exu.DhcpSnoopingConfig{VerifyMac: true})
+
+	client := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "client")
+	server := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "server")
+	rogue := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "rogue")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "other")
+	swClient := connectCapturePort(t, sw1.EthernetDevice, client)
+	swServer := connectCapturePort(t, sw1.EthernetDevice, server)
+	connectCapturePort(t, sw1.EthernetDevice, rogue)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+	sw1.SetDhcpSnoopingTrusted(swServer, true)
+
+	send := func(from *capturePort, dhcp *exu.DHCPPacket) {
+		_ = from.Write(dhcpFrame(t, from, dhcp))
+		exu.AllSettled()
+	}
+	reply := func(from *capturePort, messageType exu.DHCPMessageType, ip string) *exu.DHCPPacket {
+		return &exu.DHCPPacket{
+			Opcode:      exu.DHCPOpcodeReply,
+			Xid:         1,
+			YourIP:      net.ParseIP(ip).To4(),
+			ClientMac:   client.Mac(),
+			MessageType: messageType,
+			ServerID:    net.ParseIP("10.0.0.1").To4(),
+			LeaseTime:   time.Hour,
+		}
+	}
+
+	send(client, &exu.DHCPPacket{Opcode: exu.DHCPOpcodeRequest, Xid: 1, ClientMac: client.Mac(), MessageType: exu.DHCPDiscover})
+	assert.Len(t, server.received(), 1)
+
+	// offers of a rogue server never reach the client, the real server's do
+	send(rogue, reply(rogue, exu.DHCPOffer, "10.0.0.66"))
+	assert.Empty(t, client.received())
+	send(server, reply(server, exu.DHCPOffer, "10.0.0.10"))
+	assert.Len(t, client.received(), 1)
+
+	// a client message claiming to be another client is dropped
+	send(other, &exu.DHCPPacket{Opcode: exu.DHCPOpcodeRequest, Xid: 2, ClientMac: client.Mac(), MessageType: exu.DHCPRelease})
+	assert.Len(t, server.received(), 1)
+
+	send(client, &exu.DHCPPacket{Opcode: exu.DHCPOpcodeRequest, Xid: 1, ClientMac: client.Mac(), MessageType: exu.DHCPRequest,
+		RequestedIP: net.ParseIP("10.0.0.10")})
+	send(rogue, reply(rogue, exu.DHCPAck, "10.0.0.66"))
+	send(server, reply(server, exu.DHCPAck, "10.0.0.10"))
+
+	bindings := sw1.DhcpSnoopingBindings()
+	if assert.Len(t, bindings, 1) {
+		assert.Equal(t, client.Mac(), bindings[0].Mac)
+		assert.Equal(t, net.ParseIP("10.0.0.10").To4(), bindings[0].IP)
+		assert.Equal(t, exu.DefaultVlan, bindings[0].Vlan)
+		assert.Equal(t, swClient, bindings[0].Port)
+		assert.InDelta(t, time.Hour, bindings[0].ExpiresIn, float64(time.Second))
+		assert.False(t, bindings[0].Static)
+	}
+	assert.Equal(t, exu.DhcpSnoopingStatistics{Forwarded: 2, Dropped: 3}, sw1.DhcpSnoopingStatistics())
+
+	// releasing the address removes the binding
+	send(client, &exu.DHCPPacket{Opcode: exu.DHCPOpcodeRequest, Xid: 3, ClientIP: net.ParseIP("10.0.0.10"),
+		ClientMac: client.Mac(), MessageType: exu.DHCPRelease})
+	assert.Empty(t, sw1.DhcpSnoopingBindings())
+}
+
+func TestArpInspection(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw1.EnableArpInspection(exu.DefaultVlan)
+
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "host")
+	attacker := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "attacker")
+	router := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "router")
+	swHost := connectCapturePort(t, sw1.EthernetDevice, host)
+	connectCapturePort(t, sw1.EthernetDevice, attacker)
+	swRouter := connectCapturePort(t, sw1.EthernetDevice, router)
+	sw1.SetArpInspectionTrusted(swRouter, true)
+
+	hostIP := net.ParseIP("10.0.0.10")
+	routerIP := net.ParseIP("10.0.0.1")
+	assert.NoError(t, sw1.AddDhcpSnoopingBinding(exu.DefaultVlan, host.Mac(), hostIP, swHost))
+	assert.Error(t, sw1.AddDhcpSnoopingBinding(exu.DefaultVlan, exu.BroadcastMAC, hostIP, swHost))
+
+	send := func(from *capturePort, frame *exu.EthernetFrame) {
+		_ = from.Write(frame)
+		exu.AllSettled()
+	}
+
+	// the bound host and the trusted router pass
+	send(host, arpFrame(t, host, host.Mac(), hostIP, routerIP))
+	send(router, arpFrame(t, router, router.Mac(), routerIP, hostIP))
+	assert.Len(t, attacker.received(), 2)
+
+	// the attacker claiming the router's or the host's address is dropped, so is a
+	// sender MAC that does not match the frame
+	send(attacker, arpFrame(t, attacker, attacker.Mac(), routerIP, hostIP))
+	send(attacker, arpFrame(t, attacker, attacker.Mac(), hostIP, routerIP))
+	send(attacker, arpFrame(t, attacker, host.Mac(), hostIP, routerIP))
+	assert.Len(t, router.received(), 1)
+	assert.Len(t, host.received(), 1)
+
+	// probes without a sender address are allowed
+	send(attacker, arpFrame(t, attacker, attacker.Mac(), net.IPv4zero, routerIP))
+	assert.Len(t, router.received(), 2)
+
+	assert.Equal(t, exu.ArpInspectionStatistics{Forwarded: 2, Dropped: 3}, sw1.ArpInspectionStatistics())
+
+	// without inspection, the spoofed packet gets through
+	sw1.DisableArpInspection()
+	send(attacker, arpFrame(t, attacker, attacker.Mac(), routerIP, hostIP))
+	assert.Len(t, host.received(), 3)
+}
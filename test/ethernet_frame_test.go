@@ -38,3 +38,96 @@ func TestArpRequest(t *testing.T) {
 	assert.NoError(t, err)
 	fmt.Printf("%s", hex.Dump(*frame))
 }
+
+func TestVlanTagPushPop(t *testing.T) {
+	frame := exu.EthernetFrame{
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x02,
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x01,
+		0x08, 0x00,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+
+	_, err := frame.PopTag()
+	assert.ErrorIs(t, err, exu.FrameNotTaggedError)
+
+	assert.NoError(t, frame.PushTag(exu.VlanTag{PCP: 5, DEI: true, VID: 100}))
+	assert.Equal(t, exu.TaggingTagged, frame.Tagging())
+	assert.Equal(t, uint16(100), frame.VlanID())
+	assert.Equal(t, uint8(5), frame.PCP())
+	assert.True(t, frame.DEI())
+	assert.Equal(t, exu.EtherTypeIPv4, frame.EtherType())
+	assert.Equal(t, []byte("Hello"), frame.Payload())
+
+	assert.NoError(t, frame.PushTag(exu.VlanTag{VID: 200}))
+	assert.Equal(t, exu.TaggingDoubleTagged, frame.Tagging())
+	assert.Equal(t, uint16(200), frame.VlanID())
+	assert.Equal(t, uint16(100), frame.InnerVlanID())
+	assert.Equal(t, exu.EtherTypeIPv4, frame.EtherType())
+	assert.ErrorIs(t, frame.PushTag(exu.VlanTag{VID: 300}), exu.FrameTagLimitError)
+
+	assert.NoError(t, frame.SetVlan(201))
+	assert.Equal(t, uint16(201), frame.VlanID())
+
+	tag, err := frame.PopTag()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(201), tag.VID)
+	assert.Equal(t, exu.TaggingTagged, frame.Tagging())
+	assert.Equal(t, uint16(100), frame.VlanID())
+
+	_, err = frame.PopTag()
+	assert.NoError(t, err)
+	assert.Equal(t, exu.TaggingUntagged, frame.Tagging())
+	assert.Len(t, frame, 19)
+	assert.Equal(t, []byte("Hello"), frame.Payload())
+}
+
+func TestServiceTagPushPop(t *testing.T) {
+	frame := exu.EthernetFrame{
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x02,
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x01,
+		0x08, 0x00,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+
+	// a service tag on an untagged frame is a single tag
+	assert.NoError(t, frame.PushServiceTag(exu.VlanTag{VID: 100}))
+	assert.Equal(t, exu.TaggingTagged, frame.Tagging())
+	assert.Equal(t, []byte{0x88, 0xa8}, frame.Tags()[:2])
+	assert.Equal(t, uint16(100), frame.VlanID())
+	assert.Equal(t, exu.EtherTypeIPv4, frame.EtherType())
+	assert.ErrorIs(t, frame.PushTag(exu.VlanTag{VID: 200}), exu.FrameTagLimitError)
+
+	_, err := frame.PopTag()
+	assert.NoError(t, err)
+	assert.Equal(t, exu.TaggingUntagged, frame.Tagging())
+
+	// and goes on top of a customer tag
+	assert.NoError(t, frame.PushTag(exu.VlanTag{VID: 10}))
+	assert.NoError(t, frame.PushServiceTag(exu.VlanTag{VID: 100}))
+	assert.Equal(t, exu.TaggingDoubleTagged, frame.Tagging())
+	assert.Equal(t, uint16(100), frame.VlanID())
+	assert.Equal(t, uint16(10), frame.InnerVlanID())
+	assert.Equal(t, []byte("Hello"), frame.Payload())
+}
+
+func TestNewEthernetFrameDoubleTagged(t *testing.T) {
+	frame, err := exu.NewEthernetFrame(
+		exu.BroadcastMAC,
+		mustParseMAC("42:69:00:00:00:02"),
+		exu.WithTagging(exu.TaggingDoubleTagged, 10, 20),
+		exu.NewArpPayload(
+			exu.ArpHardwareTypeEthernet,
+			exu.ArpProtocolTypeIPv4,
+			exu.ArpOpcodeRequest,
+			mustParseMAC("42:69:00:00:00:02"),
+			net.IPv4(10, 0, 0, 2),
+			exu.ArpMacBroadcast,
+			net.IPv4(10, 0, 0, 1),
+		),
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(10), frame.VlanID())
+	assert.Equal(t, uint16(20), frame.InnerVlanID())
+	assert.Equal(t, exu.EtherTypeARP, frame.EtherType())
+}
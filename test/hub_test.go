@@ -0,0 +1,72 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHubRepeatsFrames(t *testing.T) {
+	hub := exu.NewVHub("hub1", 4)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "b")
+	sniffer := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "sniffer")
+	for _, p := range []*capturePort{a, b, sniffer} {
+		connectCapturePort(t, hub.EthernetDevice, p)
+	}
+
+	// unicast between a and b is seen by every other port, every time
+	for i := 0; i < 3; i++ {
+		_ = a.Write(helloFrame(b.Mac(), a.Mac()))
+		exu.AllSettled()
+		_ = b.Write(helloFrame(a.Mac(), b.Mac()))
+		exu.AllSettled()
+	}
+
+	assert.Len(t, a.received(), 3)
+	assert.Len(t, b.received(), 3)
+	assert.Len(t, sniffer.received(), 6)
+	assert.Empty(t, hub.MacAddressTable())
+
+	// frames are repeated unchanged
+	assert.Equal(t, *helloFrame(b.Mac(), a.Mac()), sniffer.received()[0])
+	assert.Equal(t, exu.HubStatistics{Frames: 6}, hub.Statistics())
+}
+
+func TestHubHalfDuplexCollisions(t *testing.T) {
+	hub := exu.NewVHub("hub1", 3)
+	hub.EnableHalfDuplex(exu.HalfDuplexConfig{
+		LinkSpeed: 1_000_000,
+		SlotTime:  20 * time.Millisecond,
+	})
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "b")
+	sniffer := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "sniffer")
+	for _, p := range []*capturePort{a, b, sniffer} {
+		connectCapturePort(t, hub.EthernetDevice, p)
+	}
+
+	// both stations send at the same time, the frames collide and are sent again
+	// after backing off
+	_ = a.Write(helloFrame(b.Mac(), a.Mac()))
+	_ = b.Write(helloFrame(a.Mac(), b.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, a.received(), 1)
+	assert.Len(t, b.received(), 1)
+	assert.Len(t, sniffer.received(), 2)
+
+	stats := hub.Statistics()
+	assert.Equal(t, uint64(2), stats.Frames)
+	assert.GreaterOrEqual(t, stats.Collisions, uint64(2))
+	assert.Zero(t, stats.Dropped)
+
+	// a frame sent after the medium is idle again does not collide
+	_ = a.Write(helloFrame(b.Mac(), a.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, stats.Collisions, hub.Statistics().Collisions)
+	assert.Len(t, sniffer.received(), 3)
+}
@@ -0,0 +1,289 @@
+package test
+
+import (
+	"bytes"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func ipv4Frame(t *testing.T, src *capturePort, srcIP, dstIP net.IP, protocol exu.IPv4Protocol, payload []byte) *exu.EthernetFrame {
+	dst := exu.BroadcastMAC
+	if dstIP.IsMulticast() {
+		group := dstIP.To4()
+		dst = net.HardwareAddr{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+	}
+
+	packet := &exu.IPv4Packet{
+		Header: exu.IPv4Header{
+			Version:       4,
+			IHL:           5,
+			TotalLength:   uint16(20 + len(payload)),
+			TTL:           1,
+			Protocol:      protocol,
+			SourceIP:      srcIP,
+			DestinationIP: dstIP,
+		},
+		Payload: payload,
+	}
+	packet.Header.HeaderChecksum = packet.Header.CalculateChecksum()
+
+	frame, err := exu.NewEthernetFrame(dst, src.Mac(), exu.WithTagging(exu.TaggingUntagged), packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func igmpFrame(t *testing.T, src *capturePort, srcIP, dstIP net.IP, igmp *exu.IGMPPacket) *exu.EthernetFrame {
+	igmp.Checksum = igmp.CalculateChecksum()
+	data, err := igmp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipv4Frame(t, src, srcIP, dstIP, exu.IPv4ProtocolIGMP, data)
+}
+
+func countMulticast(frames []exu.EthernetFrame, group net.IP) int {
+	count := 0
+	for _, frame := range frames {
+		payload := frame.Payload()
+		if frame.EtherType().Equal(exu.EtherTypeIPv4) && len(payload) >= 20 &&
+			exu.IPv4Protocol(payload[9]) == exu.IPv4ProtocolUDP && bytes.Equal(payload[16:20], group.To4()) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestIgmpSnoopingConstrainsMulticast(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 5)
+	sw1.EnableIgmpSnooping(exu.IgmpSnoopingConfig{})
+	defer sw1.DisableIgmpSnooping()
+
+	group := net.ParseIP("239.1.1.1")
+	sender := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "sender")
+	member1 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "member1")
+	member2 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "member2")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "other")
+	router := newCapturePort(mustParseMAC("42:69:00:00:00:05"), "router")
+	connectCapturePort(t, sw1.EthernetDevice, sender)
+	swMember1 := connectCapturePort(t, sw1.EthernetDevice, member1)
+	swMember2 := connectCapturePort(t, sw1.EthernetDevice, member2)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+	swRouter := connectCapturePort(t, sw1.EthernetDevice, router)
+
+	send := func(frame *exu.EthernetFrame, from *capturePort) {
+		_ = from.Write(frame)
+		exu.AllSettled()
+	}
+	stream := func() {
+		send(ipv4Frame(t, sender, net.ParseIP("10.0.0.1"), group, exu.IPv4ProtocolUDP, []byte{1, 2, 3, 4}), sender)
+	}
+
+	// the router port is learned from the query, which is flooded
+	send(igmpFrame(t, router, net.ParseIP("10.0.0.254"), exu.IGMPAllHosts, &exu.IGMPPacket{
+		Type:        exu.IGMPTypeMembershipQuery,
+		MaxRespTime: 100,
+	}), router)
+	assert.Equal(t, []*exu.VPort{swRouter}, sw1.IgmpRouterPorts(exu.DefaultVlan))
+	assert.Len(t, other.received(), 1)
+
+	// an IGMPv2 and an IGMPv3 report join the group, both only go to the router
+	send(igmpFrame(t, member1, net.ParseIP("10.0.0.2"), group, &exu.IGMPPacket{
+		Type:  exu.IGMPTypeV2MembershipReport,
+		Group: group,
+	}), member1)
+	send(igmpFrame(t, member2, net.ParseIP("10.0.0.3"), exu.IGMPv3Routers, &exu.IGMPPacket{
+		Type: exu.IGMPTypeV3MembershipReport,
+		Records: []exu.IGMPGroupRecord{
+			{Type: exu.IGMPRecordChangeToExclude, Group: group},
+		},
+	}), member2)
+	assert.Len(t, other.received(), 1)
+	assert.Len(t, router.received(), 2)
+
+	groups := sw1.IgmpGroups()
+	assert.Len(t, groups, 1)
+	assert.Equal(t, exu.DefaultVlan, groups[0].Vlan)
+	assert.True(t, group.Equal(groups[0].Group))
+	assert.ElementsMatch(t, []*exu.VPort{swMember1, swMember2}, groups[0].Ports)
+
+	stream()
+	assert.Equal(t, 1, countMulticast(member1.received(), group))
+	assert.Equal(t, 1, countMulticast(member2.received(), group))
+	assert.Equal(t, 1, countMulticast(router.received(), group))
+	assert.Equal(t, 0, countMulticast(other.received(), group))
+
+	// unregistered groups only go to the router
+	unregistered := net.ParseIP("239.2.2.2")
+	send(ipv4Frame(t, sender, net.ParseIP("10.0.0.1"), unregistered, exu.IPv4ProtocolUDP, []byte{1}), sender)
+	assert.Equal(t, 1, countMulticast(router.received(), unregistered))
+	assert.Equal(t, 0, countMulticast(member1.received(), unregistered))
+	assert.Equal(t, 0, countMulticast(other.received(), unregistered))
+}
+
+func TestIgmpSnoopingLeave(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw1.EnableIgmpSnooping(exu.IgmpSnoopingConfig{
+		FastLeave: true,
+	})
+	defer sw1.DisableIgmpSnooping()
+
+	group := net.ParseIP("239.1.1.1")
+	sender := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "sender")
+	member1 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "member1")
+	member2 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "member2")
+	connectCapturePort(t, sw1.EthernetDevice, sender)
+	connectCapturePort(t, sw1.EthernetDevice, member1)
+	swMember2 := connectCapturePort(t, sw1.EthernetDevice, member2)
+
+	for _, member := range []*capturePort{member1, member2} {
+		_ = member.Write(igmpFrame(t, member, net.ParseIP("10.0.0.2"), group, &exu.IGMPPacket{
+			Type:  exu.IGMPTypeV2MembershipReport,
+			Group: group,
+		}))
+		exu.AllSettled()
+	}
+
+	_ = member1.Write(igmpFrame(t, member1, net.ParseIP("10.0.0.2"), exu.IGMPAllRouters, &exu.IGMPPacket{
+		Type:  exu.IGMPTypeLeaveGroup,
+		Group: group,
+	}))
+	exu.AllSettled()
+
+	groups := sw1.IgmpGroups(exu.DefaultVlan)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, []*exu.VPort{swMember2}, groups[0].Ports)
+
+	_ = sender.Write(ipv4Frame(t, sender, net.ParseIP("10.0.0.1"), group, exu.IPv4ProtocolUDP, []byte{1}))
+	exu.AllSettled()
+	assert.Equal(t, 0, countMulticast(member1.received(), group))
+	assert.Equal(t, 1, countMulticast(member2.received(), group))
+}
+
+func TestIgmpQuerier(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "host")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "other")
+	connectCapturePort(t, sw1.EthernetDevice, host)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+
+	sw1.EnableIgmpSnooping(exu.IgmpSnoopingConfig{
+		QueryInterval:         50 * time.Millisecond,
+		QueryResponseInterval: 20 * time.Millisecond,
+		QuerierVlans:          []uint16{exu.DefaultVlan},
+		QuerierAddress:        net.ParseIP("10.0.0.254"),
+	})
+	defer sw1.DisableIgmpSnooping()
+
+	group := net.ParseIP("239.1.1.1")
+	_ = host.Write(igmpFrame(t, host, net.ParseIP("10.0.0.1"), group, &exu.IGMPPacket{
+		Type:  exu.IGMPTypeV2MembershipReport,
+		Group: group,
+	}))
+	exu.AllSettled()
+	assert.Len(t, sw1.IgmpGroups(), 1)
+
+	time.Sleep(200 * time.Millisecond)
+	exu.AllSettled()
+
+	// the switch queried the hosts in the meantime
+	queries := 0
+	for _, frame := range other.received() {
+		if bytes.Equal(frame.Destination(), mustParseMAC("01:00:5e:00:00:01")) {
+			queries++
+		}
+	}
+	assert.GreaterOrEqual(t, queries, 2)
+
+	// the host did not answer the queries, so its membership expired
+	assert.Empty(t, sw1.IgmpGroups())
+}
+
+func TestIgmpV3ReportRoundTrip(t *testing.T) {
+	report := &exu.IGMPPacket{
+		Type: exu.IGMPTypeV3MembershipReport,
+		Records: []exu.IGMPGroupRecord{
+			{Type: exu.IGMPRecordChangeToExclude, Group: net.ParseIP("239.1.1.1").To4()},
+			{Type: exu.IGMPRecordAllowNewSources, Group: net.ParseIP("232.1.1.1").To4(), Sources: []net.IP{net.ParseIP("10.0.0.1").To4()}},
+		},
+	}
+	report.Checksum = report.CalculateChecksum()
+
+	data, err := report.MarshalBinary()
+	assert.NoError(t, err)
+
+	parsed := &exu.IGMPPacket{}
+	assert.NoError(t, parsed.UnmarshalBinary(data))
+	assert.Equal(t, report, parsed)
+	assert.Equal(t, parsed.Checksum, parsed.CalculateChecksum())
+}
+
+func TestIgmpQuerierNeedsAddress(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	router := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "router")
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "host")
+	connectCapturePort(t, sw1.EthernetDevice, router)
+	connectCapturePort(t, sw1.EthernetDevice, host)
+
+	sw1.EnableIgmpSnooping(exu.IgmpSnoopingConfig{
+		QueryInterval:         20 * time.Millisecond,
+		QueryResponseInterval: 10 * time.Millisecond,
+		QuerierVlans:          []uint16{exu.DefaultVlan},
+	})
+	defer sw1.DisableIgmpSnooping()
+
+	// the query of the router is passed on, the switch has no address to query from
+	_ = router.Write(igmpFrame(t, router, net.ParseIP("10.0.0.1"), net.ParseIP("224.0.0.1"), &exu.IGMPPacket{
+		Type:        exu.IGMPTypeMembershipQuery,
+		MaxRespTime: 100,
+	}))
+	exu.AllSettled()
+	assert.Len(t, sw1.IgmpRouterPorts(exu.DefaultVlan), 1)
+
+	time.Sleep(100 * time.Millisecond)
+	exu.AllSettled()
+
+	queries := 0
+	for _, frame := range host.received() {
+		if bytes.Equal(frame.Destination(), mustParseMAC("01:00:5e:00:00:01")) {
+			queries++
+		}
+	}
+	assert.Equal(t, 1, queries)
+}
+
+func TestIgmpBadChecksum(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "host")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "other")
+	connectCapturePort(t, sw1.EthernetDevice, host)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+
+	sw1.EnableIgmpSnooping(exu.IgmpSnoopingConfig{})
+	defer sw1.DisableIgmpSnooping()
+
+	group := net.ParseIP("239.1.1.1")
+	report := &exu.IGMPPacket{
+		Type:  exu.IGMPTypeV2MembershipReport,
+		Group: group,
+	}
+	data, err := report.MarshalBinary()
+	assert.NoError(t, err)
+
+	// reports with a bad checksum are dropped instead of joining the group
+	_ = host.Write(ipv4Frame(t, host, net.ParseIP("10.0.0.1"), group, exu.IPv4ProtocolIGMP, data))
+	exu.AllSettled()
+	assert.Empty(t, sw1.IgmpGroups())
+	assert.Empty(t, other.received())
+
+	_ = host.Write(igmpFrame(t, host, net.ParseIP("10.0.0.1"), group, report))
+	exu.AllSettled()
+	assert.Len(t, sw1.IgmpGroups(), 1)
+}
@@ -0,0 +1,250 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func icmpEchoFrame(t *testing.T, src *capturePort, dst net.HardwareAddr, srcIP, dstIP net.IP) *exu.EthernetFrame {
+	icmp := &exu.ICMPPayload{Type: exu.ICMPTypeEcho, Data: []byte{0x00, 0x01, 0x00, 0x01}}
+	icmp.Checksum = icmp.CalculateChecksum()
+	data, _ := icmp.MarshalBinary()
+
+	packet := &exu.IPv4Packet{
+		Header: exu.IPv4Header{
+			Version:       4,
+			IHL:           5,
+			TotalLength:   uint16(20 + len(data)),
+			TTL:           64,
+			Protocol:      exu.IPv4ProtocolICMP,
+			SourceIP:      srcIP,
+			DestinationIP: dstIP,
+		},
+		Payload: data,
+	}
+	packet.Header.HeaderChecksum = packet.Header.CalculateChecksum()
+
+	frame, err := exu.NewEthernetFrame(dst, src.Mac(), exu.WithTagging(exu.TaggingUntagged), packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// lastIPv4 returns the last IPv4 packet received by c.
+func lastIPv4(t *testing.T, c *capturePort) (exu.EthernetFrame, *exu.IPv4Packet) {
+	frames := c.received()
+	for i := len(frames) - 1; i >= 0; i-- {
+		if frames[i].EtherType().Equal(exu.EtherTypeIPv4) {
+			packet := &exu.IPv4Packet{}
+			assert.NoError(t, packet.UnmarshalBinary(frames[i].Payload()))
+			return frames[i], packet
+		}
+	}
+	t.Fatal("no ipv4 packet received")
+	return nil, nil
+}
+
+func TestL3SwitchRoutesBetweenVlans(t *testing.T) {
+	sw1 := exu.NewVL3Switch("sw1", 4)
+	sw1.SetArpTimeout(200 * time.Millisecond)
+
+	h10 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h10")
+	h10b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h10b")
+	h20 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "h20")
+	swH10 := connectCapturePort(t, sw1.EthernetDevice, h10)
+	swH10b := connectCapturePort(t, sw1.EthernetDevice, h10b)
+	swH20 := connectCapturePort(t, sw1.EthernetDevice, h20)
+	sw1.SetPortMode(swH10, exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(swH10b, exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(swH20, exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+
+	assert.NoError(t, sw1.SetSviIPNet(10, net.IPNet{IP: net.ParseIP("10.0.10.1"), Mask: net.CIDRMask(24, 32)}))
+	assert.NoError(t, sw1.SetSviIPNet(20, net.IPNet{IP: net.ParseIP("10.0.20.1"), Mask: net.CIDRMask(24, 32)}))
+	svis := sw1.Svis()
+	assert.Len(t, svis, 2)
+	sviMac := svis[0].Mac
+
+	h10IP := net.ParseIP("10.0.10.2")
+	h20IP := net.ParseIP("10.0.20.2")
+
+	send := func(from *capturePort, frame *exu.EthernetFrame) {
+		_ = from.Write(frame)
+		exu.AllSettled()
+	}
+
+	// the hosts resolve their gateway, the request is switched within the VLAN too
+	send(h10, arpFrame(t, h10, h10.Mac(), h10IP, net.ParseIP("10.0.10.1")))
+	send(h20, arpFrame(t, h20, h20.Mac(), h20IP, net.ParseIP("10.0.20.1")))
+	assert.Len(t, h10b.received(), 1)
+	if assert.Len(t, h10.received(), 1) {
+		reply := &exu.ArpPacket{}
+		assert.NoError(t, reply.FromBytes(h10.received()[0].Payload()))
+		assert.Equal(t, exu.ArpOpcodeReply, reply.Opcode)
+		assert.Equal(t, sviMac, reply.SenderMac)
+	}
+
+	// the SVI answers pings
+	send(h10, icmpEchoFrame(t, h10, sviMac, h10IP, net.ParseIP("10.0.10.1")))
+	frame, packet := lastIPv4(t, h10)
+	assert.Equal(t, sviMac, frame.Source())
+	assert.Equal(t, net.ParseIP("10.0.10.1").To4(), packet.Header.SourceIP.To4())
+
+	// traffic to the other VLAN is routed
+	send(h10, icmpEchoFrame(t, h10, sviMac, h10IP, h20IP))
+	frame, packet = lastIPv4(t, h20)
+	assert.Equal(t, h20.Mac(), frame.Destination())
+	assert.Equal(t, sviMac, frame.Source())
+	assert.Equal(t, uint8(63), packet.Header.TTL)
+	assert.Equal(t, packet.Header.CalculateChecksum(), packet.Header.HeaderChecksum)
+	assert.Len(t, h10b.received(), 1)
+
+	// unknown next hops are resolved in the egress VLAN
+	send(h10, icmpEchoFrame(t, h10, sviMac, h10IP, net.ParseIP("10.0.20.3")))
+	request := &exu.ArpPacket{}
+	last := h20.received()[len(h20.received())-1]
+	assert.NoError(t, request.FromBytes(last.Payload()))
+	assert.Equal(t, exu.ArpOpcodeRequest, request.Opcode)
+	assert.Equal(t, net.ParseIP("10.0.20.3").To4(), request.TargetIP.To4())
+
+	// and the sender is told if they do not answer
+	_, packet = lastIPv4(t, h10)
+	icmp := &exu.ICMPPayload{}
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+	assert.Equal(t, exu.ICMPCodeHostUnreachable, icmp.Code)
+
+	// traffic within a VLAN is still switched
+	send(h10, helloFrame(h10b.Mac(), h10.Mac()))
+	assert.Len(t, h10b.received(), 2)
+	assert.Equal(t, h10.Mac(), h10b.received()[1].Source())
+}
+
+func TestL3SwitchRoutesOverTrunk(t *testing.T) {
+	sw1 := exu.NewVL3Switch("sw1", 2)
+	sw2 := exu.NewVSwitch("sw2", 3)
+
+	sw1Trunk := sw1.GetFirstFreePort()
+	sw2Trunk := sw2.GetFirstFreePort()
+	assert.NoError(t, sw1.ConnectPorts(sw1Trunk, sw2Trunk))
+	sw1.SetPortMode(sw1Trunk, exu.PortModeTrunk)
+	sw2.SetPortMode(sw2Trunk, exu.PortModeTrunk)
+
+	h10 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h10")
+	h20 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h20")
+	sw2.SetPortMode(connectCapturePort(t, sw2.EthernetDevice, h10), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw2.SetPortMode(connectCapturePort(t, sw2.EthernetDevice, h20), exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+
+	assert.NoError(t, sw1.SetSviIPNet(10, net.IPNet{IP: net.ParseIP("10.0.10.1"), Mask: net.CIDRMask(24, 32)}))
+	assert.NoError(t, sw1.SetSviIPNet(20, net.IPNet{IP: net.ParseIP("10.0.20.1"), Mask: net.CIDRMask(24, 32)}))
+	sviMac := sw1.Svis()[0].Mac
+
+	h10IP := net.ParseIP("10.0.10.2")
+	h20IP := net.ParseIP("10.0.20.2")
+
+	_ = h10.Write(arpFrame(t, h10, h10.Mac(), h10IP, net.ParseIP("10.0.10.1")))
+	_ = h20.Write(arpFrame(t, h20, h20.Mac(), h20IP, net.ParseIP("10.0.20.1")))
+	exu.AllSettled()
+
+	// the routed packet is tagged for VLAN 20 on the trunk and delivered untagged
+	_ = h10.Write(icmpEchoFrame(t, h10, sviMac, h10IP, h20IP))
+	exu.AllSettled()
+
+	frame, packet := lastIPv4(t, h20)
+	assert.Equal(t, exu.TaggingUntagged, frame.Tagging())
+	assert.Equal(t, h20IP.To4(), packet.Header.DestinationIP.To4())
+
+	// and the reply finds its way back
+	_ = h20.Write(icmpEchoFrame(t, h20, sviMac, h20IP, h10IP))
+	exu.AllSettled()
+
+	_, packet = lastIPv4(t, h10)
+	assert.Equal(t, h20IP.To4(), packet.Header.SourceIP.To4())
+}
+
+func TestL3SwitchRouting(t *testing.T) {
+	sw1 := exu.NewVL3Switch("sw1", 2)
+
+	h10 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h10")
+	h20 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h20")
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, h10), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, h20), exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+
+	assert.NoError(t, sw1.SetSviIPNet(10, net.IPNet{IP: net.ParseIP("10.0.10.1"), Mask: net.CIDRMask(24, 32)}))
+	assert.NoError(t, sw1.SetSviIPNet(20, net.IPNet{IP: net.ParseIP("10.0.20.1"), Mask: net.CIDRMask(24, 32)}))
+	sviMac := sw1.Svis()[0].Mac
+
+	h10IP := net.ParseIP("10.0.10.2")
+	h20IP := net.ParseIP("10.0.20.2")
+	_ = h10.Write(arpFrame(t, h10, h10.Mac(), h10IP, net.ParseIP("10.0.10.1")))
+	exu.AllSettled()
+
+	// a packet to a next hop that is not resolved yet waits for it
+	_ = h10.Write(icmpEchoFrame(t, h10, sviMac, h10IP, h20IP))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, receivedIPv4(t, h20))
+
+	reply, err := exu.NewEthernetFrame(sviMac, h20.Mac(), exu.WithTagging(exu.TaggingUntagged),
+		exu.NewArpPayload(exu.ArpHardwareTypeEthernet, exu.ArpProtocolTypeIPv4, exu.ArpOpcodeReply,
+			h20.Mac(), h20IP, sviMac, net.ParseIP("10.0.20.1")))
+	assert.NoError(t, err)
+	_ = h20.Write(reply)
+	exu.AllSettled()
+
+	_, packet := lastIPv4(t, h20)
+	assert.Equal(t, h10IP.To4(), packet.Header.SourceIP.To4())
+
+	// packets that run out of TTL are answered from the SVI they were received on
+	expiring := icmpEchoFrame(t, h10, sviMac, h10IP, h20IP)
+	ttl := &exu.IPv4Packet{}
+	assert.NoError(t, ttl.UnmarshalBinary(expiring.Payload()))
+	ttl.Header.TTL = 1
+	ttl.Header.HeaderChecksum = ttl.Header.CalculateChecksum()
+	expiring, err = exu.NewEthernetFrame(sviMac, h10.Mac(), exu.WithTagging(exu.TaggingUntagged), ttl)
+	assert.NoError(t, err)
+	_ = h10.Write(expiring)
+	exu.AllSettled()
+
+	_, packet = lastIPv4(t, h10)
+	assert.Equal(t, net.ParseIP("10.0.10.1").To4(), packet.Header.SourceIP.To4())
+	icmp := &exu.ICMPPayload{}
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, exu.ICMPTypeTimeExceeded, icmp.Type)
+
+	// static routes use the routing information base of a router and can be deleted
+	remote := exu.Route{
+		Network: net.IPNet{IP: net.ParseIP("172.16.0.0"), Mask: net.CIDRMask(16, 32)},
+		Via:     h20IP,
+		Metric:  10,
+	}
+	assert.Error(t, sw1.AddRoute(exu.Route{Network: remote.Network, Via: h20IP, Port: h20.VPort}))
+	assert.NoError(t, sw1.AddRoute(remote))
+	assert.Error(t, sw1.AddRoute(remote))
+
+	_ = h10.Write(icmpEchoFrame(t, h10, sviMac, h10IP, net.ParseIP("172.16.0.1")))
+	exu.AllSettled()
+	frame, packet := lastIPv4(t, h20)
+	assert.Equal(t, h20.Mac(), frame.Destination())
+	assert.Equal(t, net.ParseIP("172.16.0.1").To4(), packet.Header.DestinationIP.To4())
+
+	assert.NoError(t, sw1.DeleteRoute(remote))
+	assert.Error(t, sw1.DeleteRoute(remote))
+	_ = h10.Write(icmpEchoFrame(t, h10, sviMac, h10IP, net.ParseIP("172.16.0.1")))
+	exu.AllSettled()
+	_, packet = lastIPv4(t, h10)
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+	assert.Equal(t, exu.ICMPCodeNetUnreachable, icmp.Code)
+
+	// without its SVI, the VLAN is only switched
+	sw1.RemoveSvi(20)
+	assert.Len(t, sw1.Svis(), 1)
+	_ = h10.Write(icmpEchoFrame(t, h10, sviMac, h10IP, h20IP))
+	exu.AllSettled()
+	_, packet = lastIPv4(t, h10)
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, exu.ICMPCodeNetUnreachable, icmp.Code)
+}
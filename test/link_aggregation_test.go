@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lacpPair connects two switches with two links bundled into a port-channel
+// on both sides and returns the switches, the port-channels and the member
+// ports of both switches.
+func lacpPair(t *testing.T, mode1, mode2 exu.LinkAggregationMode) ([2]*exu.VSwitch, [2]*exu.PortChannel, [2][]*exu.VPort) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw2 := exu.NewVSwitch("sw2", 3)
+
+	members1 := make([]*exu.VPort, 0)
+	members2 := make([]*exu.VPort, 0)
+	for i := 0; i < 2; i++ {
+		a := sw1.GetFirstFreePort()
+		b := sw2.GetFirstFreePort()
+		if err := sw1.ConnectPorts(a, b); err != nil {
+			t.Fatal(err)
+		}
+		members1 = append(members1, a)
+		members2 = append(members2, b)
+	}
+
+	pc1, err := sw1.NewPortChannel(exu.PortChannelConfig{Mode: mode1, LacpInterval: 20 * time.Millisecond}, members1...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc2, err := sw2.NewPortChannel(exu.PortChannelConfig{Mode: mode2, LacpInterval: 20 * time.Millisecond}, members2...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return [2]*exu.VSwitch{sw1, sw2}, [2]*exu.PortChannel{pc1, pc2}, [2][]*exu.VPort{members1, members2}
+}
+
+func testLinkAggregation(t *testing.T, mode1, mode2 exu.LinkAggregationMode) {
+	switches, channels, members := lacpPair(t, mode1, mode2)
+	defer switches[0].RemovePortChannel(channels[0])
+	defer switches[1].RemovePortChannel(channels[1])
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, channels[0].ActiveMembers(), 2)
+	assert.Len(t, channels[1].ActiveMembers(), 2)
+
+	var received atomic.Int32
+	host := exu.NewVPort(mustParseMAC("42:69:00:00:00:01"), "host")
+	host.SetOnReceive(func(data *exu.EthernetFrame) {})
+	sink := exu.NewVPort(mustParseMAC("42:69:00:00:00:02"), "sink")
+	sink.SetOnReceive(func(data *exu.EthernetFrame) {
+		if !bytes.Equal(data.Destination(), exu.SlowProtocolsMAC) {
+			received.Add(1)
+		}
+	})
+	_ = switches[0].ConnectToFirstAvailablePort(host)
+	_ = switches[1].ConnectToFirstAvailablePort(sink)
+
+	// a broadcast crosses the port-channel exactly once
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, int32(1), received.Load())
+
+	// the MAC address table learns the host on the port-channel, not on a member
+	entries := switches[1].MacAddressTable(exu.MacFilterPort(channels[1].Port()))
+	assert.Len(t, entries, 1)
+
+	// traffic is moved to the remaining member when a member fails
+	switches[0].DisconnectPort(members[1][0])
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, []*exu.VPort{members[0][1]}, channels[0].ActiveMembers())
+	assert.Len(t, channels[1].ActiveMembers(), 1)
+
+	for i := 0; i < 5; i++ {
+		_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+		exu.AllSettled()
+	}
+	assert.Equal(t, int32(6), received.Load())
+}
+
+func TestLinkAggregationStatic(t *testing.T) {
+	testLinkAggregation(t, exu.LinkAggregationStatic, exu.LinkAggregationStatic)
+}
+
+func TestLinkAggregationLacp(t *testing.T) {
+	testLinkAggregation(t, exu.LinkAggregationLacpActive, exu.LinkAggregationLacpPassive)
+}
+
+func TestLinkAggregationLacpPassiveOnly(t *testing.T) {
+	switches, channels, _ := lacpPair(t, exu.LinkAggregationLacpPassive, exu.LinkAggregationLacpPassive)
+	defer switches[0].RemovePortChannel(channels[0])
+	defer switches[1].RemovePortChannel(channels[1])
+
+	// two passive partners never start the negotiation
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, channels[0].ActiveMembers())
+	assert.Empty(t, channels[1].ActiveMembers())
+}
+
+func TestLacpduRoundTrip(t *testing.T) {
+	lacpdu := &exu.LacpPacket{
+		Actor: exu.LacpInfo{
+			SystemPriority: 32768,
+			System:         mustParseMAC("42:69:00:00:00:01"),
+			Key:            1,
+			PortPriority:   32768,
+			Port:           2,
+			State:          exu.LacpStateActivity | exu.LacpStateAggregation,
+		},
+		Partner: exu.LacpInfo{
+			System: mustParseMAC("42:69:00:00:00:02"),
+		},
+	}
+
+	data, err := lacpdu.MarshalBinary()
+	assert.NoError(t, err)
+
+	parsed := &exu.LacpPacket{}
+	assert.NoError(t, parsed.UnmarshalBinary(data))
+	assert.Equal(t, lacpdu.Actor, parsed.Actor)
+	assert.Equal(t, lacpdu.Partner.System, parsed.Partner.System)
+}
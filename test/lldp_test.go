@@ -0,0 +1,149 @@
+package test
+
+import (
+	"bytes"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLldpNeighbors(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw2 := exu.NewVSwitch("sw2", 2)
+	sw3 := exu.NewVSwitch("sw3", 2)
+	r1 := exu.NewVRouter("r1", 1)
+
+	swToR1 := sw1.GetFirstFreePort()
+	r1Port := r1.GetFirstFreePort()
+	_ = sw1.ConnectPorts(swToR1, r1Port)
+	r1.SetPortIPNet(r1Port, net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(24, 32)})
+
+	swToSw2 := sw1.GetFirstFreePort()
+	sw2Port := sw2.GetFirstFreePort()
+	_ = sw1.ConnectPorts(swToSw2, sw2Port)
+
+	// sw3 does not run LLDP and must not forward our LLDPDUs to the host
+	_ = sw1.ConnectPorts(sw1.GetFirstFreePort(), sw3.GetFirstFreePort())
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "host")
+	connectCapturePort(t, sw3.EthernetDevice, host)
+
+	config := exu.LldpConfig{Interval: 20 * time.Millisecond}
+	for _, dev := range []*exu.EthernetDevice{sw1.EthernetDevice, sw2.EthernetDevice, r1.EthernetDevice} {
+		dev.EnableLldp(config)
+	}
+	defer sw1.DisableLldp()
+	defer sw2.DisableLldp()
+
+	time.Sleep(100 * time.Millisecond)
+
+	neighbors := sw1.LldpNeighbors()
+	assert.Len(t, neighbors, 2)
+	for i := range neighbors {
+		neighbors[i].ExpiresIn = 0
+	}
+	assert.Equal(t, []exu.LldpNeighbor{
+		{
+			Port:              swToR1,
+			ChassisID:         r1Port.Mac().String(),
+			PortID:            "eth0/0",
+			PortDescription:   "eth0/0",
+			SystemName:        "r1",
+			ManagementAddress: net.ParseIP("10.0.0.1").To4(),
+		},
+		{
+			Port:            swToSw2,
+			ChassisID:       sw2Port.Mac().String(),
+			PortID:          "eth0/0",
+			PortDescription: "eth0/0",
+			SystemName:      "sw2",
+		},
+	}, neighbors)
+
+	assert.Len(t, r1.LldpNeighbors(), 1)
+	assert.Equal(t, "sw1", r1.LldpNeighbors()[0].SystemName)
+
+	exu.AllSettled()
+	for _, frame := range host.received() {
+		assert.False(t, bytes.Equal(frame.Destination(), exu.LldpMAC))
+	}
+
+	// a neighbor that stops LLDP is removed right away
+	r1.DisableLldp()
+	exu.AllSettled()
+	assert.Len(t, sw1.LldpNeighbors(), 1)
+}
+
+func TestLldpNeighborExpiry(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 1)
+	sw1.EnableLldp(exu.LldpConfig{Interval: time.Hour})
+	defer sw1.DisableLldp()
+
+	neighbor := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "neighbor")
+	swPort := connectCapturePort(t, sw1.EthernetDevice, neighbor)
+
+	frame, err := exu.NewEthernetFrame(exu.LldpMAC, neighbor.Mac(), exu.WithTagging(exu.TaggingUntagged), &exu.LldpPacket{
+		ChassisID:  "server-1",
+		PortID:     "ens3",
+		TTL:        1,
+		SystemName: "server-1",
+	})
+	assert.NoError(t, err)
+	_ = neighbor.Write(frame)
+	exu.AllSettled()
+
+	neighbors := sw1.LldpNeighbors()
+	assert.Len(t, neighbors, 1)
+	assert.Equal(t, swPort, neighbors[0].Port)
+	assert.Equal(t, "server-1", neighbors[0].ChassisID)
+	assert.Equal(t, "ens3", neighbors[0].PortID)
+
+	time.Sleep(1100 * time.Millisecond)
+	assert.Empty(t, sw1.LldpNeighbors())
+}
+
+func TestLldpManagementAddressChange(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 1)
+	r1 := exu.NewVRouter("r1", 1)
+	r1Port := r1.GetFirstFreePort()
+	_ = sw1.ConnectPorts(sw1.GetFirstFreePort(), r1Port)
+
+	config := exu.LldpConfig{Interval: 5 * time.Millisecond}
+	sw1.EnableLldp(config)
+	defer sw1.DisableLldp()
+	r1.EnableLldp(config)
+	defer r1.DisableLldp()
+
+	// the address can change while it is being advertised
+	for i := 1; i <= 20; i++ {
+		r1.SetPortIPNet(r1Port, net.IPNet{IP: net.IPv4(10, 0, 0, byte(i)), Mask: net.CIDRMask(24, 32)})
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	neighbors := sw1.LldpNeighbors()
+	if assert.Len(t, neighbors, 1) {
+		assert.Equal(t, net.IPv4(10, 0, 0, 20).To4(), neighbors[0].ManagementAddress.To4())
+	}
+}
+
+func TestLldpduRoundTrip(t *testing.T) {
+	lldpdu := &exu.LldpPacket{
+		ChassisID:         "42:69:00:00:00:01",
+		PortID:            "eth0/1",
+		TTL:               120,
+		PortDescription:   "uplink",
+		SystemName:        "sw1",
+		ManagementAddress: net.ParseIP("10.0.0.1").To4(),
+	}
+
+	data, err := lldpdu.MarshalBinary()
+	assert.NoError(t, err)
+
+	parsed := &exu.LldpPacket{}
+	assert.NoError(t, parsed.UnmarshalBinary(data))
+	assert.Equal(t, lldpdu, parsed)
+
+	assert.Error(t, parsed.UnmarshalBinary(data[:4]))
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func helloFrame(dst, src net.HardwareAddr) *exu.EthernetFrame {
+	frame := exu.EthernetFrame{
+		dst[0], dst[1], dst[2], dst[3], dst[4], dst[5],
+		src[0], src[1], src[2], src[3], src[4], src[5],
+		0x10, 0x01,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+	return &frame
+}
+
+func TestMacMove(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+
+	host := mustParseMAC("42:69:00:00:00:01")
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:0a"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:0b"), "b")
+	c := newCapturePort(mustParseMAC("42:69:00:00:00:0c"), "c")
+
+	swA := connectCapturePort(t, sw1.EthernetDevice, a)
+	swB := connectCapturePort(t, sw1.EthernetDevice, b)
+	connectCapturePort(t, sw1.EthernetDevice, c)
+
+	var moveMu sync.Mutex
+	var moves [][2]*exu.VPort
+	sw1.SetOnMacMove(func(mac net.HardwareAddr, vlan uint16, from, to *exu.VPort) {
+		moveMu.Lock()
+		defer moveMu.Unlock()
+		assert.Equal(t, host, mac)
+		assert.Equal(t, exu.DefaultVlan, vlan)
+		moves = append(moves, [2]*exu.VPort{from, to})
+	})
+
+	// the host shows up on a, then moves to b
+	_ = a.Write(helloFrame(exu.BroadcastMAC, host))
+	exu.AllSettled()
+	_ = b.Write(helloFrame(exu.BroadcastMAC, host))
+	exu.AllSettled()
+
+	moveMu.Lock()
+	assert.Equal(t, [][2]*exu.VPort{{swA, swB}}, moves)
+	moveMu.Unlock()
+
+	// traffic for the host is now only delivered to b
+	_ = c.Write(helloFrame(host, c.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, a.received(), 1)
+	assert.Len(t, b.received(), 2)
+}
+
+func TestMacAging(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw1.SetMacAgingTime(50 * time.Millisecond)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:0a"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:0b"), "b")
+	c := newCapturePort(mustParseMAC("42:69:00:00:00:0c"), "c")
+	for _, p := range []*capturePort{a, b, c} {
+		connectCapturePort(t, sw1.EthernetDevice, p)
+	}
+
+	_ = a.Write(helloFrame(exu.BroadcastMAC, a.Mac()))
+	exu.AllSettled()
+
+	// known unicast only reaches a
+	_ = b.Write(helloFrame(a.Mac(), b.Mac()))
+	exu.AllSettled()
+	assert.Len(t, c.received(), 1)
+
+	// after the entry aged out, the frame is flooded again
+	time.Sleep(100 * time.Millisecond)
+	_ = b.Write(helloFrame(a.Mac(), mustParseMAC("42:69:00:00:00:ff")))
+	exu.AllSettled()
+	assert.Len(t, c.received(), 2)
+}
+
+func TestMacTableLimit(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw1.SetMacTableLimit(1)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:0a"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:0b"), "b")
+	c := newCapturePort(mustParseMAC("42:69:00:00:00:0c"), "c")
+	for _, p := range []*capturePort{a, b, c} {
+		connectCapturePort(t, sw1.EthernetDevice, p)
+	}
+
+	_ = a.Write(helloFrame(exu.BroadcastMAC, a.Mac()))
+	exu.AllSettled()
+
+	// learning b evicts a
+	_ = b.Write(helloFrame(exu.BroadcastMAC, b.Mac()))
+	exu.AllSettled()
+
+	_ = c.Write(helloFrame(a.Mac(), mustParseMAC("42:69:00:00:00:ff")))
+	exu.AllSettled()
+	assert.Len(t, b.received(), 2)
+}
+
+// withoutAge zeroes the age of entries so they can be compared.
+func withoutAge(entries []exu.MacAddressEntry) []exu.MacAddressEntry {
+	for i := range entries {
+		entries[i].Age = 0
+	}
+	return entries
+}
+
+func TestIndependentVlanLearning(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 4)
+
+	// a router reusing its MAC on two subinterfaces, one per vlan
+	shared := mustParseMAC("42:69:00:00:00:01")
+	r10 := newCapturePort(mustParseMAC("42:69:00:00:00:0a"), "r10")
+	r20 := newCapturePort(mustParseMAC("42:69:00:00:00:0b"), "r20")
+	h10 := newCapturePort(mustParseMAC("42:69:00:00:00:0c"), "h10")
+	h20 := newCapturePort(mustParseMAC("42:69:00:00:00:0d"), "h20")
+
+	swR10 := connectCapturePort(t, sw1.EthernetDevice, r10)
+	swR20 := connectCapturePort(t, sw1.EthernetDevice, r20)
+	swH10 := connectCapturePort(t, sw1.EthernetDevice, h10)
+	swH20 := connectCapturePort(t, sw1.EthernetDevice, h20)
+	sw1.SetPortMode(swR10, exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(swH10, exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(swR20, exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+	sw1.SetPortMode(swH20, exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+
+	_ = r10.Write(helloFrame(exu.BroadcastMAC, shared))
+	_ = r20.Write(helloFrame(exu.BroadcastMAC, shared))
+	exu.AllSettled()
+
+	assert.Equal(t, []exu.MacAddressEntry{
+		{Mac: shared, Vlan: 10, Port: swR10, Type: exu.MacAddressDynamic},
+		{Mac: shared, Vlan: 20, Port: swR20, Type: exu.MacAddressDynamic},
+	}, withoutAge(sw1.MacAddressTable()))
+	assert.Equal(t, []exu.MacAddressEntry{
+		{Mac: shared, Vlan: 20, Port: swR20, Type: exu.MacAddressDynamic},
+	}, withoutAge(sw1.MacAddressTable(exu.MacFilterVlan(20))))
+	assert.Empty(t, sw1.MacAddressTable(exu.MacFilterVlan(20), exu.MacFilterPort(swR10)))
+
+	// unicast to the shared MAC is delivered per vlan without a mac move
+	_ = h10.Write(helloFrame(shared, h10.Mac()))
+	_ = h20.Write(helloFrame(shared, h20.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, r10.received(), 1)
+	assert.Len(t, r20.received(), 1)
+
+	sw1.FlushMacAddressesInVlan(10)
+	assert.Len(t, sw1.MacAddressTable(exu.MacFilterVlan(10)), 0)
+	assert.Len(t, sw1.MacAddressTable(exu.MacFilterVlan(20)), 2)
+}
+
+func TestStaticMacAddresses(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw1.SetMacAgingTime(50 * time.Millisecond)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "b")
+	c := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "c")
+	swA := connectCapturePort(t, sw1.EthernetDevice, a)
+	swB := connectCapturePort(t, sw1.EthernetDevice, b)
+	connectCapturePort(t, sw1.EthernetDevice, c)
+
+	server := mustParseMAC("42:69:00:00:00:10")
+	assert.NoError(t, sw1.AddStaticMacAddress(exu.DefaultVlan, server, swA))
+	assert.Error(t, sw1.AddStaticMacAddress(exu.DefaultVlan, exu.BroadcastMAC, swA))
+	assert.Error(t, sw1.AddStaticMacAddress(exu.DefaultVlan, server, exu.NewVPort(server, "foreign")))
+
+	// the static entry is used for forwarding right away
+	_ = c.Write(helloFrame(server, c.Mac()))
+	exu.AllSettled()
+	assert.Len(t, a.received(), 1)
+	assert.Empty(t, b.received())
+
+	// traffic from the static address on another port does not move it
+	_ = b.Write(helloFrame(exu.BroadcastMAC, server))
+	exu.AllSettled()
+
+	// static entries never age out, dynamic ones do
+	time.Sleep(100 * time.Millisecond)
+	_ = b.Write(helloFrame(exu.BroadcastMAC, b.Mac()))
+	exu.AllSettled()
+
+	entries := sw1.MacAddressTable()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, exu.MacAddressEntry{
+		Mac:  server,
+		Vlan: exu.DefaultVlan,
+		Port: swA,
+		Type: exu.MacAddressStatic,
+	}, entries[1])
+	assert.Equal(t, exu.MacAddressDynamic, entries[0].Type)
+	assert.Equal(t, swB, entries[0].Port)
+	assert.Less(t, entries[0].Age, 50*time.Millisecond)
+
+	// clearing dynamic entries keeps the static ones
+	sw1.FlushMacAddresses(exu.MacFilterType(exu.MacAddressDynamic))
+	sw1.FlushMacAddresses()
+	sw1.FlushMacAddressesOnPort(swA)
+	assert.Equal(t, []exu.MacAddressEntry{entries[1]}, sw1.MacAddressTable())
+
+	assert.NoError(t, sw1.RemoveStaticMacAddress(exu.DefaultVlan, server))
+	assert.Error(t, sw1.RemoveStaticMacAddress(exu.DefaultVlan, server))
+	assert.Empty(t, sw1.MacAddressTable())
+}
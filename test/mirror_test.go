@@ -0,0 +1,207 @@
+package test
+
+import (
+	"bytes"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func countFrom(frames []exu.EthernetFrame, src *capturePort) int {
+	count := 0
+	for _, frame := range frames {
+		if bytes.Equal(frame.Source(), src.Mac()) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSpanDirections(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		direction exu.MirrorDirection
+		a, b      int
+	}{
+		{"ingress", exu.MirrorIngress, 1, 0},
+		{"egress", exu.MirrorEgress, 0, 1},
+		{"both", exu.MirrorBoth, 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sw1 := exu.NewVSwitch("sw1", 3)
+
+			a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+			b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "b")
+			analyzer := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "analyzer")
+			swA := connectCapturePort(t, sw1.EthernetDevice, a)
+			connectCapturePort(t, sw1.EthernetDevice, b)
+			swAnalyzer := connectCapturePort(t, sw1.EthernetDevice, analyzer)
+
+			assert.NoError(t, sw1.EnableMirrorSession(1, exu.MirrorSessionConfig{
+				SourcePorts: []*exu.VPort{swA},
+				Direction:   tc.direction,
+				Destination: swAnalyzer,
+			}))
+
+			_ = a.Write(helloFrame(b.Mac(), a.Mac()))
+			exu.AllSettled()
+			_ = b.Write(helloFrame(a.Mac(), b.Mac()))
+			exu.AllSettled()
+
+			// the monitored traffic is not affected
+			assert.Equal(t, 1, countFrom(b.received(), a))
+			assert.Equal(t, 1, countFrom(a.received(), b))
+
+			assert.Equal(t, tc.a, countFrom(analyzer.received(), a))
+			assert.Equal(t, tc.b, countFrom(analyzer.received(), b))
+		})
+	}
+}
+
+func TestSpanVlanSource(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 4)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "b")
+	c := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "c")
+	analyzer := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "analyzer")
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, a), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, b), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, c), exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+	swAnalyzer := connectCapturePort(t, sw1.EthernetDevice, analyzer)
+
+	assert.NoError(t, sw1.EnableMirrorSession(1, exu.MirrorSessionConfig{
+		SourceVlans: []uint16{10},
+		Direction:   exu.MirrorIngress,
+		Destination: swAnalyzer,
+	}))
+
+	_ = a.Write(helloFrame(exu.BroadcastMAC, a.Mac()))
+	exu.AllSettled()
+	_ = c.Write(helloFrame(exu.BroadcastMAC, c.Mac()))
+	exu.AllSettled()
+
+	assert.Equal(t, 1, countFrom(analyzer.received(), a))
+	assert.Equal(t, 0, countFrom(analyzer.received(), c))
+
+	// the destination port does not take part in switching
+	_ = analyzer.Write(helloFrame(exu.BroadcastMAC, analyzer.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, 0, countFrom(b.received(), analyzer))
+	assert.Empty(t, sw1.MacAddressTable(exu.MacFilterPort(swAnalyzer)))
+
+	sw1.DisableMirrorSession(1)
+	_ = a.Write(helloFrame(exu.BroadcastMAC, a.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, 1, countFrom(analyzer.received(), a))
+}
+
+func TestSpanInvalidSession(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+	other := exu.NewVSwitch("other", 1)
+
+	assert.Error(t, sw1.EnableMirrorSession(1, exu.MirrorSessionConfig{}))
+	assert.Error(t, sw1.EnableMirrorSession(1, exu.MirrorSessionConfig{
+		Destination: other.GetFirstFreePort(),
+	}))
+
+	port := sw1.GetFirstFreePort()
+	assert.Error(t, sw1.EnableMirrorSession(1, exu.MirrorSessionConfig{
+		SourcePorts: []*exu.VPort{port},
+		Destination: port,
+	}))
+}
+
+// TestRspan mirrors a port of sw1 over the RSPAN VLAN 999 through sw2 to an
+// analyzer on sw3
+//
+//	a, b - sw1 <-> sw2 <-> sw3 - analyzer
+func TestRspan(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw2 := exu.NewVSwitch("sw2", 3)
+	sw3 := exu.NewVSwitch("sw3", 2)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "b")
+	bystander := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "bystander")
+	analyzer := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "analyzer")
+	swA := connectCapturePort(t, sw1.EthernetDevice, a)
+	connectCapturePort(t, sw1.EthernetDevice, b)
+	connectCapturePort(t, sw2.EthernetDevice, bystander)
+	swAnalyzer := connectCapturePort(t, sw3.EthernetDevice, analyzer)
+
+	for _, pair := range [][2]*exu.VSwitch{{sw1, sw2}, {sw2, sw3}} {
+		p1 := pair[0].GetFirstFreePort()
+		p2 := pair[1].GetFirstFreePort()
+		if err := pair[0].ConnectPorts(p1, p2); err != nil {
+			t.Fatal(err)
+		}
+		trunk := exu.PortModeConfig{Mode: exu.Trunk, AllowedVlans: []uint16{999}}
+		pair[0].SetPortMode(p1, trunk)
+		pair[1].SetPortMode(p2, trunk)
+	}
+
+	assert.NoError(t, sw1.EnableMirrorSession(1, exu.MirrorSessionConfig{
+		SourcePorts: []*exu.VPort{swA},
+		Direction:   exu.MirrorIngress,
+		RspanVlan:   999,
+	}))
+	sw2.EnableRspanVlan(999)
+	assert.NoError(t, sw3.EnableMirrorSession(1, exu.MirrorSessionConfig{
+		Destination: swAnalyzer,
+		RspanVlan:   999,
+	}))
+
+	_ = a.Write(helloFrame(b.Mac(), a.Mac()))
+	exu.AllSettled()
+
+	assert.Equal(t, 1, countFrom(b.received(), a))
+	assert.Equal(t, 0, countFrom(bystander.received(), a))
+
+	// the analyzer receives the mirrored frame untagged
+	frames := analyzer.received()
+	assert.Equal(t, 1, countFrom(frames, a))
+	for _, frame := range frames {
+		assert.Equal(t, exu.TaggingUntagged, frame.Tagging())
+	}
+
+	// switches carrying the RSPAN VLAN do not learn the mirrored addresses
+	assert.Empty(t, sw2.MacAddressTable(exu.MacFilterVlan(999)))
+	assert.Empty(t, sw3.MacAddressTable(exu.MacFilterVlan(999)))
+}
+
+func TestRspanVlanReleasedWithSession(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "a")
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "uplink")
+	swA := connectCapturePort(t, sw1.EthernetDevice, a)
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, uplink), exu.PortModeTrunk)
+
+	learned := func() bool {
+		sw1.FlushMacAddresses()
+		frame := helloFrame(a.Mac(), uplink.Mac())
+		assert.NoError(t, frame.PushTag(exu.VlanTag{VID: 999}))
+		_ = uplink.Write(frame)
+		exu.AllSettled()
+		return len(sw1.MacAddressTable(exu.MacFilterVlan(999))) > 0
+	}
+
+	session := exu.MirrorSessionConfig{SourcePorts: []*exu.VPort{swA}, RspanVlan: 999}
+	assert.NoError(t, sw1.EnableMirrorSession(1, session))
+	assert.NoError(t, sw1.EnableMirrorSession(2, session))
+	assert.False(t, learned())
+
+	// the VLAN stays an RSPAN VLAN while any session uses it
+	sw1.DisableMirrorSession(1)
+	assert.False(t, learned())
+
+	sw1.DisableMirrorSession(2)
+	assert.True(t, learned())
+
+	// unless it was enabled explicitly
+	sw1.EnableRspanVlan(999)
+	assert.NoError(t, sw1.EnableMirrorSession(1, session))
+	sw1.DisableMirrorSession(1)
+	assert.False(t, learned())
+}
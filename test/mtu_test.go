@@ -0,0 +1,240 @@
+package test
+
+import (
+	"encoding/binary"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// sizedFrame returns a frame from src to dst with a payload of size bytes.
+func sizedFrame(dst net.HardwareAddr, src *capturePort, size int) *exu.EthernetFrame {
+	frame := append(exu.EthernetFrame{}, dst...)
+	frame = append(frame, src.Mac()...)
+	frame = append(frame, 0x10, 0x01)
+	frame = append(frame, make([]byte, size)...)
+	return &frame
+}
+
+func routedFrame(t *testing.T, src *capturePort, dst net.HardwareAddr, srcIP, dstIP net.IP, flags uint16, size int) *exu.EthernetFrame {
+	packet := &exu.IPv4Packet{
+		Header: exu.IPv4Header{
+			Version:       4,
+			IHL:           5,
+			TotalLength:   uint16(20 + size),
+			FlagsFragment: flags,
+			TTL:           64,
+			Protocol:      exu.IPv4ProtocolUDP,
+			SourceIP:      srcIP,
+			DestinationIP: dstIP,
+		},
+		Payload: make([]byte, size),
+	}
+	packet.Header.HeaderChecksum = packet.Header.CalculateChecksum()
+
+	frame, err := exu.NewEthernetFrame(dst, src.Mac(), exu.WithTagging(exu.TaggingUntagged), packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestVPortMTU(t *testing.T) {
+	port := exu.NewVPort(mustParseMAC("42:69:00:00:00:01"), "p1")
+	assert.Equal(t, exu.DefaultMTU, port.MTU())
+
+	assert.Error(t, port.SetMTU(exu.MinMTU-1))
+	assert.Error(t, port.SetMTU(exu.MaxMTU+1))
+	assert.NoError(t, port.SetMTU(9000))
+	assert.Equal(t, 9000, port.MTU())
+}
+
+func TestSwitchMTU(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	h2 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h2")
+	swH1 := connectCapturePort(t, sw1.EthernetDevice, h1)
+	swH2 := connectCapturePort(t, sw1.EthernetDevice, h2)
+
+	// frames larger than the MTU of the switch port are dropped when received
+	assert.NoError(t, h1.SetMTU(9000))
+	assert.NoError(t, h1.Write(sizedFrame(h2.Mac(), h1, 1501)))
+	exu.AllSettled()
+
+	assert.Empty(t, h2.received())
+	assert.Equal(t, exu.VPortCounters{RxOversize: 1}, swH1.Counters())
+
+	// and when sent
+	assert.NoError(t, swH1.SetMTU(9000))
+	assert.NoError(t, h1.Write(sizedFrame(h2.Mac(), h1, 1501)))
+	exu.AllSettled()
+
+	assert.Empty(t, h2.received())
+	assert.Equal(t, exu.VPortCounters{TxOversize: 1}, swH2.Counters())
+
+	// a port cannot send frames larger than its own MTU
+	assert.ErrorIs(t, h2.Write(sizedFrame(h1.Mac(), h2, 1501)), exu.FrameTooLargeError)
+	assert.Equal(t, exu.VPortCounters{TxOversize: 1}, h2.Counters())
+
+	// jumbo frames pass once every port on the path allows them
+	assert.NoError(t, sw1.SetMTU(9000))
+	assert.NoError(t, h2.SetMTU(9000))
+	assert.NoError(t, h1.Write(sizedFrame(h2.Mac(), h1, 9000)))
+	exu.AllSettled()
+
+	if assert.Len(t, h2.received(), 1) {
+		assert.Len(t, h2.received()[0].Payload(), 9000)
+	}
+}
+
+func TestIPv4Fragment(t *testing.T) {
+	packet := &exu.IPv4Packet{
+		Header: exu.IPv4Header{
+			Version:     4,
+			IHL:         5,
+			TotalLength: 20 + 1000,
+			TTL:         64,
+		},
+		Payload: make([]byte, 1000),
+	}
+	for i := range packet.Payload {
+		packet.Payload[i] = byte(i)
+	}
+
+	fragments, err := packet.Fragment(500)
+	assert.NoError(t, err)
+	if assert.Len(t, fragments, 3) {
+		var payload []byte
+		for i, fragment := range fragments {
+			assert.LessOrEqual(t, int(fragment.Header.TotalLength), 500)
+			assert.Equal(t, uint16(len(payload)/8), fragment.Header.FlagsFragment&exu.IPv4FragmentOffsetMask)
+			assert.Equal(t, i < 2, fragment.Header.FlagsFragment&exu.IPv4FlagMoreFragments != 0)
+			assert.Equal(t, fragment.Header.CalculateChecksum(), fragment.Header.HeaderChecksum)
+			payload = append(payload, fragment.Payload...)
+		}
+		assert.Equal(t, packet.Payload, payload)
+	}
+
+	packet.Header.FlagsFragment = exu.IPv4FlagDontFragment
+	_, err = packet.Fragment(500)
+	assert.Error(t, err)
+}
+
+func TestRouterMTU(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 2)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "uplink")
+	r1H1 := connectCapturePort(t, r1.EthernetDevice, h1)
+	r1Uplink := connectCapturePort(t, r1.EthernetDevice, uplink)
+
+	r1.SetPortIPNet(r1H1, net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(r1Uplink, net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(24, 32)})
+	assert.NoError(t, r1.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Via:     net.IPv4(192, 168, 0, 2),
+	}))
+	assert.NoError(t, r1Uplink.SetMTU(576))
+	assert.NoError(t, uplink.SetMTU(576))
+	_ = uplink.Write(arpReply(t, uplink, net.IPv4(192, 168, 0, 2), r1Uplink, net.IPv4(192, 168, 0, 1)))
+	exu.AllSettled()
+
+	h1IP := net.ParseIP("10.0.0.2")
+	dstIP := net.ParseIP("172.16.0.1")
+
+	// packets with DF set are answered with fragmentation needed
+	sent := routedFrame(t, h1, r1H1.Mac(), h1IP, dstIP, exu.IPv4FlagDontFragment, 1000)
+	assert.NoError(t, h1.Write(sent))
+	exu.AllSettled()
+
+	assert.Empty(t, uplink.received())
+	_, packet := lastIPv4(t, h1)
+	assert.Equal(t, net.ParseIP("10.0.0.1").To4(), packet.Header.SourceIP.To4())
+	assert.Equal(t, h1IP.To4(), packet.Header.DestinationIP.To4())
+
+	icmp := &exu.ICMPPayload{}
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+	assert.Equal(t, exu.ICMPCodeFragmentationNeeded, icmp.Code)
+	assert.Equal(t, icmp.CalculateChecksum(), icmp.Checksum)
+	if assert.Len(t, icmp.Data, 4+20+8) {
+		assert.Equal(t, uint32(576), binary.BigEndian.Uint32(icmp.Data[0:4]))
+		assert.Equal(t, []byte(sent.Payload()[:20+8]), icmp.Data[4:])
+	}
+
+	// everything else is fragmented
+	assert.NoError(t, h1.Write(routedFrame(t, h1, r1H1.Mac(), h1IP, dstIP, 0, 1000)))
+	exu.AllSettled()
+
+	fragments := receivedIPv4(t, uplink)
+	if assert.Len(t, fragments, 2) {
+		total := 0
+		for _, fragment := range fragments {
+			assert.LessOrEqual(t, int(fragment.Header.TotalLength), 576)
+			assert.Equal(t, uint8(63), fragment.Header.TTL)
+			total += len(fragment.Payload)
+		}
+		assert.Equal(t, 1000, total)
+	}
+	assert.Zero(t, r1Uplink.Counters().TxOversize)
+}
+
+func TestL3SwitchMTU(t *testing.T) {
+	sw1 := exu.NewVL3Switch("sw1", 2)
+
+	h10 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h10")
+	h20 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h20")
+	swH10 := connectCapturePort(t, sw1.EthernetDevice, h10)
+	swH20 := connectCapturePort(t, sw1.EthernetDevice, h20)
+	sw1.SetPortMode(swH10, exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(swH20, exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+	assert.NoError(t, swH20.SetMTU(576))
+	assert.NoError(t, h20.SetMTU(576))
+
+	assert.NoError(t, sw1.SetSviIPNet(10, net.IPNet{IP: net.ParseIP("10.0.10.1"), Mask: net.CIDRMask(24, 32)}))
+	assert.NoError(t, sw1.SetSviIPNet(20, net.IPNet{IP: net.ParseIP("10.0.20.1"), Mask: net.CIDRMask(24, 32)}))
+	sviMac := sw1.Svis()[0].Mac
+
+	h10IP := net.ParseIP("10.0.10.2")
+	h20IP := net.ParseIP("10.0.20.2")
+	_ = h10.Write(arpFrame(t, h10, h10.Mac(), h10IP, net.ParseIP("10.0.10.1")))
+	_ = h20.Write(arpFrame(t, h20, h20.Mac(), h20IP, net.ParseIP("10.0.20.1")))
+	exu.AllSettled()
+
+	// packets with DF set are answered with fragmentation needed from the SVI
+	sent := routedFrame(t, h10, sviMac, h10IP, h20IP, exu.IPv4FlagDontFragment, 1000)
+	assert.NoError(t, h10.Write(sent))
+	exu.AllSettled()
+
+	assert.Empty(t, receivedIPv4(t, h20))
+	_, packet := lastIPv4(t, h10)
+	assert.Equal(t, net.ParseIP("10.0.10.1").To4(), packet.Header.SourceIP.To4())
+	assert.Equal(t, h10IP.To4(), packet.Header.DestinationIP.To4())
+
+	icmp := &exu.ICMPPayload{}
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+	assert.Equal(t, exu.ICMPCodeFragmentationNeeded, icmp.Code)
+	if assert.Len(t, icmp.Data, 4+20+8) {
+		assert.Equal(t, uint32(576), binary.BigEndian.Uint32(icmp.Data[0:4]))
+		assert.Equal(t, []byte(sent.Payload()[:20+8]), icmp.Data[4:])
+	}
+
+	// everything else is fragmented
+	assert.NoError(t, h10.Write(routedFrame(t, h10, sviMac, h10IP, h20IP, 0, 1000)))
+	exu.AllSettled()
+
+	fragments := receivedIPv4(t, h20)
+	if assert.Len(t, fragments, 2) {
+		total := 0
+		for _, fragment := range fragments {
+			assert.LessOrEqual(t, int(fragment.Header.TotalLength), 576)
+			assert.Equal(t, uint8(63), fragment.Header.TTL)
+			total += len(fragment.Payload)
+		}
+		assert.Equal(t, 1000, total)
+	}
+	assert.Zero(t, swH20.Counters().TxOversize)
+}
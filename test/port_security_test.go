@@ -0,0 +1,83 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPortSecurityRestrict(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	attacker := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "attacker")
+	victim := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "victim")
+	swAttacker := connectCapturePort(t, sw1.EthernetDevice, attacker)
+	connectCapturePort(t, sw1.EthernetDevice, victim)
+
+	var violations atomic.Int32
+	sw1.SetOnPortSecurityViolation(func(port *exu.VPort, mac net.HardwareAddr, mode exu.PortSecurityViolationMode) {
+		assert.Equal(t, swAttacker, port)
+		assert.Equal(t, exu.PortSecurityRestrict, mode)
+		violations.Add(1)
+	})
+	sw1.EnablePortSecurity(swAttacker, exu.PortSecurityConfig{
+		MaxMacAddresses: 2,
+		ViolationMode:   exu.PortSecurityRestrict,
+	})
+
+	// flood the switch with random source addresses
+	for i := 0; i < 10; i++ {
+		_ = attacker.Write(helloFrame(exu.BroadcastMAC, net.HardwareAddr{0x42, 0x69, 0x00, 0x00, 0x01, byte(i)}))
+		exu.AllSettled()
+	}
+
+	assert.Len(t, victim.received(), 2)
+	assert.Equal(t, int32(8), violations.Load())
+	assert.Len(t, sw1.MacAddressTable(exu.MacFilterPort(swAttacker)), 2)
+
+	status, ok := sw1.PortSecurityStatus(swAttacker)
+	assert.True(t, ok)
+	assert.Len(t, status.SecureMacs, 2)
+	assert.Equal(t, uint64(8), status.Violations)
+	assert.Equal(t, net.HardwareAddr{0x42, 0x69, 0x00, 0x00, 0x01, 0x09}, status.LastViolation)
+	assert.False(t, status.Shutdown)
+}
+
+func TestPortSecurityShutdown(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "host")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "other")
+	swHost := connectCapturePort(t, sw1.EthernetDevice, host)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+
+	sw1.EnablePortSecurity(swHost, exu.PortSecurityConfig{
+		AllowedMacs:   []net.HardwareAddr{host.Mac()},
+		ViolationMode: exu.PortSecurityShutdown,
+	})
+
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	exu.AllSettled()
+	assert.Len(t, other.received(), 1)
+
+	// an unknown source shuts the port down, even for the allowed address
+	_ = host.Write(helloFrame(exu.BroadcastMAC, mustParseMAC("42:69:00:00:00:ff")))
+	exu.AllSettled()
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	_ = other.Write(helloFrame(exu.BroadcastMAC, other.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, other.received(), 1)
+	assert.Len(t, host.received(), 0)
+
+	status, _ := sw1.PortSecurityStatus(swHost)
+	assert.True(t, status.Shutdown)
+	assert.Equal(t, uint64(1), status.Violations)
+
+	sw1.ResetPortSecurity(swHost)
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	exu.AllSettled()
+	assert.Len(t, other.received(), 2)
+}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPrivateVlan(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 6)
+	assert.NoError(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{
+		Primary:   100,
+		Isolated:  101,
+		Community: []uint16{102, 103},
+	}))
+
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "uplink")
+	iso1 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "iso1")
+	iso2 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "iso2")
+	comA1 := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "comA1")
+	comA2 := newCapturePort(mustParseMAC("42:69:00:00:00:05"), "comA2")
+	comB := newCapturePort(mustParseMAC("42:69:00:00:00:06"), "comB")
+
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, uplink), exu.PortModeConfig{Mode: exu.PrivateVlanPromiscuous, Vlan: 100})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, iso1), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 101})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, iso2), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 101})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, comA1), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 102})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, comA2), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 102})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, comB), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 103})
+
+	all := []*capturePort{uplink, iso1, iso2, comA1, comA2, comB}
+	broadcast := func(from *capturePort) map[*capturePort]int {
+		before := make(map[*capturePort]int)
+		for _, p := range all {
+			before[p] = countFrom(p.received(), from)
+		}
+
+		_ = from.Write(helloFrame(exu.BroadcastMAC, from.Mac()))
+		exu.AllSettled()
+
+		received := make(map[*capturePort]int)
+		for _, p := range all {
+			if n := countFrom(p.received(), from) - before[p]; n > 0 {
+				received[p] = n
+			}
+		}
+		return received
+	}
+
+	assert.Equal(t, map[*capturePort]int{uplink: 1}, broadcast(iso1))
+	assert.Equal(t, map[*capturePort]int{uplink: 1}, broadcast(iso2))
+	assert.Equal(t, map[*capturePort]int{uplink: 1, comA2: 1}, broadcast(comA1))
+	assert.Equal(t, map[*capturePort]int{uplink: 1}, broadcast(comB))
+	assert.Equal(t, map[*capturePort]int{iso1: 1, iso2: 1, comA1: 1, comA2: 1, comB: 1}, broadcast(uplink))
+
+	// all addresses are learned in the primary vlan
+	assert.Len(t, sw1.MacAddressTable(exu.MacFilterVlan(100)), 5)
+
+	// known unicast between isolated hosts is dropped
+	_ = iso1.Write(helloFrame(iso2.Mac(), iso1.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, 0, countFrom(iso2.received(), iso1))
+
+	// known unicast between the uplink and the hosts is delivered
+	_ = iso1.Write(helloFrame(uplink.Mac(), iso1.Mac()))
+	_ = uplink.Write(helloFrame(iso1.Mac(), uplink.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, 2, countFrom(uplink.received(), iso1))
+	assert.Equal(t, 2, countFrom(iso1.received(), uplink))
+}
+
+func TestPrivateVlanConfig(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	assert.Error(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{}))
+	assert.Error(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 100, Isolated: 101, Community: []uint16{101}}))
+	assert.NoError(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 100, Isolated: 101}))
+	assert.Error(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 101}))
+	assert.Error(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 200, Isolated: 101}))
+	assert.Error(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 200, Isolated: 100}))
+
+	// replacing the private vlan frees its old secondary vlans
+	assert.NoError(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 100, Isolated: 102}))
+	assert.NoError(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{Primary: 200, Isolated: 101}))
+
+	// host ports of a removed private vlan drop all traffic
+	host := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "host")
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "uplink")
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, host), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 101})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, uplink), exu.PortModeConfig{Mode: exu.PrivateVlanPromiscuous, Vlan: 200})
+	sw1.RemovePrivateVlan(200)
+
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	exu.AllSettled()
+	assert.Empty(t, uplink.received())
+}
+
+func TestPrivateVlanStaticMacAddress(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	assert.NoError(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{
+		Primary:   100,
+		Isolated:  101,
+		Community: []uint16{102},
+	}))
+
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "uplink")
+	comA1 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "comA1")
+	comA2 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "comA2")
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, uplink), exu.PortModeConfig{Mode: exu.PrivateVlanPromiscuous, Vlan: 100})
+	swComA1 := connectCapturePort(t, sw1.EthernetDevice, comA1)
+	sw1.SetPortMode(swComA1, exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 102})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, comA2), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 102})
+
+	// a static entry of the secondary vlan is kept in the table of the primary vlan
+	assert.NoError(t, sw1.AddStaticMacAddress(102, comA1.Mac(), swComA1))
+	entries := sw1.MacAddressTable(exu.MacFilterVlan(100))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, exu.MacAddressStatic, entries[0].Type)
+	}
+
+	// and matches traffic to the host without flooding it
+	_ = uplink.Write(helloFrame(comA1.Mac(), uplink.Mac()))
+	exu.AllSettled()
+	assert.Equal(t, 1, countFrom(comA1.received(), uplink))
+	assert.Equal(t, 0, countFrom(comA2.received(), uplink))
+
+	assert.NoError(t, sw1.RemoveStaticMacAddress(102, comA1.Mac()))
+	assert.Empty(t, sw1.MacAddressTable(exu.MacFilterVlan(100), exu.MacFilterType(exu.MacAddressStatic)))
+}
+
+func TestPrivateVlanMacAddressTable(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	assert.NoError(t, sw1.SetPrivateVlan(exu.PrivateVlanConfig{
+		Primary:   100,
+		Isolated:  101,
+		Community: []uint16{102},
+	}))
+
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "uplink")
+	iso := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "iso")
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, uplink), exu.PortModeConfig{Mode: exu.PrivateVlanPromiscuous, Vlan: 100})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, iso), exu.PortModeConfig{Mode: exu.PrivateVlanHost, Vlan: 101})
+
+	_ = uplink.Write(helloFrame(exu.BroadcastMAC, uplink.Mac()))
+	_ = iso.Write(helloFrame(exu.BroadcastMAC, iso.Mac()))
+	exu.AllSettled()
+
+	// the shared table of the private VLAN is selected by each of its VLANs
+	for _, vlan := range []uint16{100, 101, 102} {
+		entries := sw1.MacAddressTable(exu.MacFilterVlan(vlan))
+		if assert.Len(t, entries, 2, "vlan %d", vlan) {
+			assert.Equal(t, uint16(100), entries[0].Vlan)
+		}
+	}
+	assert.Empty(t, sw1.MacAddressTable(exu.MacFilterVlan(103)))
+
+	sw1.FlushMacAddresses(exu.MacFilterVlan(101), exu.MacFilterMac(iso.Mac()))
+	assert.Len(t, sw1.MacAddressTable(exu.MacFilterVlan(100)), 1)
+
+	sw1.FlushMacAddressesInVlan(102)
+	assert.Empty(t, sw1.MacAddressTable(exu.MacFilterVlan(100)))
+}
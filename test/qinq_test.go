@@ -0,0 +1,267 @@
+package test
+
+import (
+	"bytes"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func customerFrame(t *testing.T, src *capturePort, cvlan uint16) *exu.EthernetFrame {
+	frame := helloFrame(exu.BroadcastMAC, src.Mac())
+	if cvlan != 0 {
+		if err := frame.PushTag(exu.VlanTag{PCP: 5, VID: cvlan}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return frame
+}
+
+func customerBpdu(t *testing.T, src *capturePort) *exu.EthernetFrame {
+	bpdu := &exu.BpduPacket{
+		Version:  exu.BpduVersionSTP,
+		Type:     exu.BpduTypeConfig,
+		RootID:   exu.BridgeID{Priority: 0, Mac: src.Mac()},
+		BridgeID: exu.BridgeID{Priority: 0, Mac: src.Mac()},
+		PortID:   0x8001,
+		MaxAge:   20 * 256,
+	}
+	frame, err := exu.NewEthernetFrame(exu.BpduMAC, src.Mac(), exu.WithTagging(exu.TaggingUntagged), bpdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestQinQServiceTag(t *testing.T) {
+	pe1 := exu.NewVSwitch("pe1", 2)
+
+	customer := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "customer")
+	core := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "core")
+	pe1.SetPortMode(connectCapturePort(t, pe1.EthernetDevice, customer), exu.PortModeConfig{Mode: exu.Dot1qTunnel, Vlan: 100})
+	pe1.SetPortMode(connectCapturePort(t, pe1.EthernetDevice, core), exu.PortModeTrunk)
+
+	// a customer tagged frame leaves the provider port with the service tag on top
+	_ = customer.Write(customerFrame(t, customer, 10))
+	_ = customer.Write(customerFrame(t, customer, 0))
+	exu.AllSettled()
+
+	frames := core.received()
+	assert.Len(t, frames, 2)
+	for _, frame := range frames {
+		// both carry an 802.1ad service tag
+		assert.Equal(t, []byte{0x88, 0xa8}, frame.Tags()[:2])
+		assert.Equal(t, uint16(100), frame.VlanID())
+		if frame.Tagging() == exu.TaggingDoubleTagged {
+			assert.Equal(t, uint16(10), frame.InnerVlanID())
+			assert.Equal(t, uint8(5), frame.PCP())
+		} else {
+			assert.Equal(t, customerFrame(t, customer, 0).EtherType(), frame.EtherType())
+		}
+	}
+
+	// the service tag is removed towards the customer, the customer tag is kept
+	reply := customerFrame(t, core, 10)
+	assert.NoError(t, reply.PushTag(exu.VlanTag{VID: 100}))
+	_ = core.Write(reply)
+	exu.AllSettled()
+
+	assert.Len(t, customer.received(), 1)
+	assert.Equal(t, exu.TaggingTagged, customer.received()[0].Tagging())
+	assert.Equal(t, uint16(10), customer.received()[0].VlanID())
+
+	// as is an untagged customer frame with only a service tag
+	reply = customerFrame(t, core, 0)
+	assert.NoError(t, reply.PushServiceTag(exu.VlanTag{VID: 100}))
+	_ = core.Write(reply)
+	exu.AllSettled()
+
+	assert.Len(t, customer.received(), 2)
+	assert.Equal(t, exu.TaggingUntagged, customer.received()[1].Tagging())
+
+	// customers can not send frames that are double tagged already
+	double := customerFrame(t, customer, 10)
+	assert.NoError(t, double.PushTag(exu.VlanTag{VID: 100}))
+	_ = customer.Write(double)
+	exu.AllSettled()
+	assert.Len(t, core.received(), 2)
+}
+
+func TestQinQNativeServiceVlan(t *testing.T) {
+	pe1 := exu.NewVSwitch("pe1", 2)
+
+	customer := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "customer")
+	core := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "core")
+	pe1.SetPortMode(connectCapturePort(t, pe1.EthernetDevice, customer), exu.PortModeConfig{Mode: exu.Dot1qTunnel, Vlan: 100})
+	pe1.SetPortMode(connectCapturePort(t, pe1.EthernetDevice, core), exu.PortModeConfig{Mode: exu.Trunk, NativeVlan: 100})
+
+	// the service tag is kept even if the service VLAN is the native VLAN of the trunk
+	_ = customer.Write(customerFrame(t, customer, 10))
+	exu.AllSettled()
+	_ = customer.Write(customerFrame(t, customer, 0))
+	exu.AllSettled()
+
+	frames := core.received()
+	if assert.Len(t, frames, 2) {
+		assert.Equal(t, exu.TaggingDoubleTagged, frames[0].Tagging())
+		assert.Equal(t, uint16(100), frames[0].VlanID())
+		assert.Equal(t, uint16(10), frames[0].InnerVlanID())
+		assert.Equal(t, []byte{0x88, 0xa8}, frames[1].Tags()[:2])
+		assert.Equal(t, uint16(100), frames[1].VlanID())
+	}
+}
+
+// qinqSites connects two sites of customers A (service VLAN 100) and B (service
+// VLAN 200) through two provider edge switches
+//
+//	a1, b1 - pe1 <-> pe2 - a2, b2
+func qinqSites(t *testing.T, l2pt bool) ([2]*exu.VSwitch, [4]*capturePort) {
+	pe1 := exu.NewVSwitch("pe1", 3)
+	pe2 := exu.NewVSwitch("pe2", 3)
+
+	core1 := pe1.GetFirstFreePort()
+	core2 := pe2.GetFirstFreePort()
+	if err := pe1.ConnectPorts(core1, core2); err != nil {
+		t.Fatal(err)
+	}
+	pe1.SetPortMode(core1, exu.PortModeTrunk)
+	pe2.SetPortMode(core2, exu.PortModeTrunk)
+
+	sites := [4]*capturePort{
+		newCapturePort(mustParseMAC("42:69:00:00:0a:01"), "a1"),
+		newCapturePort(mustParseMAC("42:69:00:00:0b:01"), "b1"),
+		newCapturePort(mustParseMAC("42:69:00:00:0a:02"), "a2"),
+		newCapturePort(mustParseMAC("42:69:00:00:0b:02"), "b2"),
+	}
+	for i, site := range sites {
+		pe := pe1
+		if i >= 2 {
+			pe = pe2
+		}
+		vlan := uint16(100)
+		if i%2 == 1 {
+			vlan = 200
+		}
+		pe.SetPortMode(connectCapturePort(t, pe.EthernetDevice, site), exu.PortModeConfig{
+			Mode:             exu.Dot1qTunnel,
+			Vlan:             vlan,
+			L2ProtocolTunnel: l2pt,
+		})
+	}
+
+	return [2]*exu.VSwitch{pe1, pe2}, sites
+}
+
+func TestQinQTransparentService(t *testing.T) {
+	_, sites := qinqSites(t, false)
+	a1, b1, a2, b2 := sites[0], sites[1], sites[2], sites[3]
+
+	// both customers use the same customer vlan without seeing each other
+	_ = a1.Write(customerFrame(t, a1, 10))
+	_ = b1.Write(customerFrame(t, b1, 10))
+	exu.AllSettled()
+
+	assert.Equal(t, 1, countFrom(a2.received(), a1))
+	assert.Equal(t, 0, countFrom(a2.received(), b1))
+	assert.Equal(t, 1, countFrom(b2.received(), b1))
+	assert.Equal(t, 0, countFrom(b2.received(), a1))
+
+	// the customer gets its own 802.1Q tag back
+	frame := a2.received()[0]
+	assert.Equal(t, []byte{0x81, 0x00}, frame.Tags()[:2])
+	assert.Equal(t, uint16(10), frame.VlanID())
+}
+
+func TestQinQCoreSwitch(t *testing.T) {
+	pe1 := exu.NewVSwitch("pe1", 2)
+	p1 := exu.NewVSwitch("p1", 3)
+	pe2 := exu.NewVSwitch("pe2", 2)
+
+	// pe1 <-> p1 <-> pe2, the core switch p1 only has trunk ports
+	for _, pair := range [][2]*exu.VSwitch{{pe1, p1}, {p1, pe2}} {
+		a, b := pair[0].GetFirstFreePort(), pair[1].GetFirstFreePort()
+		if err := pair[0].ConnectPorts(a, b); err != nil {
+			t.Fatal(err)
+		}
+		pair[0].SetPortMode(a, exu.PortModeTrunk)
+		pair[1].SetPortMode(b, exu.PortModeTrunk)
+	}
+
+	tap := newCapturePort(mustParseMAC("42:69:00:00:00:ff"), "tap")
+	p1.SetPortMode(connectCapturePort(t, p1.EthernetDevice, tap), exu.PortModeTrunk)
+
+	a1 := newCapturePort(mustParseMAC("42:69:00:00:0a:01"), "a1")
+	a2 := newCapturePort(mustParseMAC("42:69:00:00:0a:02"), "a2")
+	pe1.SetPortMode(connectCapturePort(t, pe1.EthernetDevice, a1), exu.PortModeConfig{Mode: exu.Dot1qTunnel, Vlan: 100})
+	pe2.SetPortMode(connectCapturePort(t, pe2.EthernetDevice, a2), exu.PortModeConfig{Mode: exu.Dot1qTunnel, Vlan: 100})
+
+	_ = a1.Write(customerFrame(t, a1, 0))
+	exu.AllSettled()
+	_ = a1.Write(customerFrame(t, a1, 10))
+	exu.AllSettled()
+
+	// the core switch keeps the service tag whether the customer frame is tagged or not
+	frames := tap.received()
+	if assert.Len(t, frames, 2) {
+		for _, frame := range frames {
+			assert.Equal(t, []byte{0x88, 0xa8}, frame.Tags()[:2])
+			assert.Equal(t, uint16(100), frame.VlanID())
+		}
+		assert.Equal(t, exu.TaggingTagged, frames[0].Tagging())
+		assert.Equal(t, exu.TaggingDoubleTagged, frames[1].Tagging())
+	}
+
+	// and the other site gets the customer frames as they were sent
+	received := a2.received()
+	if assert.Len(t, received, 2) {
+		assert.Equal(t, exu.TaggingUntagged, received[0].Tagging())
+		assert.Equal(t, []byte{0x81, 0x00}, received[1].Tags()[:2])
+		assert.Equal(t, uint16(10), received[1].VlanID())
+	}
+}
+
+func TestQinQBpduTunneling(t *testing.T) {
+	for _, l2pt := range []bool{false, true} {
+		pes, sites := qinqSites(t, l2pt)
+		for _, pe := range pes {
+			pe.EnableStp(exu.StpConfig{
+				HelloTime:    20 * time.Millisecond,
+				MaxAge:       200 * time.Millisecond,
+				ForwardDelay: 50 * time.Millisecond,
+			})
+		}
+		a1, a2, b2 := sites[0], sites[2], sites[3]
+
+		// wait until all ports are forwarding
+		time.Sleep(200 * time.Millisecond)
+
+		_ = a1.Write(customerBpdu(t, a1))
+		exu.AllSettled()
+		for _, pe := range pes {
+			pe.DisableStp()
+		}
+
+		// the provider switches do not take part in the customer spanning tree
+		for _, pe := range pes {
+			assert.NotEqual(t, a1.Mac(), pe.StpRootID().Mac)
+		}
+
+		count := 0
+		for _, frame := range a2.received() {
+			if bytes.Equal(frame.Destination(), exu.BpduMAC) {
+				count++
+				assert.Equal(t, a1.Mac(), frame.Source())
+			}
+		}
+		for _, frame := range b2.received() {
+			assert.False(t, bytes.Equal(frame.Destination(), exu.BpduMAC))
+		}
+
+		if l2pt {
+			assert.Equal(t, 1, count)
+		} else {
+			assert.Equal(t, 0, count)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package test
 
 import (
+	"encoding/binary"
 	"exu"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestSimpleRouting(t *testing.T) {
@@ -153,3 +156,494 @@ func TestSimpleRouting(t *testing.T) {
 	dstMac, _ := v1.ArpResolve(net.IPv4(172, 0, 0, 2))
 	assert.Equal(t, v2Port.Mac(), dstMac)
 }
+
+// arpReply returns the ARP reply telling dst, which has the address dstIP, that
+// srcIP is at src.
+func arpReply(t *testing.T, src *capturePort, srcIP net.IP, dst *exu.VPort, dstIP net.IP) *exu.EthernetFrame {
+	arp := exu.NewArpPayload(exu.ArpHardwareTypeEthernet, exu.ArpProtocolTypeIPv4, exu.ArpOpcodeReply,
+		src.Mac(), srcIP, dst.Mac(), dstIP)
+	frame, err := exu.NewEthernetFrame(dst.Mac(), src.Mac(), exu.WithTagging(exu.TaggingUntagged), arp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// receivedIPv4 returns the IPv4 packets received by c.
+func receivedIPv4(t *testing.T, c *capturePort) []*exu.IPv4Packet {
+	packets := make([]*exu.IPv4Packet, 0)
+	for _, frame := range c.received() {
+		if frame.EtherType().Equal(exu.EtherTypeIPv4) {
+			packet := &exu.IPv4Packet{}
+			assert.NoError(t, packet.UnmarshalBinary(frame.Payload()))
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+func TestRouterLongestPrefixMatch(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 3)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:0a"), "a")
+	b := newCapturePort(mustParseMAC("42:69:00:00:00:0b"), "b")
+	r1H1 := connectCapturePort(t, r1.EthernetDevice, h1)
+	r1.SetPortIPNet(r1H1, net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)})
+	r1A := connectCapturePort(t, r1.EthernetDevice, a)
+	r1B := connectCapturePort(t, r1.EthernetDevice, b)
+	r1.SetPortIPNet(r1A, net.IPNet{IP: net.IPv4(192, 168, 1, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(r1B, net.IPNet{IP: net.IPv4(192, 168, 2, 1), Mask: net.CIDRMask(24, 32)})
+	_ = a.Write(arpReply(t, a, net.IPv4(192, 168, 1, 2), r1A, net.IPv4(192, 168, 1, 1)))
+	_ = b.Write(arpReply(t, b, net.IPv4(192, 168, 2, 2), r1B, net.IPv4(192, 168, 2, 1)))
+	exu.AllSettled()
+
+	// the shorter prefix is added first and must not shadow the longer one
+	assert.NoError(t, r1.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(16, 32)},
+		Via:     net.IPv4(192, 168, 1, 2),
+	}))
+	assert.NoError(t, r1.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4(172, 16, 5, 0), Mask: net.CIDRMask(24, 32)},
+		Via:     net.IPv4(192, 168, 2, 2),
+	}))
+
+	route, ok := r1.LookupRoute(net.ParseIP("172.16.5.1"))
+	assert.True(t, ok)
+	assert.Equal(t, net.IPv4(192, 168, 2, 2).To4(), route.Via)
+
+	route, ok = r1.LookupRoute(net.ParseIP("172.16.6.1"))
+	assert.True(t, ok)
+	assert.Equal(t, net.IPv4(192, 168, 1, 2).To4(), route.Via)
+
+	send := func(dst string) {
+		_ = h1.Write(routedFrame(t, h1, r1H1.Mac(), net.ParseIP("10.0.0.2"), net.ParseIP(dst), 0, 8))
+		exu.AllSettled()
+	}
+
+	send("172.16.5.1")
+	assert.Len(t, receivedIPv4(t, a), 0)
+	assert.Len(t, receivedIPv4(t, b), 1)
+
+	send("172.16.6.1")
+	assert.Len(t, receivedIPv4(t, a), 1)
+	assert.Len(t, receivedIPv4(t, b), 1)
+
+	// without a default route, packets to unknown networks are dropped
+	_, ok = r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.False(t, ok)
+	send("8.8.8.8")
+	assert.Len(t, receivedIPv4(t, a), 1)
+	assert.Len(t, receivedIPv4(t, b), 1)
+
+	// of two routes to the same network, the lowest next hop wins regardless of order
+	assert.NoError(t, r1.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4(172, 17, 0, 0), Mask: net.CIDRMask(16, 32)},
+		Via:     net.IPv4(192, 168, 2, 2),
+	}))
+	assert.NoError(t, r1.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4(172, 17, 0, 0), Mask: net.CIDRMask(16, 32)},
+		Via:     net.IPv4(192, 168, 1, 2),
+	}))
+	route, _ = r1.LookupRoute(net.ParseIP("172.17.0.1"))
+	assert.Equal(t, net.IPv4(192, 168, 1, 2).To4(), route.Via)
+
+	// a default route catches everything else
+	defaultRoute := exu.Route{
+		Network: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Via:     net.IPv4(192, 168, 2, 2),
+	}
+	assert.NoError(t, r1.AddRoute(defaultRoute))
+	route, ok = r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.True(t, ok)
+	assert.Equal(t, defaultRoute.Via.To4(), route.Via)
+	assert.Equal(t, r1B, route.Port)
+}
+
+func TestRouterConnectedRoutes(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 2)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	h2 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h2")
+	r1H1 := connectCapturePort(t, r1.EthernetDevice, h1)
+	r1H2 := connectCapturePort(t, r1.EthernetDevice, h2)
+	r1.SetPortIPNet(r1H1, net.IPNet{IP: net.IPv4(10, 0, 1, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(r1H2, net.IPNet{IP: net.IPv4(10, 0, 2, 1), Mask: net.CIDRMask(24, 32)})
+
+	h1IP := net.IPv4(10, 0, 1, 2)
+	h2IP := net.IPv4(10, 0, 2, 2)
+
+	// the networks of the ports are routed to without any static routes
+	route, ok := r1.LookupRoute(h2IP)
+	assert.True(t, ok)
+	assert.Nil(t, route.Via)
+	assert.Equal(t, r1H2, route.Port)
+	assert.Equal(t, net.IPv4(10, 0, 2, 0).To4(), route.Network.IP.To4())
+
+	// the destination itself is resolved, not a next hop
+	_ = h1.Write(routedFrame(t, h1, r1H1.Mac(), h1IP, h2IP, 0, 8))
+	assert.Eventually(t, func() bool {
+		return len(h2.received()) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	request := &exu.ArpPacket{}
+	assert.NoError(t, request.FromBytes(h2.received()[0].Payload()))
+	assert.Equal(t, exu.ArpOpcodeRequest, request.Opcode)
+	assert.Equal(t, h2IP.To4(), request.TargetIP.To4())
+	assert.Equal(t, net.IPv4(10, 0, 2, 1).To4(), request.SenderIP.To4())
+	assert.Equal(t, r1H2.Mac(), request.SenderMac)
+
+	_ = h2.Write(arpReply(t, h2, h2IP, r1H2, net.IPv4(10, 0, 2, 1)))
+	exu.AllSettled()
+
+	frame, packet := lastIPv4(t, h2)
+	assert.Equal(t, h2.Mac(), frame.Destination())
+	assert.Equal(t, r1H2.Mac(), frame.Source())
+	assert.Equal(t, uint8(63), packet.Header.TTL)
+
+	// readdressing a port replaces its connected route
+	r1.SetPortIPNet(r1H2, net.IPNet{IP: net.IPv4(10, 0, 3, 1), Mask: net.CIDRMask(24, 32)})
+	_, ok = r1.LookupRoute(h2IP)
+	assert.False(t, ok)
+	route, ok = r1.LookupRoute(net.IPv4(10, 0, 3, 2))
+	assert.True(t, ok)
+	assert.Equal(t, r1H2, route.Port)
+}
+
+func TestRouterArpQueue(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 2)
+	r1.SetArpTimeout(200 * time.Millisecond)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	h2 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h2")
+	r1H1 := connectCapturePort(t, r1.EthernetDevice, h1)
+	r1H2 := connectCapturePort(t, r1.EthernetDevice, h2)
+	r1.SetPortIPNet(r1H1, net.IPNet{IP: net.IPv4(10, 0, 1, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(r1H2, net.IPNet{IP: net.IPv4(10, 0, 2, 1), Mask: net.CIDRMask(24, 32)})
+
+	h1IP := net.IPv4(10, 0, 1, 2)
+	h2IP := net.IPv4(10, 0, 2, 2)
+
+	// packets to a neighbor that is being resolved are queued, it is only resolved once
+	for i := 0; i < 3; i++ {
+		_ = h1.Write(routedFrame(t, h1, r1H1.Mac(), h1IP, h2IP, 0, 8+i))
+	}
+	assert.Eventually(t, func() bool {
+		return len(h2.received()) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	_ = h2.Write(arpReply(t, h2, h2IP, r1H2, net.IPv4(10, 0, 2, 1)))
+	exu.AllSettled()
+
+	assert.Len(t, h2.received(), 1+3)
+	packets := receivedIPv4(t, h2)
+	if assert.Len(t, packets, 3) {
+		sizes := []int{len(packets[0].Payload), len(packets[1].Payload), len(packets[2].Payload)}
+		assert.ElementsMatch(t, []int{8, 9, 10}, sizes)
+	}
+
+	// the queue is bounded, the senders of the queued packets are told the host is
+	// unreachable if it cannot be resolved
+	unknownIP := net.IPv4(10, 0, 2, 3)
+	for i := 0; i < exu.ArpQueueLimit+4; i++ {
+		_ = h1.Write(routedFrame(t, h1, r1H1.Mac(), h1IP, unknownIP, 0, 8))
+	}
+	exu.AllSettled()
+
+	assert.Len(t, receivedIPv4(t, h2), 3)
+	unreachable := receivedIPv4(t, h1)
+	if assert.Len(t, unreachable, exu.ArpQueueLimit) {
+		assert.Equal(t, net.IPv4(10, 0, 1, 1).To4(), unreachable[0].Header.SourceIP.To4())
+		assert.Equal(t, h1IP.To4(), unreachable[0].Header.DestinationIP.To4())
+
+		icmp := &exu.ICMPPayload{}
+		assert.NoError(t, icmp.UnmarshalBinary(unreachable[0].Payload))
+		assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+		assert.Equal(t, exu.ICMPCodeHostUnreachable, icmp.Code)
+		assert.Equal(t, unknownIP.To4(), net.IP(icmp.Data[4+16:4+20]))
+	}
+}
+
+func TestRouterLookupMatchesLinearScan(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 1)
+	r1.SetPortIPNet(r1.GetFirstFreePort(), net.IPNet{IP: net.IPv4(192, 168, 255, 254), Mask: net.CIDRMask(16, 32)})
+	rng := rand.New(rand.NewSource(1))
+
+	networks := make(map[string]bool)
+	routes := make([]exu.Route, 0, 500)
+	for len(routes) < cap(routes) {
+		length := 8 + rng.Intn(25)
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, rng.Uint32()&0x0f0f0fff)
+		mask := net.CIDRMask(length, 32)
+		route := exu.Route{
+			Network: net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			Via:     net.IPv4(192, 168, byte(len(routes)>>8), byte(len(routes))).To4(),
+		}
+		if networks[route.Network.String()] {
+			continue
+		}
+		networks[route.Network.String()] = true
+
+		assert.NoError(t, r1.AddRoute(route))
+		routes = append(routes, route)
+	}
+
+	for i := 0; i < 5000; i++ {
+		dst := make(net.IP, 4)
+		binary.BigEndian.PutUint32(dst, rng.Uint32()&0x0f0f0fff)
+
+		var expected exu.Route
+		expectedLength := -1
+		for _, route := range routes {
+			length, _ := route.Network.Mask.Size()
+			if route.Network.Contains(dst) && length > expectedLength {
+				expected = route
+				expectedLength = length
+			}
+		}
+
+		route, ok := r1.LookupRoute(dst)
+		assert.Equal(t, expectedLength >= 0, ok)
+		assert.Equal(t, expected.Network, route.Network)
+		assert.Equal(t, expected.Via, route.Via)
+	}
+}
+
+// icmpError returns the ICMP message in packet and the header of the packet it
+// quotes.
+func icmpError(t *testing.T, packet *exu.IPv4Packet) (*exu.ICMPPayload, *exu.IPv4Header) {
+	assert.Equal(t, exu.IPv4ProtocolICMP, packet.Header.Protocol)
+
+	icmp := &exu.ICMPPayload{}
+	assert.NoError(t, icmp.UnmarshalBinary(packet.Payload))
+	assert.Equal(t, icmp.CalculateChecksum(), icmp.Checksum)
+
+	quoted := &exu.IPv4Header{}
+	if assert.Len(t, icmp.Data, 4+20+8) {
+		assert.NoError(t, quoted.UnmarshalBinary(icmp.Data[4:24]))
+	}
+	return icmp, quoted
+}
+
+func TestRouterTraceroute(t *testing.T) {
+	// h1 <-> r1 <-> r2
+	r1 := exu.NewVRouter("r1", 2)
+	r2 := exu.NewVRouter("r2", 2)
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	r1H1 := connectCapturePort(t, r1.EthernetDevice, h1)
+	r1R2 := r1.GetFirstFreePort()
+	r2R1 := r2.GetFirstFreePort()
+	assert.NoError(t, r1.ConnectPorts(r1R2, r2R1))
+
+	r1.SetPortIPNet(r1H1, net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(r1R2, net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(24, 32)})
+	r2.SetPortIPNet(r2R1, net.IPNet{IP: net.IPv4(192, 168, 0, 2), Mask: net.CIDRMask(24, 32)})
+	r2.SetPortIPNet(r2.GetFirstFreePort(), net.IPNet{IP: net.IPv4(172, 16, 0, 1), Mask: net.CIDRMask(24, 32)})
+	assert.NoError(t, r1.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Via:     net.IPv4(192, 168, 0, 2),
+	}))
+	assert.NoError(t, r2.AddRoute(exu.Route{
+		Network: net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+		Via:     net.IPv4(192, 168, 0, 1),
+	}))
+
+	h1IP := net.IPv4(10, 0, 0, 2)
+	_ = h1.Write(arpReply(t, h1, h1IP, r1H1, net.IPv4(10, 0, 0, 1)))
+	exu.AllSettled()
+
+	// every hop answers from the address the probe came in on, a router that is
+	// traced itself with port unreachable from the traced address
+	host := net.IPv4(172, 16, 0, 2)
+	probes := []struct {
+		ttl      byte
+		dst      net.IP
+		src      net.IP
+		icmpType exu.ICMPType
+		code     uint8
+	}{
+		{1, host, net.IPv4(10, 0, 0, 1), exu.ICMPTypeTimeExceeded, exu.ICMPCodeTTLExceeded},
+		{2, host, net.IPv4(192, 168, 0, 2), exu.ICMPTypeTimeExceeded, exu.ICMPCodeTTLExceeded},
+		{2, net.IPv4(172, 16, 0, 1), net.IPv4(172, 16, 0, 1), exu.ICMPTypeDestinationUnreachable, exu.ICMPCodePortUnreachable},
+	}
+	for i, probe := range probes {
+		frame := routedFrame(t, h1, r1H1.Mac(), h1IP, probe.dst, 0, 8)
+		(*frame)[14+8] = probe.ttl
+		_ = h1.Write(frame)
+		exu.AllSettled()
+
+		reply, packet := lastIPv4(t, h1)
+		assert.Len(t, receivedIPv4(t, h1), i+1)
+		assert.Equal(t, h1.Mac(), reply.Destination())
+		assert.Equal(t, probe.src.To4(), packet.Header.SourceIP.To4())
+		assert.Equal(t, h1IP.To4(), packet.Header.DestinationIP.To4())
+
+		icmp, quoted := icmpError(t, packet)
+		assert.Equal(t, probe.icmpType, icmp.Type)
+		assert.Equal(t, probe.code, icmp.Code)
+		assert.Equal(t, probe.dst.To4(), quoted.DestinationIP.To4())
+	}
+}
+
+func TestRouterIcmpErrors(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 2)
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	uplink := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "uplink")
+	r1H1 := connectCapturePort(t, r1.EthernetDevice, h1)
+	r1Uplink := connectCapturePort(t, r1.EthernetDevice, uplink)
+	r1.SetPortIPNet(r1H1, net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(r1Uplink, net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(24, 32)})
+
+	h1IP := net.IPv4(10, 0, 0, 2)
+	send := func(frame *exu.EthernetFrame) (*exu.ICMPPayload, *exu.IPv4Header) {
+		count := len(receivedIPv4(t, h1))
+		_ = h1.Write(frame)
+		exu.AllSettled()
+
+		packets := receivedIPv4(t, h1)
+		if !assert.Len(t, packets, count+1) {
+			t.FailNow()
+		}
+		assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), packets[count].Header.SourceIP.To4())
+		return icmpError(t, packets[count])
+	}
+
+	// without a route the network is unreachable, the original header and 8 bytes of
+	// its payload are quoted
+	sent := routedFrame(t, h1, r1H1.Mac(), h1IP, net.IPv4(8, 8, 8, 8), 0, 100)
+	icmp, _ := send(sent)
+	assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+	assert.Equal(t, exu.ICMPCodeNetUnreachable, icmp.Code)
+	assert.Equal(t, []byte(sent.Payload()[:20+8]), icmp.Data[4:])
+
+	// malformed headers are a parameter problem, the pointer shows where
+	malformed := routedFrame(t, h1, r1H1.Mac(), h1IP, net.IPv4(192, 168, 0, 2), 0, 8)
+	(*malformed)[14] = 0x44
+	icmp, _ = send(malformed)
+	assert.Equal(t, exu.ICMPTypeParameterProblem, icmp.Type)
+	assert.Equal(t, []byte{0, 0, 0, 0}, icmp.Data[0:4])
+
+	malformed = routedFrame(t, h1, r1H1.Mac(), h1IP, net.IPv4(192, 168, 0, 2), 0, 8)
+	(*malformed)[14+3] = 0xff
+	icmp, _ = send(malformed)
+	assert.Equal(t, exu.ICMPTypeParameterProblem, icmp.Type)
+	assert.Equal(t, []byte{2, 0, 0, 0}, icmp.Data[0:4])
+
+	// other protocols than UDP are unreachable on the router itself
+	local := routedFrame(t, h1, r1H1.Mac(), h1IP, net.IPv4(10, 0, 0, 1), 0, 8)
+	(*local)[14+9] = 6
+	icmp, _ = send(local)
+	assert.Equal(t, exu.ICMPTypeDestinationUnreachable, icmp.Type)
+	assert.Equal(t, exu.ICMPCodeProtocolUnreachable, icmp.Code)
+
+	// errors are not answered with errors, nor are broadcasts
+	count := len(h1.received())
+	icmpPayload := &exu.ICMPPayload{Type: exu.ICMPTypeDestinationUnreachable, Data: make([]byte, 4+28)}
+	icmpData, _ := icmpPayload.MarshalBinary()
+	_ = h1.Write(ipv4Frame(t, h1, h1IP, net.IPv4(8, 8, 8, 8), exu.IPv4ProtocolICMP, icmpData))
+	_ = h1.Write(routedFrame(t, h1, r1H1.Mac(), h1IP, net.IPv4(8, 8, 8, 8), 0, 8))
+	exu.AllSettled()
+	assert.Len(t, h1.received(), count+1)
+
+	_ = h1.Write(routedFrame(t, h1, exu.BroadcastMAC, h1IP, net.IPv4(8, 8, 8, 8), 0, 8))
+	exu.AllSettled()
+	assert.Len(t, h1.received(), count+1)
+
+	// errors are rate limited
+	r1.SetIcmpRateLimit(exu.IcmpRateLimit{PerSecond: 0.001, Burst: 2})
+	before := r1.IcmpErrorStatistics()
+	for i := 0; i < 5; i++ {
+		_ = h1.Write(routedFrame(t, h1, r1H1.Mac(), h1IP, net.IPv4(8, 8, 8, 8), 0, 8))
+	}
+	exu.AllSettled()
+	assert.Len(t, h1.received(), count+1+2)
+	assert.Equal(t, exu.IcmpErrorStatistics{Sent: before.Sent + 2, RateLimited: 3}, r1.IcmpErrorStatistics())
+}
+
+func TestRouterRib(t *testing.T) {
+	r1 := exu.NewVRouter("r1", 2)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	a := newCapturePort(mustParseMAC("42:69:00:00:00:0a"), "a")
+	lan := connectCapturePort(t, r1.EthernetDevice, h1)
+	uplink := connectCapturePort(t, r1.EthernetDevice, a)
+	r1.SetPortIPNet(lan, net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)})
+	r1.SetPortIPNet(uplink, net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(24, 32)})
+
+	defaultNetwork := net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	remoteNetwork := net.IPNet{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(16, 32)}
+
+	// a dynamic route loses against a static one, unless the static route floats
+	// above its distance
+	dynamic := exu.Route{Network: defaultNetwork, Via: net.IPv4(192, 168, 0, 3), Source: exu.RouteSourceDynamic}
+	floating := exu.Route{Network: defaultNetwork, Via: net.IPv4(192, 168, 0, 4), Distance: 200}
+	assert.NoError(t, r1.AddRoute(dynamic))
+	assert.NoError(t, r1.AddRoute(floating))
+	assert.Error(t, r1.AddRoute(floating))
+	route, ok := r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.True(t, ok)
+	assert.Equal(t, net.IPv4(192, 168, 0, 3).To4(), route.Via)
+
+	static := exu.Route{Network: defaultNetwork, Via: net.IPv4(192, 168, 0, 2)}
+	assert.NoError(t, r1.AddRoute(static))
+	route, _ = r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.Equal(t, net.IPv4(192, 168, 0, 2).To4(), route.Via)
+
+	// of routes with the same distance the lower metric wins
+	assert.NoError(t, r1.AddRoute(exu.Route{Network: remoteNetwork, Via: net.IPv4(192, 168, 0, 5), Metric: 20}))
+	assert.NoError(t, r1.AddRoute(exu.Route{Network: remoteNetwork, Via: net.IPv4(192, 168, 0, 6), Metric: 10}))
+	route, _ = r1.LookupRoute(net.ParseIP("172.16.0.1"))
+	assert.Equal(t, net.IPv4(192, 168, 0, 6).To4(), route.Via)
+
+	// replacing a route drops the other routes of its source to the network
+	assert.NoError(t, r1.ReplaceRoute(exu.Route{Network: remoteNetwork, Via: net.IPv4(192, 168, 0, 7), Metric: 30}))
+	route, _ = r1.LookupRoute(net.ParseIP("172.16.0.1"))
+	assert.Equal(t, net.IPv4(192, 168, 0, 7).To4(), route.Via)
+
+	// next hops are resolved through other routes
+	assert.NoError(t, r1.AddRoute(exu.Route{Network: net.IPNet{IP: net.IPv4(172, 17, 0, 0), Mask: net.CIDRMask(16, 32)}, Via: net.IPv4(172, 16, 0, 1)}))
+	route, ok = r1.LookupRoute(net.ParseIP("172.17.0.1"))
+	assert.True(t, ok)
+	assert.Equal(t, net.IPv4(192, 168, 0, 7).To4(), route.Via)
+	assert.Equal(t, uplink, route.Port)
+
+	var lines []string
+	for _, entry := range r1.Routes() {
+		lines = append(lines, entry.String())
+	}
+	assert.Equal(t, []string{
+		"S* 0.0.0.0/0 [1/0] via 192.168.0.2, eth0/1",
+		"D  0.0.0.0/0 [120/0] via 192.168.0.3",
+		"S  0.0.0.0/0 [200/0] via 192.168.0.4",
+		"C* 10.0.0.0/24 is directly connected, eth0/0",
+		"S* 172.16.0.0/16 [1/30] via 192.168.0.7, eth0/1",
+		"S* 172.17.0.0/16 [1/0] via 172.16.0.1, eth0/1",
+		"C* 192.168.0.0/24 is directly connected, eth0/1",
+	}, lines)
+
+	entries := r1.Routes()
+	assert.Equal(t, net.IPv4(192, 168, 0, 7).To4(), entries[5].NextHop)
+	assert.Equal(t, uplink, entries[5].EgressPort)
+	assert.True(t, entries[1].Active)
+	assert.False(t, entries[1].Selected)
+
+	// deleting the static route falls back to the dynamic one
+	assert.NoError(t, r1.DeleteRoute(static))
+	assert.Error(t, r1.DeleteRoute(static))
+	route, _ = r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.Equal(t, net.IPv4(192, 168, 0, 3).To4(), route.Via)
+
+	assert.NoError(t, r1.DeleteRoute(dynamic))
+	route, _ = r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.Equal(t, net.IPv4(192, 168, 0, 4).To4(), route.Via)
+
+	// routes whose next hop cannot be resolved anymore are withdrawn
+	r1.SetPortIPNet(uplink, net.IPNet{IP: net.IPv4(192, 168, 1, 1), Mask: net.CIDRMask(24, 32)})
+	_, ok = r1.LookupRoute(net.ParseIP("8.8.8.8"))
+	assert.False(t, ok)
+
+	entries = r1.Routes()
+	assert.False(t, entries[0].Active)
+	assert.Equal(t, "S  0.0.0.0/0 [200/0] via 192.168.0.4 (unresolved)", entries[0].String())
+}
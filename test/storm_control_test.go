@@ -0,0 +1,115 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStormControlDrop(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	noisy := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "noisy")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "other")
+	swNoisy := connectCapturePort(t, sw1.EthernetDevice, noisy)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+
+	var events atomic.Int32
+	sw1.SetOnStormControl(func(port *exu.VPort, class exu.StormControlClass, action exu.StormControlAction) {
+		assert.Equal(t, exu.StormControlBroadcast, class)
+		assert.Equal(t, exu.StormControlDrop, action)
+		events.Add(1)
+	})
+	sw1.EnableStormControl(swNoisy, exu.StormControlConfig{
+		Thresholds: map[exu.StormControlClass]exu.StormControlThreshold{
+			exu.StormControlBroadcast: {PacketsPerSecond: 5},
+		},
+	})
+
+	for i := 0; i < 10; i++ {
+		_ = noisy.Write(helloFrame(exu.BroadcastMAC, noisy.Mac()))
+		exu.AllSettled()
+	}
+
+	// unknown unicast is not limited
+	_ = noisy.Write(helloFrame(mustParseMAC("42:69:00:00:00:ff"), noisy.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, other.received(), 6)
+	assert.Equal(t, int32(1), events.Load())
+
+	status, ok := sw1.StormControlStatus(swNoisy)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), status.Dropped[exu.StormControlBroadcast])
+	assert.False(t, status.Shutdown)
+}
+
+func TestStormControlShutdown(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	noisy := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "noisy")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "other")
+	swNoisy := connectCapturePort(t, sw1.EthernetDevice, noisy)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+
+	// 8000 bit/s link, 1% are 10 bytes per second
+	sw1.EnableStormControl(swNoisy, exu.StormControlConfig{
+		LinkSpeed: 8000,
+		Thresholds: map[exu.StormControlClass]exu.StormControlThreshold{
+			exu.StormControlMulticast: {Percent: 1},
+		},
+		Action: exu.StormControlShutdown,
+	})
+
+	_ = noisy.Write(helloFrame(mustParseMAC("01:00:5e:00:00:01"), noisy.Mac()))
+	exu.AllSettled()
+	_ = other.Write(helloFrame(noisy.Mac(), other.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, other.received(), 0)
+	assert.Len(t, noisy.received(), 0)
+
+	status, _ := sw1.StormControlStatus(swNoisy)
+	assert.True(t, status.Shutdown)
+
+	sw1.ResetStormControl(swNoisy)
+	_ = other.Write(helloFrame(noisy.Mac(), other.Mac()))
+	exu.AllSettled()
+	assert.Len(t, noisy.received(), 1)
+}
+
+func TestStormControlIgnoresLinkLocal(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 2)
+
+	noisy := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "noisy")
+	other := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "other")
+	swNoisy := connectCapturePort(t, sw1.EthernetDevice, noisy)
+	connectCapturePort(t, sw1.EthernetDevice, other)
+
+	sw1.EnableStormControl(swNoisy, exu.StormControlConfig{
+		Thresholds: map[exu.StormControlClass]exu.StormControlThreshold{
+			exu.StormControlMulticast: {PacketsPerSecond: 2},
+		},
+		Action: exu.StormControlShutdown,
+	})
+
+	// control protocols like STP, LACP and LLDP are not multicast traffic
+	for _, dst := range []string{"01:80:c2:00:00:00", "01:80:c2:00:00:02", "01:80:c2:00:00:0e", "01:80:c2:00:00:0f"} {
+		_ = noisy.Write(helloFrame(mustParseMAC(dst), noisy.Mac()))
+		exu.AllSettled()
+	}
+
+	status, _ := sw1.StormControlStatus(swNoisy)
+	assert.False(t, status.Shutdown)
+	assert.Zero(t, status.Dropped[exu.StormControlMulticast])
+
+	// the rest of the range is
+	for i := 0; i < 3; i++ {
+		_ = noisy.Write(helloFrame(mustParseMAC("01:80:c2:00:00:10"), noisy.Mac()))
+		exu.AllSettled()
+	}
+
+	status, _ = sw1.StormControlStatus(swNoisy)
+	assert.True(t, status.Shutdown)
+}
@@ -0,0 +1,242 @@
+package test
+
+import (
+	"bytes"
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stpLink struct {
+	sw   *exu.VSwitch
+	port *exu.VPort
+}
+
+// stpTriangle connects three switches in a loop, sw1 is the root bridge
+//
+//	sw1 <-> sw2 <-> sw3 <-> sw1
+func stpTriangle(t *testing.T, mode exu.StpMode) ([]*exu.VSwitch, []stpLink) {
+	sw1 := exu.NewVSwitch("sw1", 3)
+	sw2 := exu.NewVSwitch("sw2", 3)
+	sw3 := exu.NewVSwitch("sw3", 3)
+
+	config := exu.StpConfig{
+		Mode:         mode,
+		HelloTime:    50 * time.Millisecond,
+		MaxAge:       500 * time.Millisecond,
+		ForwardDelay: 150 * time.Millisecond,
+	}
+
+	rootConfig := config
+	rootConfig.BridgePriority = 4096
+	sw1.EnableStp(rootConfig)
+	sw2.EnableStp(config)
+	sw3.EnableStp(config)
+
+	links := make([]stpLink, 0)
+	for _, pair := range [][2]*exu.VSwitch{{sw1, sw2}, {sw2, sw3}, {sw3, sw1}} {
+		a := stpLink{sw: pair[0], port: pair[0].GetFirstFreePort()}
+		b := stpLink{sw: pair[1], port: pair[1].GetFirstFreePort()}
+		if err := a.sw.ConnectPorts(a.port, b.port); err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, a, b)
+	}
+
+	return []*exu.VSwitch{sw1, sw2, sw3}, links
+}
+
+func testStpConvergence(t *testing.T, mode exu.StpMode, wait time.Duration) {
+	switches, links := stpTriangle(t, mode)
+	for _, sw := range switches {
+		defer sw.DisableStp()
+	}
+
+	var received atomic.Int32
+	host := exu.NewVPort(mustParseMAC("42:69:00:00:00:01"), "host")
+	host.SetOnReceive(func(data *exu.EthernetFrame) {})
+	sink := exu.NewVPort(mustParseMAC("42:69:00:00:00:02"), "sink")
+	sink.SetOnReceive(func(data *exu.EthernetFrame) {
+		if !bytes.Equal(data.Destination(), exu.BpduMAC) {
+			received.Add(1)
+		}
+	})
+
+	hostPort := switches[1].GetFirstFreePort()
+	switches[1].SetStpPortConfig(hostPort, exu.StpPortConfig{Edge: true})
+	_ = switches[1].ConnectPorts(hostPort, host)
+	sinkPort := switches[2].GetFirstFreePort()
+	switches[2].SetStpPortConfig(sinkPort, exu.StpPortConfig{Edge: true})
+	_ = switches[2].ConnectPorts(sinkPort, sink)
+
+	time.Sleep(wait)
+
+	for _, sw := range switches {
+		assert.Equal(t, switches[0].StpBridgeID(), sw.StpRootID())
+	}
+	assert.Nil(t, switches[0].StpRootPort())
+	assert.Equal(t, exu.StpPortRoleRoot, switches[1].StpPortRole(switches[1].StpRootPort()))
+	assert.Equal(t, exu.StpPortRoleRoot, switches[2].StpPortRole(switches[2].StpRootPort()))
+
+	// exactly one port of the loop is blocking, on the link between sw2 and sw3
+	blocking := make([]stpLink, 0)
+	var blockingPeer stpLink
+	for i, link := range links {
+		if link.sw.StpPortState(link.port) != exu.StpPortStateForwarding {
+			// the links are stored in pairs of both ends
+			blocking = append(blocking, link)
+			blockingPeer = links[i^1]
+			assert.Equal(t, exu.StpPortRoleAlternate, link.sw.StpPortRole(link.port))
+		}
+	}
+	assert.Len(t, blocking, 1)
+	assert.Equal(t, exu.StpPortStateForwarding, switches[1].StpPortState(hostPort))
+	assert.Equal(t, exu.StpPortStateForwarding, switches[2].StpPortState(sinkPort))
+
+	// a broadcast is delivered exactly once instead of looping forever
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, int32(1), received.Load())
+
+	// the blocked port stays blocked once the spanning tree is disabled, so the loop
+	// stays broken
+	for _, sw := range switches {
+		sw.DisableStp()
+	}
+	assert.Equal(t, exu.StpPortStateBlocking, blocking[0].sw.StpPortState(blocking[0].port))
+
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, int32(2), received.Load())
+
+	// once the link of the blocked port goes down, the port forwards again, e.g. to
+	// another device plugged into it
+	blocking[0].sw.DisconnectPort(blockingPeer.port)
+	assert.Equal(t, exu.StpPortStateForwarding, blocking[0].sw.StpPortState(blocking[0].port))
+
+	var replugged atomic.Int32
+	other := exu.NewVPort(mustParseMAC("42:69:00:00:00:03"), "other")
+	other.SetOnReceive(func(data *exu.EthernetFrame) {
+		replugged.Add(1)
+	})
+	assert.NoError(t, blocking[0].sw.ConnectPorts(blocking[0].port, other))
+	assert.Equal(t, exu.StpPortStateForwarding, blocking[0].sw.StpPortState(blocking[0].port))
+
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, int32(1), replugged.Load())
+	assert.Equal(t, int32(3), received.Load())
+}
+
+func TestStpConvergence(t *testing.T) {
+	testStpConvergence(t, exu.StpModeSTP, 800*time.Millisecond)
+}
+
+func TestRstpConvergence(t *testing.T) {
+	testStpConvergence(t, exu.StpModeRSTP, 200*time.Millisecond)
+}
+
+// TestStpPortChannel closes a loop with a port-channel
+//
+//	sw1 <=> sw2 <-> sw3 <-> sw1
+func TestStpPortChannel(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 4)
+	sw2 := exu.NewVSwitch("sw2", 3)
+	sw3 := exu.NewVSwitch("sw3", 3)
+
+	connect := func(a, b *exu.VSwitch) (*exu.VPort, *exu.VPort) {
+		pa, pb := a.GetFirstFreePort(), b.GetFirstFreePort()
+		if err := a.ConnectPorts(pa, pb); err != nil {
+			t.Fatal(err)
+		}
+		return pa, pb
+	}
+
+	a1, b1 := connect(sw1, sw2)
+	a2, b2 := connect(sw1, sw2)
+	pc1, err := sw1.NewPortChannel(exu.PortChannelConfig{Mode: exu.LinkAggregationStatic}, a1, a2)
+	assert.NoError(t, err)
+	pc2, err := sw2.NewPortChannel(exu.PortChannelConfig{Mode: exu.LinkAggregationStatic}, b1, b2)
+	assert.NoError(t, err)
+	sw2Sw3, sw3Sw2 := connect(sw2, sw3)
+	connect(sw3, sw1)
+
+	config := exu.StpConfig{
+		Mode:         exu.StpModeRSTP,
+		HelloTime:    50 * time.Millisecond,
+		MaxAge:       500 * time.Millisecond,
+		ForwardDelay: 150 * time.Millisecond,
+	}
+	rootConfig := config
+	rootConfig.BridgePriority = 4096
+	sw1.EnableStp(rootConfig)
+	sw2.EnableStp(config)
+	sw3.EnableStp(config)
+	for _, sw := range []*exu.VSwitch{sw1, sw2, sw3} {
+		defer sw.DisableStp()
+	}
+
+	var received atomic.Int32
+	host := exu.NewVPort(mustParseMAC("42:69:00:00:00:01"), "host")
+	host.SetOnReceive(func(data *exu.EthernetFrame) {})
+	sink := exu.NewVPort(mustParseMAC("42:69:00:00:00:02"), "sink")
+	sink.SetOnReceive(func(data *exu.EthernetFrame) {
+		if !bytes.Equal(data.Destination(), exu.BpduMAC) {
+			received.Add(1)
+		}
+	})
+	hostPort := sw1.GetFirstFreePort()
+	sw1.SetStpPortConfig(hostPort, exu.StpPortConfig{Edge: true})
+	_ = sw1.ConnectPorts(hostPort, host)
+	sinkPort := sw3.GetFirstFreePort()
+	sw3.SetStpPortConfig(sinkPort, exu.StpPortConfig{Edge: true})
+	_ = sw3.ConnectPorts(sinkPort, sink)
+
+	time.Sleep(300 * time.Millisecond)
+
+	// the port-channel is a single port of the spanning tree, the loop is broken on
+	// the link between sw2 and sw3
+	assert.Equal(t, exu.StpPortRoleDesignated, sw1.StpPortRole(pc1.Port()))
+	assert.Equal(t, pc2.Port(), sw2.StpRootPort())
+	assert.Equal(t, exu.StpPortStateForwarding, sw2.StpPortState(pc2.Port()))
+	blocked := 0
+	for _, link := range []stpLink{{sw2, sw2Sw3}, {sw3, sw3Sw2}} {
+		if link.sw.StpPortState(link.port) != exu.StpPortStateForwarding {
+			blocked++
+		}
+	}
+	assert.Equal(t, 1, blocked)
+
+	_ = host.Write(helloFrame(exu.BroadcastMAC, host.Mac()))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), received.Load())
+}
+
+func TestBpduRoundTrip(t *testing.T) {
+	bpdu := &exu.BpduPacket{
+		Version:      exu.BpduVersionRSTP,
+		Type:         exu.BpduTypeRST,
+		Flags:        exu.BpduFlagProposal | exu.BpduFlagTopologyChange,
+		RootID:       exu.BridgeID{Priority: 4096, Mac: mustParseMAC("42:69:00:00:00:01")},
+		RootPathCost: 20000,
+		BridgeID:     exu.BridgeID{Priority: 32768, Mac: mustParseMAC("42:69:00:00:00:02")},
+		PortID:       0x8001,
+		MessageAge:   256,
+		MaxAge:       20 * 256,
+		HelloTime:    2 * 256,
+		ForwardDelay: 15 * 256,
+	}
+
+	frame, err := exu.NewEthernetFrame(exu.BpduMAC, mustParseMAC("42:69:00:00:00:02"), exu.WithTagging(exu.TaggingUntagged), bpdu)
+	assert.NoError(t, err)
+	assert.Equal(t, exu.EtherType{0x00, 0x27}, frame.EtherType())
+
+	parsed := &exu.BpduPacket{}
+	assert.NoError(t, parsed.UnmarshalBinary(frame.Payload()))
+	assert.Equal(t, bpdu, parsed)
+}
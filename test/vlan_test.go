@@ -0,0 +1,162 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+)
+
+type capturePort struct {
+	*exu.VPort
+	mu     sync.Mutex
+	frames []exu.EthernetFrame
+}
+
+func newCapturePort(mac net.HardwareAddr, name string) *capturePort {
+	c := &capturePort{
+		VPort: exu.NewVPort(mac, name),
+	}
+	c.SetOnReceive(func(data *exu.EthernetFrame) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.frames = append(c.frames, *data)
+	})
+	return c
+}
+
+func (c *capturePort) received() []exu.EthernetFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]exu.EthernetFrame{}, c.frames...)
+}
+
+// connectCapturePort connects c to the first free port of dev and returns the
+// port on the device.
+func connectCapturePort(t *testing.T, dev *exu.EthernetDevice, c *capturePort) *exu.VPort {
+	port := dev.GetFirstFreePort()
+	if err := dev.ConnectPorts(port, c.VPort); err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestVSwitchAccessVlanIsolation(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 4)
+
+	p1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "p1")
+	p2 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "p2")
+	p3 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "p3")
+	trunk := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "trunk")
+
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, p1), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, p2), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, p3), exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, trunk), exu.PortModeTrunk)
+
+	frame := exu.EthernetFrame{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x01,
+		0x10, 0x01,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+	_ = p1.Write(&frame)
+
+	exu.AllSettled()
+
+	assert.Len(t, p2.received(), 1)
+	assert.Equal(t, exu.TaggingUntagged, (&p2.received()[0]).Tagging())
+	assert.Len(t, p3.received(), 0)
+
+	assert.Len(t, trunk.received(), 1)
+	trunkFrame := trunk.received()[0]
+	assert.Equal(t, exu.TaggingTagged, trunkFrame.Tagging())
+	assert.Equal(t, []byte{0x81, 0x00, 0x00, 0x0a}, trunkFrame.Tags())
+	assert.Equal(t, []byte("Hello"), trunkFrame.Payload())
+
+	// a tagged frame for vlan 20 from the trunk only reaches p3, untagged
+	tagged := exu.EthernetFrame{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x04,
+		0x81, 0x00, 0x00, 0x14,
+		0x10, 0x01,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+	_ = trunk.Write(&tagged)
+
+	exu.AllSettled()
+
+	assert.Len(t, p1.received(), 0)
+	assert.Len(t, p2.received(), 1)
+	assert.Len(t, p3.received(), 1)
+	assert.Equal(t, exu.TaggingUntagged, (&p3.received()[0]).Tagging())
+	assert.Equal(t, []byte("Hello"), (&p3.received()[0]).Payload())
+}
+
+func TestVSwitchTrunkNativeAndAllowedVlans(t *testing.T) {
+	sw1 := exu.NewVSwitch("sw1", 4)
+
+	p10 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "p10")
+	p20 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "p20")
+	p30 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "p30")
+	trunk := newCapturePort(mustParseMAC("42:69:00:00:00:04"), "trunk")
+
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, p10), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, p20), exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, p30), exu.PortModeConfig{Mode: exu.Access, Vlan: 30})
+	sw1.SetPortMode(connectCapturePort(t, sw1.EthernetDevice, trunk), exu.PortModeConfig{
+		Mode:         exu.Trunk,
+		NativeVlan:   10,
+		AllowedVlans: []uint16{10, 20},
+	})
+
+	for _, p := range []*capturePort{p10, p20, p30} {
+		frame := exu.EthernetFrame{
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			p.Mac()[0], p.Mac()[1], p.Mac()[2], p.Mac()[3], p.Mac()[4], p.Mac()[5],
+			0x10, 0x01,
+			0x48, 0x65, 0x6c, 0x6c, 0x6f,
+		}
+		_ = p.Write(&frame)
+	}
+
+	exu.AllSettled()
+
+	// vlan 10 is native and leaves untagged, vlan 20 is tagged, vlan 30 is pruned
+	frames := trunk.received()
+	assert.Len(t, frames, 2)
+	vlans := map[exu.VlanTagging]uint16{}
+	for _, f := range frames {
+		vlans[f.Tagging()] = f.VlanID()
+	}
+	assert.Equal(t, map[exu.VlanTagging]uint16{
+		exu.TaggingUntagged: 0,
+		exu.TaggingTagged:   20,
+	}, vlans)
+
+	// untagged frames from the trunk belong to the native vlan, tagged frames of
+	// a disallowed vlan are dropped
+	untagged := exu.EthernetFrame{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x04,
+		0x10, 0x01,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+	_ = trunk.Write(&untagged)
+
+	disallowed := exu.EthernetFrame{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x42, 0x69, 0x00, 0x00, 0x00, 0x04,
+		0x81, 0x00, 0x00, 0x1e,
+		0x10, 0x01,
+		0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	}
+	_ = trunk.Write(&disallowed)
+
+	exu.AllSettled()
+
+	assert.Len(t, p10.received(), 1)
+	assert.Len(t, p20.received(), 0)
+	assert.Len(t, p30.received(), 0)
+}
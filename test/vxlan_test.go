@@ -0,0 +1,160 @@
+package test
+
+import (
+	"exu"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func vxlanPayload(t *testing.T, frame *exu.EthernetFrame) (*exu.UDPPacket, *exu.VXLANPacket) {
+	packet := &exu.IPv4Packet{}
+	if err := packet.UnmarshalBinary(frame.Payload()); err != nil {
+		t.Fatal(err)
+	}
+
+	udp := &exu.UDPPacket{}
+	if err := udp.UnmarshalBinary(packet.Payload); err != nil {
+		t.Fatal(err)
+	}
+
+	vxlan := &exu.VXLANPacket{}
+	if err := vxlan.UnmarshalBinary(udp.Payload); err != nil {
+		t.Fatal(err)
+	}
+	return udp, vxlan
+}
+
+func newVtep(t *testing.T, name string, ip string, underlay *exu.VSwitch) *exu.VVtep {
+	vtep := exu.NewVVtep(name, 3)
+	vtep.SetUnderlayIPNet(net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}, nil)
+	assert.NoError(t, underlay.ConnectToFirstAvailablePort(vtep.Underlay().GetFirstFreePort()))
+	return vtep
+}
+
+func TestVxlanOverlay(t *testing.T) {
+	underlay := exu.NewVSwitch("underlay", 3)
+	vtep1 := newVtep(t, "vtep1", "192.168.0.1", underlay)
+	vtep2 := newVtep(t, "vtep2", "192.168.0.2", underlay)
+	vtep3 := newVtep(t, "vtep3", "192.168.0.3", underlay)
+
+	// the VLAN of a VNI is local to every VTEP
+	assert.NoError(t, vtep1.MapVlanToVni(10, 5010))
+	assert.NoError(t, vtep2.MapVlanToVni(20, 5010))
+	assert.NoError(t, vtep3.MapVlanToVni(10, 5010))
+	assert.Error(t, vtep1.MapVlanToVni(10, 5020))
+	assert.Error(t, vtep1.MapVlanToVni(11, 1<<24))
+
+	vteps := []*exu.VVtep{vtep1, vtep2, vtep3}
+	for i, vtep := range vteps {
+		for j := range vteps {
+			if i != j {
+				assert.NoError(t, vtep.AddRemoteVtep(5010, net.IPv4(192, 168, 0, byte(j+1))))
+			}
+		}
+	}
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	h2 := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "h2")
+	h3 := newCapturePort(mustParseMAC("42:69:00:00:00:03"), "h3")
+	vtep1.SetPortMode(connectCapturePort(t, vtep1.EthernetDevice, h1), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	vtep2.SetPortMode(connectCapturePort(t, vtep2.EthernetDevice, h2), exu.PortModeConfig{Mode: exu.Access, Vlan: 20})
+	vtep3.SetPortMode(connectCapturePort(t, vtep3.EthernetDevice, h3), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+
+	// broadcast is replicated to every remote VTEP
+	_ = h1.Write(helloFrame(exu.BroadcastMAC, h1.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, h2.received(), 1)
+	assert.Len(t, h3.received(), 1)
+	assert.Equal(t, *helloFrame(exu.BroadcastMAC, h1.Mac()), h2.received()[0])
+
+	// the answer only goes to the VTEP h1 was learned behind
+	_ = h2.Write(helloFrame(h1.Mac(), h2.Mac()))
+	exu.AllSettled()
+
+	assert.Len(t, h1.received(), 1)
+	assert.Len(t, h3.received(), 1)
+	assert.Equal(t, []exu.VxlanRemoteMac{
+		{Vni: 5010, Mac: h1.Mac(), Vtep: net.ParseIP("192.168.0.1").To4()},
+	}, vtep2.RemoteMacs())
+	assert.Equal(t, []exu.VxlanRemoteMac{
+		{Vni: 5010, Mac: h2.Mac(), Vtep: net.ParseIP("192.168.0.2").To4()},
+	}, vtep1.RemoteMacs())
+
+	// without the mapping, the VLAN stays local
+	vtep1.UnmapVni(5010)
+	assert.Empty(t, vtep1.RemoteMacs())
+	_ = h1.Write(helloFrame(exu.BroadcastMAC, h1.Mac()))
+	exu.AllSettled()
+	assert.Len(t, h2.received(), 1)
+}
+
+func TestVxlanEncapsulation(t *testing.T) {
+	vtep := exu.NewVVtep("vtep1", 3)
+	vtep.SetUnderlayIPNet(net.IPNet{IP: net.ParseIP("192.168.0.1"), Mask: net.CIDRMask(24, 32)}, nil)
+	assert.NoError(t, vtep.MapVlanToVni(10, 5010))
+	assert.NoError(t, vtep.MapVlanToVni(30, 5030))
+	assert.NoError(t, vtep.AddRemoteVtep(5010, net.ParseIP("192.168.0.2")))
+	assert.NoError(t, vtep.AddRemoteVtep(5030, net.ParseIP("192.168.0.2")))
+	assert.Error(t, vtep.MapPortToVni(vtep.GetFirstFreePort(), 5040))
+
+	remoteIP := net.ParseIP("192.168.0.2")
+	fabric := newCapturePort(mustParseMAC("42:69:00:00:00:ff"), "fabric")
+	connectCapturePort(t, vtep.Underlay().EthernetDevice, fabric)
+
+	h1 := newCapturePort(mustParseMAC("42:69:00:00:00:01"), "h1")
+	customer := newCapturePort(mustParseMAC("42:69:00:00:00:02"), "customer")
+	vtep.SetPortMode(connectCapturePort(t, vtep.EthernetDevice, h1), exu.PortModeConfig{Mode: exu.Access, Vlan: 10})
+	assert.NoError(t, vtep.MapPortToVni(connectCapturePort(t, vtep.EthernetDevice, customer), 5030))
+
+	// the next hop is already resolved
+	arp := exu.NewArpPayload(exu.ArpHardwareTypeEthernet, exu.ArpProtocolTypeIPv4, exu.ArpOpcodeReply,
+		fabric.Mac(), remoteIP, make(net.HardwareAddr, 6), net.ParseIP("192.168.0.1"))
+	reply, _ := exu.NewEthernetFrame(exu.BroadcastMAC, fabric.Mac(), exu.WithTagging(exu.TaggingUntagged), arp)
+	_ = fabric.Write(reply)
+	exu.AllSettled()
+
+	_ = h1.Write(helloFrame(exu.BroadcastMAC, h1.Mac()))
+	exu.AllSettled()
+
+	if assert.Len(t, fabric.received(), 1) {
+		outer := fabric.received()[0]
+		assert.Equal(t, fabric.Mac(), outer.Destination())
+
+		udp, vxlan := vxlanPayload(t, &outer)
+		assert.Equal(t, exu.VxlanPort, udp.DestinationPort)
+		assert.GreaterOrEqual(t, udp.SourcePort, uint16(49152))
+		assert.Equal(t, uint32(5010), vxlan.Vni)
+		assert.Equal(t, *helloFrame(exu.BroadcastMAC, h1.Mac()), vxlan.Frame)
+	}
+
+	// the customer tag of a port mapped to a VNI is carried through the tunnel
+	_ = customer.Write(customerFrame(t, customer, 100))
+	exu.AllSettled()
+
+	if assert.Len(t, fabric.received(), 2) {
+		outer := fabric.received()[1]
+		_, vxlan := vxlanPayload(t, &outer)
+		assert.Equal(t, uint32(5030), vxlan.Vni)
+		assert.Equal(t, exu.TaggingTagged, vxlan.Frame.Tagging())
+		assert.Equal(t, uint16(100), vxlan.Frame.VlanID())
+	}
+
+	// packets from the fabric are decapsulated and switched into the VLAN of the VNI
+	remote := mustParseMAC("42:69:00:00:01:01")
+	packet := &exu.VXLANPacket{Vni: 5010, Frame: *helloFrame(h1.Mac(), remote)}
+	vxlanData, _ := packet.MarshalBinary()
+	udp := &exu.UDPPacket{SourcePort: 50000, DestinationPort: exu.VxlanPort, Payload: vxlanData}
+	udpData, _ := udp.MarshalBinary()
+	_ = fabric.Write(ipv4Frame(t, fabric, remoteIP, net.ParseIP("192.168.0.1"), exu.IPv4ProtocolUDP, udpData))
+	exu.AllSettled()
+
+	if assert.Len(t, h1.received(), 1) {
+		assert.Equal(t, *helloFrame(h1.Mac(), remote), h1.received()[0])
+	}
+	assert.Empty(t, customer.received())
+	assert.Equal(t, []exu.VxlanRemoteMac{
+		{Vni: 5010, Mac: remote, Vtep: remoteIP.To4()},
+	}, vtep.RemoteMacs())
+}
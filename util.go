@@ -2,17 +2,48 @@ package exu
 
 import "sync"
 
-var globalWaitGroup = sync.WaitGroup{}
+// inFlight counts the frames that are being delivered. Unlike a sync.WaitGroup it
+// can be added to while AllSettled is waiting, which happens whenever a protocol
+// timer sends a frame on its own.
+var inFlight = struct {
+	mu sync.Mutex
+	// settled is signalled whenever count drops to zero
+	settled *sync.Cond
+	count   int
+	// generation increases whenever count drops to zero
+	generation uint64
+}{}
+
+func init() {
+	inFlight.settled = sync.NewCond(&inFlight.mu)
+}
 
 func WithWaitGroup(f func()) {
-	globalWaitGroup.Add(1)
+	inFlight.mu.Lock()
+	inFlight.count++
+	inFlight.mu.Unlock()
 
 	go func() {
 		f()
-		globalWaitGroup.Done()
+
+		inFlight.mu.Lock()
+		inFlight.count--
+		if inFlight.count == 0 {
+			inFlight.generation++
+			inFlight.settled.Broadcast()
+		}
+		inFlight.mu.Unlock()
 	}()
 }
 
+// AllSettled waits until no frames are being delivered. Frames sent by timers
+// after that are not waited for.
 func AllSettled() {
-	globalWaitGroup.Wait()
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+
+	generation := inFlight.generation
+	for inFlight.count > 0 && inFlight.generation == generation {
+		inFlight.settled.Wait()
+	}
 }
@@ -3,32 +3,149 @@ package exu
 import (
 	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 var VPortNotConnectedError = errors.New("vPort is not connected")
+var FrameTooLargeError = errors.New("frame exceeds the mtu of the port")
+
+const (
+	// DefaultMTU is the MTU of a port that has none configured
+	DefaultMTU = 1500
+	// MinMTU is the smallest MTU a port can be configured with
+	MinMTU = 68
+	// MaxMTU is the largest MTU a port can be configured with, enough for 9000
+	// byte jumbo frames with room for encapsulation
+	MaxMTU = 9216
+	// MaxFrameSize is the largest frame a port can carry, a double tagged frame
+	// with a payload of MaxMTU bytes
+	MaxFrameSize = 6 + 6 + 8 + 2 + MaxMTU
+)
+
+// VPortCounters counts the frames dropped by a port because they exceeded its MTU.
+type VPortCounters struct {
+	// TxOversize is the number of frames that were too large to be sent
+	TxOversize uint64
+	// RxOversize is the number of received frames that were too large
+	RxOversize uint64
+}
 
 type VPort struct {
-	mac         net.HardwareAddr
+	mac net.HardwareAddr
+	// mu guards connectedTo and onReceive, which the devices on both ends of a link
+	// change while the other one may be sending
+	mu          sync.RWMutex
 	connectedTo *VPort
 	onReceive   func(data *EthernetFrame)
 	portCname   string
+	// writeFn replaces the default write behaviour of logical ports that are not
+	// connected to another port themselves, e.g. port-channels
+	writeFn func(data *EthernetFrame) error
+	// mtu is the largest payload a frame sent or received on the port may have,
+	// VLAN tags do not count towards it. Zero means DefaultMTU.
+	mtu        atomic.Int64
+	txOversize atomic.Uint64
+	rxOversize atomic.Uint64
 }
 
 func (v *VPort) SetOnReceive(onReceive func(data *EthernetFrame)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
 	v.onReceive = onReceive
 }
 
+// peer returns the port v is connected to, or nil.
+func (v *VPort) peer() *VPort {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	return v.connectedTo
+}
+
+func (v *VPort) setPeer(peer *VPort) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.connectedTo = peer
+}
+
+// SetMTU sets the largest payload frames sent or received on the port may have.
+// Larger frames are dropped and counted.
+func (v *VPort) SetMTU(mtu int) error {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return errors.New("mtu must be between 68 and 9216")
+	}
+
+	v.mtu.Store(int64(mtu))
+	return nil
+}
+
+// MTU returns the MTU of the port.
+func (v *VPort) MTU() int {
+	if mtu := v.mtu.Load(); mtu != 0 {
+		return int(mtu)
+	}
+	return DefaultMTU
+}
+
+// Counters returns the oversize drop counters of the port.
+func (v *VPort) Counters() VPortCounters {
+	return VPortCounters{
+		TxOversize: v.txOversize.Load(),
+		RxOversize: v.rxOversize.Load(),
+	}
+}
+
+// payloadSize returns the size of the payload of data, tags not included.
+func payloadSize(data *EthernetFrame) int {
+	if len(*data) < 6+6+2 {
+		return 0
+	}
+	return len(*data) - 6 - 6 - 2 - int(data.Tagging())
+}
+
 func (v *VPort) Write(data *EthernetFrame) error {
-	if v.connectedTo == nil {
+	if payloadSize(data) > v.MTU() {
+		v.txOversize.Add(1)
+		return FrameTooLargeError
+	}
+
+	if v.writeFn != nil {
+		return v.writeFn(data)
+	}
+
+	peer := v.peer()
+	if peer == nil {
+		return VPortNotConnectedError
+	}
+
+	// the peer may be disconnected before the frame arrives
+	peer.mu.RLock()
+	onReceive := peer.onReceive
+	peer.mu.RUnlock()
+	if onReceive == nil {
 		return VPortNotConnectedError
 	}
 
+	// the frame is on the wire, the peer drops it if it exceeds its MTU
+	if payloadSize(data) > peer.MTU() {
+		peer.rxOversize.Add(1)
+		return nil
+	}
+
 	WithWaitGroup(func() {
-		v.connectedTo.onReceive(data)
+		onReceive(data)
 	})
 	return nil
 }
 
+// connected returns true if frames written to the port can reach another port.
+func (v *VPort) connected() bool {
+	return v.peer() != nil || v.writeFn != nil
+}
+
 func (v *VPort) Mac() net.HardwareAddr {
 	return v.mac
 }